@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
 
 	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
 	"github.com/GermanVor/go-tpl/internal/common"
@@ -12,22 +13,29 @@ import (
 
 type GetOrderResponse accrualStor.Order
 
+const retryAfterSeconds = "60"
+
+func writeOrderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, accrualStor.ErrInvalidOrderIDFormat):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, accrualStor.ErrExceededRequestsNumber):
+		// the limiter is reset every minute
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, accrualStor.ErrUnknownOrderID):
+		http.Error(w, err.Error(), http.StatusNoContent)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func GetOrderHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
 	orderID := chi.URLParam(r, "orderID")
 
 	orderPtr, err := stor.GetOrder(orderID)
 	if err != nil {
-		switch {
-		case errors.Is(err, accrualStor.ErrInvalidOrderIDFormat):
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		case errors.Is(err, accrualStor.ErrExceededRequestsNumber):
-			http.Error(w, err.Error(), http.StatusTooManyRequests)
-		case errors.Is(err, accrualStor.ErrUnknownOrderID):
-			http.Error(w, err.Error(), http.StatusNoContent)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-
+		writeOrderError(w, err)
 		return
 	}
 
@@ -42,6 +50,26 @@ func GetOrderHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.In
 	w.WriteHeader(http.StatusOK)
 }
 
+// GetOrderBreakdownHandler explains the accrual of the order, statuses are
+// the same as of GetOrderHandler.
+func GetOrderBreakdownHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
+	breakdown, err := stor.GetOrderBreakdown(chi.URLParam(r, "orderID"))
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(breakdown)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
 func SetOrderHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
 	orderPackage := accrualStor.OrderPackage{}
 
@@ -96,16 +124,212 @@ func SetGoodRewardHandler(w http.ResponseWriter, r *http.Request, stor accrualSt
 	w.WriteHeader(http.StatusOK)
 }
 
+// writeList answers 204 No Content for empty lists.
+func writeList(w http.ResponseWriter, arr interface{}, length int) {
+	if length == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bytes, err := json.Marshal(arr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// GetGoodRewardsHandler serves ?state=active|upcoming|expired, every rule
+// without it, and ?limit=&offset=.
+func GetGoodRewardsHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
+	page, err := common.GetPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state := accrualStor.GoodRewardState(r.URL.Query().Get("state"))
+
+	arr := make([]*accrualStor.GoodReward, 0)
+	err = stor.GoodRewardsForEach(state, page, func(goodReward *accrualStor.GoodReward) error {
+		arr = append(arr, goodReward)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, accrualStor.ErrUnknownGoodRewardState) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	writeList(w, arr, len(arr))
+}
+
+// getMatch returns {match} of the path. chi leaves it escaped when the
+// path has escaped characters, e.g. %2F of a slash in the match.
+func getMatch(r *http.Request) (string, error) {
+	match := chi.URLParam(r, "match")
+	if r.URL.RawPath == "" {
+		return match, nil
+	}
+
+	return url.PathUnescape(match)
+}
+
+func writeGoodRewardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, accrualStor.ErrInvalidGoodReward):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, accrualStor.ErrUnknownGoodReward):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func GetGoodRewardHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
+	match, err := getMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goodReward, err := stor.GetGoodReward(match)
+	if err != nil {
+		writeGoodRewardError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(goodReward)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// UpdateGoodRewardHandler replaces the rule, match of the body may be
+// omitted but must not differ from the path.
+func UpdateGoodRewardHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
+	if r.Header.Get("Content-Type") != common.ApplicationJSONStr {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	match, err := getMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goodReward := accrualStor.GoodReward{}
+	if err := json.NewDecoder(r.Body).Decode(&goodReward); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if goodReward.Match != "" && goodReward.Match != match {
+		http.Error(w, "match of the body differs from the path", http.StatusBadRequest)
+		return
+	}
+	goodReward.Match = match
+
+	err = stor.UpdateGoodReward(goodReward)
+	if err != nil {
+		writeGoodRewardError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func DeleteGoodRewardHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
+	match, err := getMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = stor.DeleteGoodReward(match)
+	if err != nil {
+		writeGoodRewardError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetGoodRewardHistoryHandler(w http.ResponseWriter, r *http.Request, stor accrualStor.Interface) {
+	match, err := getMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	arr := make([]*accrualStor.GoodRewardVersion, 0)
+	err = stor.GoodRewardHistoryForEach(match, func(version *accrualStor.GoodRewardVersion) error {
+		arr = append(arr, version)
+		return nil
+	})
+	if err != nil {
+		writeGoodRewardError(w, err)
+		return
+	}
+
+	writeList(w, arr, len(arr))
+}
+
+// InitRouter registers routes, every one of them needs an api key with
+// its own scope.
 func InitRouter(r *chi.Mux, stor accrualStor.Interface) {
-	r.Get("/api/orders/{orderID}", func(w http.ResponseWriter, r *http.Request) {
+	requireScope := func(scope accrualStor.Scope) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return CheckAPIKeyMiddleware(h, stor, scope)
+		}
+	}
+
+	r.With(requireScope(accrualStor.ScopeOrdersRead)).Get("/api/orders/{orderID}", func(w http.ResponseWriter, r *http.Request) {
 		GetOrderHandler(w, r, stor)
 	})
 
-	r.Post("/api/orders", func(w http.ResponseWriter, r *http.Request) {
+	r.With(requireScope(accrualStor.ScopeOrdersRead)).Get("/api/orders/{orderID}/breakdown", func(w http.ResponseWriter, r *http.Request) {
+		GetOrderBreakdownHandler(w, r, stor)
+	})
+
+	r.With(requireScope(accrualStor.ScopeOrdersWrite)).Post("/api/orders", func(w http.ResponseWriter, r *http.Request) {
 		SetOrderHandler(w, r, stor)
 	})
 
-	r.Post("/api/goods", func(w http.ResponseWriter, r *http.Request) {
+	r.With(requireScope(accrualStor.ScopeGoodsRead)).Get("/api/goods", func(w http.ResponseWriter, r *http.Request) {
+		GetGoodRewardsHandler(w, r, stor)
+	})
+
+	r.With(requireScope(accrualStor.ScopeGoodsWrite)).Post("/api/goods", func(w http.ResponseWriter, r *http.Request) {
 		SetGoodRewardHandler(w, r, stor)
 	})
+
+	r.With(requireScope(accrualStor.ScopeGoodsRead)).Get("/api/goods/{match}", func(w http.ResponseWriter, r *http.Request) {
+		GetGoodRewardHandler(w, r, stor)
+	})
+
+	r.With(requireScope(accrualStor.ScopeGoodsWrite)).Put("/api/goods/{match}", func(w http.ResponseWriter, r *http.Request) {
+		UpdateGoodRewardHandler(w, r, stor)
+	})
+
+	r.With(requireScope(accrualStor.ScopeGoodsWrite)).Delete("/api/goods/{match}", func(w http.ResponseWriter, r *http.Request) {
+		DeleteGoodRewardHandler(w, r, stor)
+	})
+
+	r.With(requireScope(accrualStor.ScopeGoodsRead)).Get("/api/goods/{match}/history", func(w http.ResponseWriter, r *http.Request) {
+		GetGoodRewardHistoryHandler(w, r, stor)
+	})
 }
@@ -4,59 +4,39 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	accrualHandlers "github.com/GermanVor/go-tpl/cmd/accrual/accrualHandlers"
 	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/money"
 	"github.com/bmizerany/assert"
 	"github.com/go-chi/chi"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/stretchr/testify/require"
 )
 
-const databaseURI = "postgres://zzman:@localhost:5432/test"
-
-func cleanDatabase() {
-	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	dropTableNameList := []string{
-		"ordersReward",
-		"goods",
-		"goodsBaskets",
-	}
-
-	for _, tableName := range dropTableNameList {
-		sql := "DROP TABLE IF EXISTS " + tableName
-
-		_, err = conn.Exec(context.TODO(), sql)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-	}
-}
-
-func init() {
-	cleanDatabase()
-}
+// apiKey has every scope, createTestEnv creates it
+var apiKey string
 
 func createTestEnv() (string, func()) {
 	r := chi.NewRouter()
 
-	stor := accrualStor.Init(databaseURI, 10)
+	stor := accrualStor.InitMemory(10, 1)
 	accrualHandlers.InitRouter(r, stor)
 
+	key, err := stor.CreateAPIKey(accrualStor.Scopes)
+	if err != nil {
+		panic(err)
+	}
+	apiKey = key.String()
+
 	ts := httptest.NewServer(r)
 
 	destructor := func() {
 		ts.Close()
-		cleanDatabase()
 	}
 
 	return ts.URL, destructor
@@ -68,12 +48,12 @@ var (
 	goodsRewards = []accrualStor.GoodReward{
 		{
 			Match:      "Rty",
-			Reward:     10,
+			Reward:     money.MustParse("10"),
 			RewardType: accrualStor.RewardTypePercent,
 		},
 		{
 			Match:      "Qwe",
-			Reward:     11.2,
+			Reward:     money.MustParse("11.2"),
 			RewardType: accrualStor.RewardTypePT,
 		},
 	}
@@ -83,11 +63,11 @@ var (
 		Goods: []accrualStor.Good{
 			{
 				Description: "SAsd " + goodsRewards[0].Match + " dsxd",
-				Price:       100,
+				Price:       money.MustParse("100"),
 			},
 			{
 				Description: "sacca " + goodsRewards[1].Match + " asdsd",
-				Price:       110.5,
+				Price:       money.MustParse("110.5"),
 			},
 		},
 	}
@@ -106,6 +86,7 @@ func setGoodsRewardsRequest(t *testing.T, goodReward accrualStor.GoodReward, end
 	require.NoError(t, err)
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(accrualStor.APIKeyHeader, apiKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	require.NoError(t, err)
@@ -145,6 +126,7 @@ func setOrderRequest(t *testing.T, endpointURL string) *http.Response {
 	)
 	require.NoError(t, err)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(accrualStor.APIKeyHeader, apiKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	require.NoError(t, err)
@@ -189,6 +171,7 @@ func getOrderRequest(t *testing.T, endpointURL string, orderID string) *http.Res
 	)
 
 	require.NoError(t, err)
+	req.Header.Set(accrualStor.APIKeyHeader, apiKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	require.NoError(t, err)
@@ -246,7 +229,7 @@ func TestGetOrder(t *testing.T) {
 				if respBody.Status == accrualStor.OrderStatusProcessed {
 					assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-					expectedAccural := goodsRewards[1].Reward + orderPackage.Goods[0].Price*(goodsRewards[0].Reward/100)
+					expectedAccural := goodsRewards[1].Reward + orderPackage.Goods[0].Price.Percent(goodsRewards[0].Reward)
 
 					assert.Equal(t, orderID, respBody.Order)
 					assert.Equal(t, expectedAccural, respBody.Accrual)
@@ -265,3 +248,84 @@ func TestGetOrder(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	})
 }
+
+func TestAPIKeyAuth(t *testing.T) {
+	r := chi.NewRouter()
+
+	stor := accrualStor.InitMemory(10, 1)
+	accrualHandlers.InitRouter(r, stor)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	readKey, err := stor.CreateAPIKey([]accrualStor.Scope{accrualStor.ScopeOrdersRead})
+	require.NoError(t, err)
+
+	goodsKey, err := stor.CreateAPIKey([]accrualStor.Scope{accrualStor.ScopeGoodsWrite})
+	require.NoError(t, err)
+
+	goodsData, err := json.Marshal(goodsRewards[0])
+	require.NoError(t, err)
+
+	request := func(method string, path string, body []byte, headers map[string]string) int {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	signed := func(key *accrualStor.APIKey, timestamp time.Time, body []byte) map[string]string {
+		timestampStr := strconv.FormatInt(timestamp.Unix(), 10)
+
+		return map[string]string{
+			accrualStor.KeyIDHeader:     key.KeyID,
+			accrualStor.TimestampHeader: timestampStr,
+			accrualStor.SignatureHeader: accrualStor.Sign(key.Secret, http.MethodPost, "/api/goods", timestampStr, body),
+		}
+	}
+
+	t.Run("No key", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/orders/"+orderID, nil, nil))
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/orders", nil, nil))
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/goods", goodsData, nil))
+	})
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		headers := map[string]string{accrualStor.APIKeyHeader: readKey.KeyID + ".secret"}
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/orders/"+orderID, nil, headers))
+	})
+
+	t.Run("Scopes", func(t *testing.T) {
+		headers := map[string]string{accrualStor.APIKeyHeader: readKey.String()}
+		assert.Equal(t, http.StatusNoContent, request(http.MethodGet, "/api/orders/"+orderID, nil, headers))
+		assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/orders", nil, headers))
+		assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/goods", goodsData, headers))
+	})
+
+	t.Run("Signed requests", func(t *testing.T) {
+		tampered, err := json.Marshal(goodsRewards[1])
+		require.NoError(t, err)
+
+		stale := time.Now().Add(-2 * accrualStor.MaxClockSkew)
+
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/goods", tampered, signed(goodsKey, time.Now(), goodsData)))
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/goods", goodsData, signed(goodsKey, stale, goodsData)))
+		assert.Equal(t, http.StatusOK, request(http.MethodPost, "/api/goods", goodsData, signed(goodsKey, time.Now(), goodsData)))
+	})
+
+	t.Run("Revoked key", func(t *testing.T) {
+		require.NoError(t, stor.RevokeAPIKey(readKey.KeyID))
+
+		headers := map[string]string{accrualStor.APIKeyHeader: readKey.String()}
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/orders/"+orderID, nil, headers))
+	})
+}
@@ -0,0 +1,119 @@
+package accrualhandlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+)
+
+// the biggest body a signed request may have, it is read to be hashed
+const signedBodyLimit = 1 << 20
+
+var (
+	ErrNoCredentials    = errors.New("no api key")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrStaleTimestamp   = errors.New("request timestamp is too far from now")
+)
+
+func authenticateAPIKey(r *http.Request, stor accrualStor.APIKeys) (*accrualStor.APIKey, error) {
+	keyID, secret, err := accrualStor.ParseAPIKey(r.Header.Get(accrualStor.APIKeyHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := stor.GetAPIKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Secret), []byte(secret)) != 1 {
+		return nil, accrualStor.ErrUnknownAPIKey
+	}
+
+	return key, nil
+}
+
+func authenticateSignature(r *http.Request, stor accrualStor.APIKeys) (*accrualStor.APIKey, error) {
+	timestamp := r.Header.Get(accrualStor.TimestampHeader)
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrStaleTimestamp
+	}
+
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > accrualStor.MaxClockSkew || skew < -accrualStor.MaxClockSkew {
+		return nil, ErrStaleTimestamp
+	}
+
+	key, err := stor.GetAPIKey(r.Header.Get(accrualStor.KeyIDHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, signedBodyLimit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > signedBodyLimit {
+		return nil, ErrInvalidSignature
+	}
+
+	// the handler reads the body once more
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature := accrualStor.Sign(key.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(r.Header.Get(accrualStor.SignatureHeader))) {
+		return nil, ErrInvalidSignature
+	}
+
+	return key, nil
+}
+
+func authenticate(r *http.Request, stor accrualStor.APIKeys) (*accrualStor.APIKey, error) {
+	switch {
+	case r.Header.Get(accrualStor.APIKeyHeader) != "":
+		return authenticateAPIKey(r, stor)
+	case r.Header.Get(accrualStor.KeyIDHeader) != "":
+		return authenticateSignature(r, stor)
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// CheckAPIKeyMiddleware answers 401 to requests without a valid key and
+// 403 to keys without scope.
+func CheckAPIKeyMiddleware(next http.Handler, stor accrualStor.APIKeys, scope accrualStor.Scope) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := authenticate(r, stor)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrNoCredentials),
+				errors.Is(err, accrualStor.ErrInvalidAPIKey),
+				errors.Is(err, accrualStor.ErrUnknownAPIKey),
+				errors.Is(err, ErrInvalidSignature),
+				errors.Is(err, ErrStaleTimestamp):
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		if !key.HasScope(scope) {
+			http.Error(w, "api key has no "+string(scope)+" scope", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 
 	accrualHandlers "github.com/GermanVor/go-tpl/cmd/accrual/accrualHandlers"
 	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/migrations"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/joho/godotenv"
@@ -24,13 +27,26 @@ var defaultCompressibleContentTypes = []string{
 
 var address = "localhost:8080"
 var databaseURI = "postgres://zzman:@localhost:5432/postgres"
+var storageMode = storageModePostgres
+var migrateMode = migrations.ModeAuto
+var calculationWorkersCount uint = accrualStor.DefaultCalculationWorkersCount
+
+const (
+	storageModePostgres = "postgres"
+	storageModeMemory   = "memory"
+
+	requestCountLimit = 10000
+)
 
 func InitEnv() {
 	const aUsage = "Service launch address and port"
 	const dbUsage = "Database connection address"
+	const sUsage = "Storage backend: " + storageModePostgres + " or " + storageModeMemory
+	const mUsage = "Schema migrations on start: " +
+		migrations.ModeAuto + ", " + migrations.ModeDryRun + " or " + migrations.ModeOff
+	const wUsage = "Number of workers calculating accruals of registered orders"
 
 	godotenv.Load(".env")
-	flag.Parse()
 
 	// -------------- RUN_ADDRESS --------------
 	if addressEnv, ok := os.LookupEnv("RUN_ADDRESS"); ok {
@@ -45,12 +61,92 @@ func InitEnv() {
 	}
 	flag.StringVar(&databaseURI, "d", databaseURI, dbUsage)
 	// ------------------------------------------
+
+	// -------------- STORAGE_MODE --------------
+	if storageModeEnv, ok := os.LookupEnv("STORAGE_MODE"); ok {
+		storageMode = storageModeEnv
+	}
+	flag.StringVar(&storageMode, "s", storageMode, sUsage)
+	// ------------------------------------------
+
+	// -------------- MIGRATE_MODE --------------
+	if migrateModeEnv, ok := os.LookupEnv("MIGRATE_MODE"); ok {
+		migrateMode = migrateModeEnv
+	}
+	flag.StringVar(&migrateMode, "m", migrateMode, mUsage)
+	// ------------------------------------------
+
+	// -------------- CALCULATION_WORKERS --------------
+	if calculationWorkersEnv, ok := os.LookupEnv("CALCULATION_WORKERS"); ok {
+		count, err := strconv.ParseUint(calculationWorkersEnv, 10, 32)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		calculationWorkersCount = uint(count)
+	}
+	flag.UintVar(&calculationWorkersCount, "w", calculationWorkersCount, wUsage)
+	// -------------------------------------------------
+
+	flag.Parse()
+}
+
+func initStorage(calculationWorkersCount uint) accrualStor.Interface {
+	switch storageMode {
+	case storageModeMemory:
+		return accrualStor.InitMemory(requestCountLimit, calculationWorkersCount)
+	case storageModePostgres:
+		err := migrations.OnStart(databaseURI, migrations.Accrual, migrateMode)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		return accrualStor.Init(databaseURI, requestCountLimit, calculationWorkersCount)
+	}
+
+	log.Fatalln("unknown storage mode", storageMode)
+	return nil
 }
 
 func main() {
 	InitEnv()
 
-	stor := accrualStor.Init(databaseURI, 10000)
+	// accrual [flags] migrate up|down|status
+	if flag.Arg(0) == "migrate" {
+		err := migrations.Command(databaseURI, migrations.Accrual, flag.Args()[1:], os.Stdout)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		return
+	}
+
+	// accrual [flags] keys create <scope>...|list|revoke <key id>
+	if flag.Arg(0) == "keys" {
+		// the command does not calculate orders
+		err := accrualStor.APIKeysCommand(initStorage(0), flag.Args()[1:], os.Stdout)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		return
+	}
+
+	stor := initStorage(calculationWorkersCount)
+
+	// in-memory keys die with the process, so one with every scope is
+	// created on every start
+	if storageMode == storageModeMemory {
+		key, err := stor.CreateAPIKey(accrualStor.Scopes)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		// the secret is printed once and is kept out of the logs
+		log.Println("Created API key with every scope", key.KeyID)
+		fmt.Println(key.String())
+	}
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
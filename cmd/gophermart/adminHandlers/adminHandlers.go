@@ -0,0 +1,227 @@
+package adminhandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	userStor "github.com/GermanVor/go-tpl/internal/userStor"
+	"github.com/go-chi/chi"
+)
+
+const limitReader = 1024
+
+type UserResponse struct {
+	UserID       string        `json:"user_id"`
+	Login        string        `json:"login,omitempty"`
+	Role         userStor.Role `json:"role"`
+	RegisteredAt string        `json:"registered_at,omitempty"`
+}
+
+// SearchUsersHandler serves ?q= with the ID or a part of the login.
+func SearchUsersHandler(w http.ResponseWriter, r *http.Request, stor userStor.Interface) {
+	page, err := common.GetPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := stor.SearchUsers(r.URL.Query().Get("q"), page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(users) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	arr := make([]*UserResponse, 0, len(users))
+	for _, user := range users {
+		userResponse := &UserResponse{
+			UserID: user.UserID,
+			Login:  user.Login,
+			Role:   user.Role,
+		}
+
+		if !user.RegisteredAt.IsZero() {
+			userResponse.RegisteredAt = user.RegisteredAt.Format(time.RFC3339)
+		}
+
+		arr = append(arr, userResponse)
+	}
+
+	bytes, err := json.Marshal(arr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+func GetUserOrdersHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
+	arr := make([]*gophermartStor.OrdersForEachObject, 0)
+	err := stor.OrdersForEach(chi.URLParam(r, "userID"), func(order *gophermartStor.OrdersForEachObject) error {
+		arr = append(arr, order)
+		return nil
+	})
+
+	writeList(w, arr, len(arr), err)
+}
+
+func GetUserWithdrawalsHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
+	arr := make([]*gophermartStor.WithdrawalObject, 0)
+	err := stor.WithdrawalsForEach(chi.URLParam(r, "userID"), func(withdrawal *gophermartStor.WithdrawalObject) error {
+		arr = append(arr, withdrawal)
+		return nil
+	})
+
+	writeList(w, arr, len(arr), err)
+}
+
+func GetAuditHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
+	page, err := common.GetPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	arr := make([]*gophermartStor.AuditEntry, 0)
+	err = stor.AuditForEach(page, func(entry *gophermartStor.AuditEntry) error {
+		arr = append(arr, entry)
+		return nil
+	})
+
+	writeList(w, arr, len(arr), err)
+}
+
+// writeList answers 204 No Content for empty lists, like the user routes.
+func writeList(w http.ResponseWriter, arr interface{}, length int, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if length == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bytes, err := json.Marshal(arr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+func RepollOrderHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
+	err := stor.RepollOrder(common.GetContextUserID(r), chi.URLParam(r, "orderID"))
+	if err != nil {
+		if errors.Is(err, gophermartStor.ErrUnknownOrder) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type AdjustBalanceRequest struct {
+	// negative to take points away
+	Amount money.Money `json:"amount"`
+	Reason string      `json:"reason"`
+}
+
+func AdjustBalanceHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
+	if r.Header.Get("Content-Type") != common.ApplicationJSONStr {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, limitReader+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(bodyBytes) > limitReader {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	adjustment := AdjustBalanceRequest{}
+	err = json.Unmarshal(bodyBytes, &adjustment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = stor.AdjustBalance(
+		common.GetContextUserID(r),
+		chi.URLParam(r, "userID"),
+		adjustment.Amount,
+		adjustment.Reason,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, gophermartStor.ErrInvalidAdjustment):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, gophermartStor.ErrUnknownBalance):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, gophermartStor.ErrNotEnoughFunds):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// InitRouter registers routes which need CheckUserTokenMiddleware and
+// CheckAdminMiddleware.
+func InitRouter(r chi.Router, stor userStor.Interface, gophermartStorage gophermartStor.Interface) {
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+			SearchUsersHandler(w, r, stor)
+		})
+
+		r.Get("/users/{userID}/orders", func(w http.ResponseWriter, r *http.Request) {
+			GetUserOrdersHandler(w, r, gophermartStorage)
+		})
+
+		r.Get("/users/{userID}/withdrawals", func(w http.ResponseWriter, r *http.Request) {
+			GetUserWithdrawalsHandler(w, r, gophermartStorage)
+		})
+
+		r.Post("/users/{userID}/balance", func(w http.ResponseWriter, r *http.Request) {
+			AdjustBalanceHandler(w, r, gophermartStorage)
+		})
+
+		r.Post("/orders/{orderID}/repoll", func(w http.ResponseWriter, r *http.Request) {
+			RepollOrderHandler(w, r, gophermartStorage)
+		})
+
+		r.Get("/audit", func(w http.ResponseWriter, r *http.Request) {
+			GetAuditHandler(w, r, gophermartStorage)
+		})
+	})
+}
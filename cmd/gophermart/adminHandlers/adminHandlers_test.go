@@ -0,0 +1,213 @@
+package adminhandlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	adminHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/adminHandlers"
+	registrationHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/registrationHandlers"
+	"github.com/GermanVor/go-tpl/internal/common"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	userStor "github.com/GermanVor/go-tpl/internal/userStor"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const orderID = "70757088342"
+
+type testEnv struct {
+	endpointURL       string
+	gophermartStorage *gophermartStor.MemoryStorage
+
+	adminCookie *http.Cookie
+	userCookie  *http.Cookie
+}
+
+func register(t *testing.T, userStorage userStor.Interface, login string) *http.Cookie {
+	session, err := userStorage.SignIn(login, "Secret-2022", "")
+	require.NoError(t, err)
+
+	return &http.Cookie{Name: registrationHandlers.SessionTokenName, Value: session.Token}
+}
+
+func createTestEnv(t *testing.T) (*testEnv, func()) {
+	gophermartStorage := gophermartStor.InitMemory("", "", 0)
+	userStorage := userStor.InitMemory(gophermartStorage, userStor.DefaultSessionTTL, userStor.DefaultHashPolicy)
+
+	env := &testEnv{
+		gophermartStorage: gophermartStorage,
+		adminCookie:       register(t, userStorage, "Support"),
+		userCookie:        register(t, userStorage, "Qwerty"),
+	}
+	require.NoError(t, userStorage.SetRole("support", userStor.RoleAdmin))
+
+	r := chi.NewRouter()
+
+	r.Group(func(r chi.Router) {
+		r.Use(func(h http.Handler) http.Handler {
+			return registrationHandlers.CheckUserTokenMiddleware(h, userStorage)
+		})
+		r.Use(func(h http.Handler) http.Handler {
+			return registrationHandlers.CheckAdminMiddleware(h, userStorage)
+		})
+
+		adminHandlers.InitRouter(r, userStorage, gophermartStorage)
+	})
+
+	ts := httptest.NewServer(r)
+	env.endpointURL = ts.URL
+
+	return env, ts.Close
+}
+
+func request(t *testing.T, method string, url string, cookie *http.Cookie, body []byte, dst interface{}) int {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", common.ApplicationJSONStr)
+
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if dst != nil && resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(dst))
+	}
+
+	return resp.StatusCode
+}
+
+func TestAdminAccess(t *testing.T) {
+	env, destructor := createTestEnv(t)
+	defer destructor()
+
+	url := env.endpointURL + "/api/admin/users"
+
+	assert.Equal(t, http.StatusUnauthorized, request(t, http.MethodGet, url, nil, nil, nil))
+	assert.Equal(t, http.StatusForbidden, request(t, http.MethodGet, url, env.userCookie, nil, nil))
+	assert.Equal(t, http.StatusOK, request(t, http.MethodGet, url, env.adminCookie, nil, nil))
+}
+
+func TestSearchUsers(t *testing.T) {
+	env, destructor := createTestEnv(t)
+	defer destructor()
+
+	users := []*adminHandlers.UserResponse{}
+	status := request(t, http.MethodGet, env.endpointURL+"/api/admin/users", env.adminCookie, nil, &users)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, users, 2)
+	assert.Equal(t, "Support", users[0].Login)
+	assert.Equal(t, userStor.RoleAdmin, users[0].Role)
+	assert.Equal(t, "Qwerty", users[1].Login)
+	assert.Equal(t, userStor.RoleUser, users[1].Role)
+
+	status = request(t, http.MethodGet, env.endpointURL+"/api/admin/users?q=WERT", env.adminCookie, nil, &users)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, users, 1)
+	assert.Equal(t, "2", users[0].UserID)
+
+	status = request(t, http.MethodGet, env.endpointURL+"/api/admin/users?q=1", env.adminCookie, nil, &users)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, users, 1)
+	assert.Equal(t, "Support", users[0].Login)
+
+	status = request(t, http.MethodGet, env.endpointURL+"/api/admin/users?limit=1&offset=1", env.adminCookie, nil, &users)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, users, 1)
+	assert.Equal(t, "Qwerty", users[0].Login)
+
+	status = request(t, http.MethodGet, env.endpointURL+"/api/admin/users?q=nobody", env.adminCookie, nil, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+}
+
+func TestUserOrdersAndRepoll(t *testing.T) {
+	env, destructor := createTestEnv(t)
+	defer destructor()
+
+	ordersURL := env.endpointURL + "/api/admin/users/2/orders"
+	assert.Equal(t, http.StatusNoContent, request(t, http.MethodGet, ordersURL, env.adminCookie, nil, nil))
+
+	_, err := env.gophermartStorage.InitOrder("2", orderID)
+	require.NoError(t, err)
+
+	orders := []*gophermartStor.OrdersForEachObject{}
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, ordersURL, env.adminCookie, nil, &orders))
+	require.Len(t, orders, 1)
+	assert.Equal(t, orderID, orders[0].Number)
+
+	withdrawalsURL := env.endpointURL + "/api/admin/users/2/withdrawals"
+	assert.Equal(t, http.StatusNoContent, request(t, http.MethodGet, withdrawalsURL, env.adminCookie, nil, nil))
+
+	repollURL := env.endpointURL + "/api/admin/orders/" + orderID + "/repoll"
+	assert.Equal(t, http.StatusAccepted, request(t, http.MethodPost, repollURL, env.adminCookie, nil, nil))
+
+	unknownRepollURL := env.endpointURL + "/api/admin/orders/12345678903/repoll"
+	assert.Equal(t, http.StatusNotFound, request(t, http.MethodPost, unknownRepollURL, env.adminCookie, nil, nil))
+
+	audit := []*gophermartStor.AuditEntry{}
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, env.endpointURL+"/api/admin/audit", env.adminCookie, nil, &audit))
+	require.Len(t, audit, 1)
+	assert.Equal(t, "1", audit[0].AdminID)
+	assert.Equal(t, gophermartStor.AuditActionRepoll, audit[0].Action)
+	assert.Equal(t, "2", audit[0].UserID)
+	assert.Equal(t, orderID, audit[0].Order)
+}
+
+func TestAdjustBalance(t *testing.T) {
+	env, destructor := createTestEnv(t)
+	defer destructor()
+
+	url := env.endpointURL + "/api/admin/users/2/balance"
+
+	adjust := func(amount string, reason string) int {
+		body, err := json.Marshal(adminHandlers.AdjustBalanceRequest{
+			Amount: money.MustParse(amount),
+			Reason: reason,
+		})
+		require.NoError(t, err)
+
+		return request(t, http.MethodPost, url, env.adminCookie, body, nil)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, adjust("10", ""))
+	assert.Equal(t, http.StatusBadRequest, adjust("0", "nothing"))
+	assert.Equal(t, http.StatusConflict, adjust("-10", "too much"))
+	assert.Equal(t, http.StatusOK, adjust("10.5", "lost accrual of a deleted order"))
+	assert.Equal(t, http.StatusOK, adjust("-0.5", "typo"))
+
+	balance, err := env.gophermartStorage.GetBalance("2")
+	require.NoError(t, err)
+	assert.Equal(t, money.MustParse("10"), balance.Current)
+	assert.Equal(t, money.Money(0), balance.Withdrawn)
+
+	entries := []*gophermartStor.LedgerEntry{}
+	err = env.gophermartStorage.LedgerForEach("2", common.Page{Limit: 10}, func(entry *gophermartStor.LedgerEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, gophermartStor.LedgerEntryKindAdjustment, entries[0].Kind)
+	assert.Equal(t, money.MustParse("-0.5"), entries[0].Amount)
+
+	audit := []*gophermartStor.AuditEntry{}
+	require.Equal(t, http.StatusOK, request(t, http.MethodGet, env.endpointURL+"/api/admin/audit", env.adminCookie, nil, &audit))
+	require.Len(t, audit, 2)
+	assert.Equal(t, gophermartStor.AuditActionBalanceAdjustment, audit[1].Action)
+	assert.Equal(t, money.MustParse("10.5"), audit[1].Amount)
+	assert.Equal(t, "lost accrual of a deleted order", audit[1].Reason)
+	assert.Equal(t, "typo", audit[0].Reason)
+
+	unknownURL := env.endpointURL + "/api/admin/users/42/balance"
+	body, err := json.Marshal(adminHandlers.AdjustBalanceRequest{Amount: 100, Reason: "unknown"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, request(t, http.MethodPost, unknownURL, env.adminCookie, body, nil))
+}
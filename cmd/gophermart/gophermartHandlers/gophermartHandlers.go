@@ -8,6 +8,7 @@ import (
 
 	"github.com/GermanVor/go-tpl/internal/common"
 	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/money"
 	"github.com/go-chi/chi"
 )
 
@@ -106,8 +107,8 @@ func GetBalanceHandler(w http.ResponseWriter, r *http.Request, stor gophermartSt
 }
 
 type MakeWithdrawResponse struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order string      `json:"order"`
+	Sum   money.Money `json:"sum"`
 }
 
 func MakeWithdrawHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
@@ -126,6 +127,8 @@ func MakeWithdrawHandler(w http.ResponseWriter, r *http.Request, stor gophermart
 			http.Error(w, err.Error(), http.StatusPaymentRequired)
 		case errors.Is(err, gophermartStor.ErrInvalidOrderIDFormat):
 			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, gophermartStor.ErrInvalidWithdrawSum):
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -163,6 +166,42 @@ func GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request, stor gopherma
 	}
 }
 
+func GetBalanceHistoryHandler(w http.ResponseWriter, r *http.Request, stor gophermartStor.Interface) {
+	page, err := common.GetPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID := common.GetContextUserID(r)
+
+	arr := make([]*gophermartStor.LedgerEntry, 0)
+	err = stor.LedgerForEach(userID, page, func(entry *gophermartStor.LedgerEntry) error {
+		arr = append(arr, entry)
+		return nil
+	})
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(arr) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bytes, err := json.Marshal(arr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
 func InitRouter(r chi.Router, stor gophermartStor.Interface) {
 	r.Route("/api/user/orders", func(r chi.Router) {
 		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
@@ -182,6 +221,10 @@ func InitRouter(r chi.Router, stor gophermartStor.Interface) {
 		r.Post("/withdraw", func(w http.ResponseWriter, r *http.Request) {
 			MakeWithdrawHandler(w, r, stor)
 		})
+
+		r.Get("/history", func(w http.ResponseWriter, r *http.Request) {
+			GetBalanceHistoryHandler(w, r, stor)
+		})
 	})
 
 	r.Get("/api/user/withdrawals", func(w http.ResponseWriter, r *http.Request) {
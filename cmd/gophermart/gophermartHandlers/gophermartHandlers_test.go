@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -16,44 +15,17 @@ import (
 	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
 	"github.com/GermanVor/go-tpl/internal/common"
 	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/money"
 	"github.com/bmizerany/assert"
 	"github.com/go-chi/chi"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/stretchr/testify/require"
 )
 
-const databaseURI = "postgres://zzman:@localhost:5432/test"
 const orderID = "70757088342"
 
 var userObj = registrationHandlers.UserRequest{
 	Login:    "Qwerty",
-	Password: "qwertY",
-}
-
-func cleanDatabase() {
-	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	dropTableNameList := []string{
-		"ordersPool",
-		"balances",
-		"orderHistory",
-	}
-
-	for _, tableName := range dropTableNameList {
-		sql := "DROP TABLE IF EXISTS " + tableName
-
-		_, err = conn.Exec(context.TODO(), sql)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-	}
-}
-
-func init() {
-	cleanDatabase()
+	Password: "Secret-2022",
 }
 
 var i = 0
@@ -61,9 +33,19 @@ var mux sync.RWMutex
 var accrualScenerio = []accrualStor.Order{
 	{Order: "", Accrual: 0, Status: accrualStor.OrderStatusRegistered},
 	{Order: "", Accrual: 0, Status: accrualStor.OrderStatusProcessing},
-	{Order: "", Accrual: 22, Status: accrualStor.OrderStatusProcessed},
+	{Order: "", Accrual: money.MustParse("22"), Status: accrualStor.OrderStatusProcessed},
 }
 
+var accrualBreakdown = []accrualStor.BreakdownItem{{
+	Description: "Bork kettle",
+	Price:       money.MustParse("220"),
+	Match:       "Bork",
+	RuleVersion: 1,
+	RewardType:  accrualStor.RewardTypePercent,
+	Reward:      money.MustParse("10"),
+	Accrual:     money.MustParse("22"),
+}}
+
 func initAccrualServerMock() (string, func()) {
 	r := chi.NewRouter()
 
@@ -84,6 +66,19 @@ func initAccrualServerMock() (string, func()) {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	r.Get("/api/orders/{orderID}/breakdown", func(w http.ResponseWriter, r *http.Request) {
+		mux.RLock()
+		order := accrualScenerio[i]
+		mux.RUnlock()
+
+		json.NewEncoder(w).Encode(accrualStor.Breakdown{
+			Order:   chi.URLParam(r, "orderID"),
+			Status:  order.Status,
+			Accrual: order.Accrual,
+			Items:   accrualBreakdown,
+		})
+	})
+
 	ts := httptest.NewServer(r)
 
 	destructor := func() {
@@ -96,20 +91,11 @@ func initAccrualServerMock() (string, func()) {
 func createTestEnv(t *testing.T, accrualAddress string) (string, func()) {
 	r := chi.NewRouter()
 
-	gophermartStorage := gophermartStor.Init(databaseURI, accrualAddress)
+	gophermartStorage := gophermartStor.InitMemory(accrualAddress, "", 1)
 
 	// balance row creates in SignIn handler
 	const userID = "qwertyUserID"
-	{
-		conn, err := pgxpool.Connect(context.TODO(), databaseURI)
-		require.NoError(t, err)
-
-		tx, err := conn.Begin(context.TODO())
-		require.NoError(t, err)
-
-		require.NoError(t, gophermartStor.CreateBalance(tx, userID))
-		require.NoError(t, tx.Commit(context.TODO()))
-	}
+	require.NoError(t, gophermartStorage.CreateBalance(userID))
 
 	r.Group(func(r chi.Router) {
 		r.Use(func(h http.Handler) http.Handler {
@@ -128,7 +114,6 @@ func createTestEnv(t *testing.T, accrualAddress string) (string, func()) {
 
 	destructor := func() {
 		ts.Close()
-		cleanDatabase()
 	}
 
 	return ts.URL, destructor
@@ -230,7 +215,7 @@ func TestGetOrder(t *testing.T) {
 
 		require.Equal(t, 1, len(respBody))
 		assert.Equal(t, gophermartStor.OrderStatusProcessing, respBody[0].Status)
-		assert.Equal(t, float64(0), respBody[0].Accrual)
+		assert.Equal(t, money.Money(0), respBody[0].Accrual)
 		assert.Equal(t, orderID, respBody[0].Number)
 	})
 
@@ -252,6 +237,7 @@ func TestGetOrder(t *testing.T) {
 		assert.Equal(t, gophermartStor.OrderStatusProcessed, respBody[0].Status)
 		assert.Equal(t, accrualScenerio[i].Accrual, respBody[0].Accrual)
 		assert.Equal(t, orderID, respBody[0].Number)
+		assert.Equal(t, accrualBreakdown, respBody[0].Breakdown)
 	})
 }
 
@@ -300,8 +286,8 @@ func TestBalancesHandlers(t *testing.T) {
 		var respBody gophermartStor.Balance
 		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
 
-		assert.Equal(t, float64(0), respBody.Current)
-		assert.Equal(t, float64(0), respBody.Withdrawn)
+		assert.Equal(t, money.Money(0), respBody.Current)
+		assert.Equal(t, money.Money(0), respBody.Withdrawn)
 	})
 
 	{
@@ -321,7 +307,7 @@ func TestBalancesHandlers(t *testing.T) {
 		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
 
 		assert.Equal(t, accrualScenerio[i].Accrual, respBody.Current)
-		assert.Equal(t, float64(0), respBody.Withdrawn)
+		assert.Equal(t, money.Money(0), respBody.Withdrawn)
 	})
 
 	{
@@ -334,12 +320,24 @@ func TestBalancesHandlers(t *testing.T) {
 		require.Equal(t, accrualScenerio[i].Accrual, respBody.Current)
 	}
 
-	delta := float64(1.5)
+	delta := money.MustParse("1.5")
 	reqBody := gophermartHandlers.MakeWithdrawResponse{
 		Order: orderID,
 		Sum:   accrualScenerio[i].Accrual - delta,
 	}
 
+	t.Run("Not Positive Withdraw Request", func(t *testing.T) {
+		for _, sum := range []money.Money{0, -delta} {
+			resp := makeWithdrawRequest(t, endpointURL, gophermartHandlers.MakeWithdrawResponse{
+				Order: orderID,
+				Sum:   sum,
+			})
+			resp.Body.Close()
+
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
 	t.Run("Success Withdraw Request", func(t *testing.T) {
 		resp := makeWithdrawRequest(t, endpointURL, reqBody)
 		defer resp.Body.Close()
@@ -379,4 +377,80 @@ func TestBalancesHandlers(t *testing.T) {
 		assert.Equal(t, delta, respBody.Current)
 		assert.Equal(t, reqBody.Sum, respBody.Withdrawn)
 	})
+
+	t.Run("Second Withdraw Request", func(t *testing.T) {
+		resp := makeWithdrawRequest(t, endpointURL, gophermartHandlers.MakeWithdrawResponse{
+			Order: orderID,
+			Sum:   delta,
+		})
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Check After Second Withdraw", func(t *testing.T) {
+		resp := checkBalanceRequest(t, endpointURL)
+		defer resp.Body.Close()
+
+		var respBody gophermartStor.Balance
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+
+		assert.Equal(t, money.Money(0), respBody.Current)
+		assert.Equal(t, accrualScenerio[i].Accrual, respBody.Withdrawn)
+	})
+
+	t.Run("Balance History check", func(t *testing.T) {
+		resp := balanceHistoryRequest(t, endpointURL, "")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var respBody []gophermartStor.LedgerEntry
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+
+		require.Equal(t, 3, len(respBody))
+
+		// newest first
+		assert.Equal(t, gophermartStor.LedgerEntryKindWithdrawal, respBody[0].Kind)
+		assert.Equal(t, -delta, respBody[0].Amount)
+		assert.Equal(t, gophermartStor.LedgerEntryKindWithdrawal, respBody[1].Kind)
+		assert.Equal(t, -reqBody.Sum, respBody[1].Amount)
+		assert.Equal(t, gophermartStor.LedgerEntryKindAccrual, respBody[2].Kind)
+		assert.Equal(t, accrualScenerio[i].Accrual, respBody[2].Amount)
+		assert.Equal(t, orderID, respBody[2].Order)
+	})
+
+	t.Run("Balance History pagination", func(t *testing.T) {
+		resp := balanceHistoryRequest(t, endpointURL, "?limit=1&offset=2")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var respBody []gophermartStor.LedgerEntry
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+
+		require.Equal(t, 1, len(respBody))
+		assert.Equal(t, gophermartStor.LedgerEntryKindAccrual, respBody[0].Kind)
+	})
+
+	t.Run("Balance History invalid page", func(t *testing.T) {
+		resp := balanceHistoryRequest(t, endpointURL, "?limit=-1")
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func balanceHistoryRequest(t *testing.T, endpointURL string, query string) *http.Response {
+	req, err := http.NewRequest(
+		http.MethodGet,
+		endpointURL+"/api/user/balance/history"+query,
+		nil,
+	)
+
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	return resp
 }
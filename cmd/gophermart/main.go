@@ -1,14 +1,21 @@
 package main
 
 import (
+	"errors"
+	"expvar"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
+	adminHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/adminHandlers"
 	gophermartHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/gophermartHandlers"
 	registrationHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/registrationHandlers"
 	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/jwt"
+	"github.com/GermanVor/go-tpl/internal/migrations"
 	userStor "github.com/GermanVor/go-tpl/internal/userStor"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -26,15 +33,38 @@ var defaultCompressibleContentTypes = []string{
 
 var address = "localhost:8081"
 var accrualAddress = "localhost:8080"
+var accrualAPIKey = ""
 var databaseURI = "postgres://zzman:@localhost:5432/postgres"
+var storageMode = storageModePostgres
+var migrateMode = migrations.ModeAuto
+var pollingWorkersCount uint = gophermartStor.DefaultPollingWorkersCount
+var sessionTTL = userStor.DefaultSessionTTL
+var jwtKeysDir = ""
+var jwtKeyID = ""
+var passwordHash = userStor.DefaultHashPolicy.Algorithm
+var passwordHashParams = ""
+
+const (
+	storageModePostgres = "postgres"
+	storageModeMemory   = "memory"
+)
 
 func initEnv() {
 	const aUsage = "Service launch address and port"
 	const dbUsage = "Database connection address"
 	const rUsage = "Address of the accrual calculation system"
+	const xUsage = "API key of the accrual calculation system with the orders:read scope, <key id>.<secret>"
+	const sUsage = "Storage backend: " + storageModePostgres + " or " + storageModeMemory
+	const mUsage = "Schema migrations on start: " +
+		migrations.ModeAuto + ", " + migrations.ModeDryRun + " or " + migrations.ModeOff
+	const wUsage = "Number of workers polling the accrual system"
+	const tUsage = "Session lifetime without requests, e.g. 24h"
+	const jUsage = "Directory with <key id>.hs256 and <key id>.pem keys, enables JWT session tokens"
+	const kUsage = "ID of the key signing new JWT session tokens"
+	const hUsage = "Algorithm of new password hashes: " + userStor.HashScrypt + " or " + userStor.HashArgon2id
+	const pUsage = "Cost of new password hashes, e.g. ln=15,r=8,p=1 or m=65536,t=3,p=4"
 
 	godotenv.Load(".env")
-	flag.Parse()
 
 	// -------------- RUN_ADDRESS --------------
 	if addressEnv, ok := os.LookupEnv("RUN_ADDRESS"); ok {
@@ -56,13 +86,167 @@ func initEnv() {
 	}
 	flag.StringVar(&accrualAddress, "r", accrualAddress, rUsage)
 	// ----------------------------------------------------
+
+	// -------------- ACCRUAL_API_KEY --------------
+	if accrualAPIKeyEnv, ok := os.LookupEnv("ACCRUAL_API_KEY"); ok {
+		accrualAPIKey = accrualAPIKeyEnv
+	}
+	flag.StringVar(&accrualAPIKey, "x", accrualAPIKey, xUsage)
+	// ---------------------------------------------
+
+	// -------------- STORAGE_MODE --------------
+	if storageModeEnv, ok := os.LookupEnv("STORAGE_MODE"); ok {
+		storageMode = storageModeEnv
+	}
+	flag.StringVar(&storageMode, "s", storageMode, sUsage)
+	// ------------------------------------------
+
+	// -------------- MIGRATE_MODE --------------
+	if migrateModeEnv, ok := os.LookupEnv("MIGRATE_MODE"); ok {
+		migrateMode = migrateModeEnv
+	}
+	flag.StringVar(&migrateMode, "m", migrateMode, mUsage)
+	// ------------------------------------------
+
+	// -------------- POLLING_WORKERS --------------
+	if pollingWorkersEnv, ok := os.LookupEnv("POLLING_WORKERS"); ok {
+		count, err := strconv.ParseUint(pollingWorkersEnv, 10, 32)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		pollingWorkersCount = uint(count)
+	}
+	flag.UintVar(&pollingWorkersCount, "w", pollingWorkersCount, wUsage)
+	// ---------------------------------------------
+
+	// -------------- SESSION_TTL --------------
+	if sessionTTLEnv, ok := os.LookupEnv("SESSION_TTL"); ok {
+		ttl, err := time.ParseDuration(sessionTTLEnv)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		sessionTTL = ttl
+	}
+	flag.DurationVar(&sessionTTL, "t", sessionTTL, tUsage)
+	// -----------------------------------------
+
+	// -------------- JWT_KEYS_DIR --------------
+	if jwtKeysDirEnv, ok := os.LookupEnv("JWT_KEYS_DIR"); ok {
+		jwtKeysDir = jwtKeysDirEnv
+	}
+	flag.StringVar(&jwtKeysDir, "j", jwtKeysDir, jUsage)
+	// ------------------------------------------
+
+	// -------------- JWT_KEY_ID --------------
+	if jwtKeyIDEnv, ok := os.LookupEnv("JWT_KEY_ID"); ok {
+		jwtKeyID = jwtKeyIDEnv
+	}
+	flag.StringVar(&jwtKeyID, "k", jwtKeyID, kUsage)
+	// ----------------------------------------
+
+	// -------------- PASSWORD_HASH --------------
+	if passwordHashEnv, ok := os.LookupEnv("PASSWORD_HASH"); ok {
+		passwordHash = passwordHashEnv
+	}
+	flag.StringVar(&passwordHash, "H", passwordHash, hUsage)
+	// -------------------------------------------
+
+	// -------------- PASSWORD_HASH_PARAMS --------------
+	if passwordHashParamsEnv, ok := os.LookupEnv("PASSWORD_HASH_PARAMS"); ok {
+		passwordHashParams = passwordHashParamsEnv
+	}
+	flag.StringVar(&passwordHashParams, "P", passwordHashParams, pUsage)
+	// --------------------------------------------------
+
+	flag.Parse()
+}
+
+// withJWT leaves userStorage as is unless JWT keys are configured.
+func withJWT(userStorage userStor.Interface) userStor.Interface {
+	if jwtKeysDir == "" {
+		return userStorage
+	}
+
+	keys, err := jwt.LoadKeySet(jwtKeysDir, jwtKeyID)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	log.Println("Session tokens are JWTs signed by", jwtKeyID)
+
+	return userStor.InitJWT(userStorage, keys)
+}
+
+func initStorages() (gophermartStor.Interface, userStor.Interface) {
+	hashPolicy, err := userStor.ParseHashPolicy(passwordHash, passwordHashParams)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	// polls refused by the accrual system are logged and paused, see
+	// AccrualResultUnauthorized
+	if pollingWorkersCount > 0 && accrualAPIKey == "" {
+		log.Println("No accrual system API key, polls fail unless the accrual system accepts them, " +
+			"set -x or ACCRUAL_API_KEY")
+	}
+
+	switch storageMode {
+	case storageModeMemory:
+		gophermartStorage := gophermartStor.InitMemory(accrualAddress, accrualAPIKey, pollingWorkersCount)
+		return gophermartStorage, withJWT(userStor.InitMemory(gophermartStorage, sessionTTL, hashPolicy))
+	case storageModePostgres:
+		err = migrations.OnStart(databaseURI, migrations.Gophermart, migrateMode)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		gophermartStorage := gophermartStor.Init(databaseURI, accrualAddress, accrualAPIKey, pollingWorkersCount)
+		return gophermartStorage, withJWT(userStor.Init(databaseURI, sessionTTL, hashPolicy))
+	}
+
+	log.Fatalln("unknown storage mode", storageMode)
+	return nil, nil
+}
+
+// setRole runs "gophermart role <login> user|admin", roles are granted
+// only this way, there is no route for it.
+func setRole(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: gophermart [flags] role <login> " +
+			string(userStor.RoleUser) + "|" + string(userStor.RoleAdmin))
+	}
+
+	userStorage := userStor.Init(databaseURI, sessionTTL, userStor.DefaultHashPolicy)
+
+	return userStorage.SetRole(args[0], userStor.Role(args[1]))
 }
 
 func main() {
 	initEnv()
 
-	gophermartStorage := gophermartStor.Init(databaseURI, accrualAddress)
-	userStorage := userStor.Init(databaseURI)
+	// gophermart [flags] migrate up|down|status
+	if flag.Arg(0) == "migrate" {
+		err := migrations.Command(databaseURI, migrations.Gophermart, flag.Args()[1:], os.Stdout)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		return
+	}
+
+	// gophermart [flags] role <login> user|admin
+	if flag.Arg(0) == "role" {
+		err := setRole(flag.Args()[1:])
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+
+		return
+	}
+
+	gophermartStorage, userStorage := initStorages()
 
 	r := chi.NewRouter()
 
@@ -80,9 +264,26 @@ func main() {
 			return registrationHandlers.CheckUserTokenMiddleware(h, userStorage)
 		})
 
+		registrationHandlers.InitPrivateRouter(r, userStorage)
+		registrationHandlers.InitProfileRouter(r, userStorage, gophermartStorage)
 		gophermartHandlers.InitRouter(r, gophermartStorage)
 	})
 
+	// Admin
+	r.Group(func(r chi.Router) {
+		r.Use(func(h http.Handler) http.Handler {
+			return registrationHandlers.CheckUserTokenMiddleware(h, userStorage)
+		})
+		r.Use(func(h http.Handler) http.Handler {
+			return registrationHandlers.CheckAdminMiddleware(h, userStorage)
+		})
+
+		adminHandlers.InitRouter(r, userStorage, gophermartStorage)
+
+		// Metrics, expvar publishes the command line with the database URI
+		r.Handle("/debug/vars", expvar.Handler())
+	})
+
 	log.Println("Server Started: http://" + address)
 
 	log.Fatal(http.ListenAndServe(address, r))
@@ -4,19 +4,39 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/GermanVor/go-tpl/internal/common"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
 	userStor "github.com/GermanVor/go-tpl/internal/userStor"
 	"github.com/go-chi/chi"
 )
 
 const (
 	SessionTokenName = "sessionToken"
-	limitReader      = 100
+	// fits the longest login and password allowed by userStor
+	limitReader = 1024
 )
 
+// published at /debug/vars, admins only
+var blockedLoginAttempts = expvar.NewInt("gophermart_blocked_login_attempts")
+
+// getIP does not trust X-Forwarded-For, a client could pick any address.
+func getIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 func CheckUserTokenMiddleware(next http.Handler, stor userStor.Interface) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie(SessionTokenName)
@@ -30,19 +50,48 @@ func CheckUserTokenMiddleware(next http.Handler, stor userStor.Interface) http.H
 			return
 		}
 
-		userID, err := stor.GetUserID(cookie.Value)
+		session, err := stor.GetSession(cookie.Value)
 		if err == nil {
-			newContext := context.WithValue(r.Context(), common.UserIDContextKey, userID)
+			// the expiry slides with every request
+			setUserCookie(w, r, session)
+
+			newContext := context.WithValue(r.Context(), common.UserIDContextKey, session.UserID)
+			newContext = context.WithValue(newContext, common.SessionTokenContextKey, session.Token)
 			r = r.WithContext(newContext)
 
 			next.ServeHTTP(w, r)
 		} else {
 			if errors.Is(err, userStor.ErrUnknownSessionToken) {
+				clearUserCookie(w, r)
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	})
+}
+
+// CheckAdminMiddleware goes after CheckUserTokenMiddleware. The role is read
+// on every request, so taking it away works at once.
+func CheckAdminMiddleware(next http.Handler, stor userStor.Interface) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := stor.GetUser(common.GetContextUserID(r))
+		if err != nil {
+			if errors.Is(err, userStor.ErrUnknownUser) {
 				w.WriteHeader(http.StatusUnauthorized)
 			} else {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
+
+			return
+		}
+
+		if user.Role != userStor.RoleAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			return
 		}
+
+		next.ServeHTTP(w, r)
 	})
 }
 
@@ -51,10 +100,51 @@ type UserRequest struct {
 	Password string `json:"password"`
 }
 
-func setUserCookie(w http.ResponseWriter, userID string) http.ResponseWriter {
+// ValidationErrorsResponse is the body of 400 Bad Request when the login or
+// the password breaks the policy.
+type ValidationErrorsResponse struct {
+	Errors userStor.ValidationErrors `json:"errors"`
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs userStor.ValidationErrors) {
+	bytes, err := json.Marshal(ValidationErrorsResponse{Errors: errs})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(bytes)
+}
+
+func setUserCookie(w http.ResponseWriter, r *http.Request, session *userStor.Session) http.ResponseWriter {
+	cookie := &http.Cookie{
+		Name:     SessionTokenName,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	http.SetCookie(w, cookie)
+
+	return w
+}
+
+func clearUserCookie(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	// drop the prolonged cookie set by CheckUserTokenMiddleware
+	w.Header().Del("Set-Cookie")
+
 	cookie := &http.Cookie{
-		Name:  SessionTokenName,
-		Value: userID,
+		Name:     SessionTokenName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
 	}
 
 	http.SetCookie(w, cookie)
@@ -86,18 +176,23 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request, stor userStor.Inter
 		return
 	}
 
-	sessionToken, err := stor.SignIn(userObj.Login, userObj.Password)
+	session, err := stor.SignIn(userObj.Login, userObj.Password, r.UserAgent())
 	if err != nil {
-		if errors.Is(err, userStor.ErrLoginOccupied) {
+		var validationErrs userStor.ValidationErrors
+
+		switch {
+		case errors.As(err, &validationErrs):
+			writeValidationErrors(w, validationErrs)
+		case errors.Is(err, userStor.ErrLoginOccupied):
 			http.Error(w, err.Error(), http.StatusConflict)
-		} else {
+		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
 		return
 	}
 
-	setUserCookie(w, sessionToken)
+	setUserCookie(w, r, session)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -125,18 +220,59 @@ func LoginHandler(w http.ResponseWriter, r *http.Request, stor userStor.Interfac
 		return
 	}
 
-	userID, err := stor.LogIn(userObj.Login, userObj.Password)
+	session, err := stor.LogIn(userObj.Login, userObj.Password, r.UserAgent(), getIP(r))
 	if err != nil {
-		if errors.Is(err, userStor.ErrUnknownUser) {
+		var blockedErr *userStor.LoginBlockedError
+
+		switch {
+		case errors.Is(err, userStor.ErrUnknownUser):
 			http.Error(w, err.Error(), http.StatusUnauthorized)
-		} else {
+		case errors.As(err, &blockedErr):
+			blockedLoginAttempts.Add(1)
+
+			retryAfter := math.Ceil(blockedErr.RetryAfter.Seconds())
+			w.Header().Set("Retry-After", strconv.FormatFloat(retryAfter, 'f', 0, 64))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	// the token the client logged in with before is replaced by the new one
+	if cookie, err := r.Cookie(SessionTokenName); err == nil && cookie.Value != session.Token {
+		err = stor.LogOut(cookie.Value)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+	}
+
+	setUserCookie(w, r, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request, stor userStor.Interface) {
+	err := stor.LogOut(common.GetContextSessionToken(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	clearUserCookie(w, r)
+	w.WriteHeader(http.StatusOK)
+}
 
+// LogoutEverywhereHandler ends every session of the user, including the current one.
+func LogoutEverywhereHandler(w http.ResponseWriter, r *http.Request, stor userStor.Interface) {
+	err := stor.LogOutEverywhere(common.GetContextUserID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	setUserCookie(w, userID)
+	clearUserCookie(w, r)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -149,3 +285,169 @@ func InitRouter(r chi.Router, stor userStor.Interface) {
 		LoginHandler(w, r, stor)
 	})
 }
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePasswordHandler keeps the current session, other devices have to log in again.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request, stor userStor.Interface) {
+	if r.Header.Get("Content-Type") != common.ApplicationJSONStr {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, limitReader+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(bodyBytes) > limitReader {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	passwordObj := ChangePasswordRequest{}
+	err = json.Unmarshal(bodyBytes, &passwordObj)
+	if err != nil || passwordObj.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = stor.ChangePassword(
+		common.GetContextUserID(r),
+		common.GetContextSessionToken(r),
+		passwordObj.OldPassword,
+		passwordObj.NewPassword,
+	)
+	if err != nil {
+		var validationErrs userStor.ValidationErrors
+
+		switch {
+		case errors.As(err, &validationErrs):
+			writeValidationErrors(w, validationErrs)
+		case errors.Is(err, userStor.ErrWrongPassword):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, userStor.ErrUnknownUser), errors.Is(err, userStor.ErrUnknownSessionToken):
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteUserHandler removes the account, see userStor.DeleteUser.
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request, stor userStor.Interface) {
+	err := stor.DeleteUser(common.GetContextUserID(r))
+	if err != nil {
+		if errors.Is(err, userStor.ErrUnknownUser) {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	clearUserCookie(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+// InitPrivateRouter registers routes which need CheckUserTokenMiddleware.
+func InitPrivateRouter(r chi.Router, stor userStor.Interface) {
+	r.Post("/api/user/logout", func(w http.ResponseWriter, r *http.Request) {
+		LogoutHandler(w, r, stor)
+	})
+
+	r.Post("/api/user/logout/all", func(w http.ResponseWriter, r *http.Request) {
+		LogoutEverywhereHandler(w, r, stor)
+	})
+
+	r.Post("/api/user/password", func(w http.ResponseWriter, r *http.Request) {
+		ChangePasswordHandler(w, r, stor)
+	})
+
+	r.Delete("/api/user", func(w http.ResponseWriter, r *http.Request) {
+		DeleteUserHandler(w, r, stor)
+	})
+}
+
+// ProfileResponse is the body of GET /api/user/me. Login and RegisteredAt are
+// omitted for users who registered before they were stored.
+type ProfileResponse struct {
+	UserID           string                 `json:"user_id"`
+	Login            string                 `json:"login,omitempty"`
+	Role             userStor.Role          `json:"role"`
+	RegisteredAt     string                 `json:"registered_at,omitempty"`
+	Balance          gophermartStor.Balance `json:"balance"`
+	OrdersCount      int                    `json:"orders_count"`
+	WithdrawalsCount int                    `json:"withdrawals_count"`
+}
+
+func GetProfileHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+	stor userStor.Interface,
+	gophermartStorage gophermartStor.Interface,
+) {
+	userID := common.GetContextUserID(r)
+
+	user, err := stor.GetUser(userID)
+	if err != nil {
+		if errors.Is(err, userStor.ErrUnknownUser) {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	balance, err := gophermartStorage.GetBalance(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := gophermartStorage.GetUserStats(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	profile := ProfileResponse{
+		UserID:           user.UserID,
+		Login:            user.Login,
+		Role:             user.Role,
+		Balance:          *balance,
+		OrdersCount:      stats.OrdersCount,
+		WithdrawalsCount: stats.WithdrawalsCount,
+	}
+
+	if !user.RegisteredAt.IsZero() {
+		profile.RegisteredAt = user.RegisteredAt.Format(time.RFC3339)
+	}
+
+	profileBytes, err := json.Marshal(profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.ApplicationJSONStr)
+	w.Write(profileBytes)
+}
+
+// InitProfileRouter registers routes which need CheckUserTokenMiddleware
+// and both storages.
+func InitProfileRouter(r chi.Router, stor userStor.Interface, gophermartStorage gophermartStor.Interface) {
+	r.Get("/api/user/me", func(w http.ResponseWriter, r *http.Request) {
+		GetProfileHandler(w, r, stor, gophermartStorage)
+	})
+}
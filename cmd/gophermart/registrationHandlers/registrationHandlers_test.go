@@ -2,92 +2,49 @@ package registrationhandlers_test
 
 import (
 	"bytes"
-	"context"
 	"encoding/hex"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	registrationHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/registrationHandlers"
 	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/jwt"
 	userStor "github.com/GermanVor/go-tpl/internal/userStor"
 	"github.com/bmizerany/assert"
 	"github.com/go-chi/chi"
 
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/stretchr/testify/require"
 )
 
-const databaseURI = "postgres://zzman:@localhost:5432/test"
-
 var userObj = registrationHandlers.UserRequest{
 	Login:    "Qwerty",
-	Password: "qwertY",
-}
-
-func cleanDatabase() {
-	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	dropTableNameList := []string{
-		"users",
-		"balances",
-	}
-
-	for _, tableName := range dropTableNameList {
-		sql := "DROP TABLE IF EXISTS " + tableName
-
-		_, err = conn.Exec(context.TODO(), sql)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-	}
-}
-
-func init() {
-	cleanDatabase()
+	Password: "Secret-2022",
 }
 
 type StorMock struct {
 	gophermartStor.Interface
 }
 
-// Need for correct work of SignIn registration handler
-func createBalancesTable() {
-	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	tx, err := conn.Begin(context.TODO())
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	defer tx.Rollback(context.TODO())
-
-	gophermartStor.CreateBalancesTable(tx)
-
-	tx.Commit(context.TODO())
+func initUserStorage() userStor.Interface {
+	// balance row creates in SignIn handler
+	return userStor.InitMemory(gophermartStor.InitMemory("", "", 0), userStor.DefaultSessionTTL, userStor.DefaultHashPolicy)
 }
 
 func createTestEnv() (string, func()) {
-	createBalancesTable()
-
 	r := chi.NewRouter()
 
-	userStorage := userStor.Init(databaseURI)
+	userStorage := initUserStorage()
 	registrationHandlers.InitRouter(r, userStorage)
 
 	ts := httptest.NewServer(r)
 
 	destructor := func() {
 		ts.Close()
-		cleanDatabase()
 	}
 
 	return ts.URL, destructor
@@ -140,6 +97,41 @@ func TestRegisterHandler(t *testing.T) {
 		assert.Equal(t, http.StatusConflict, resp.StatusCode)
 		assert.Equal(t, getSessionCookie(resp.Cookies()), (*http.Cookie)(nil))
 	})
+
+	t.Run("Login differs in case", func(t *testing.T) {
+		upperUserObj := userObj
+		upperUserObj.Login = strings.ToUpper(userObj.Login)
+
+		upperUserData, err := json.Marshal(upperUserObj)
+		require.NoError(t, err)
+
+		resp := registerUser(t, endpointURL, upperUserData)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("Invalid credentials", func(t *testing.T) {
+		invalidUserData, err := json.Marshal(registrationHandlers.UserRequest{
+			Login:    "Q",
+			Password: "secretsecret",
+		})
+		require.NoError(t, err)
+
+		resp := registerUser(t, endpointURL, invalidUserData)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, getSessionCookie(resp.Cookies()), (*http.Cookie)(nil))
+
+		body := registrationHandlers.ValidationErrorsResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, userStor.ValidationErrors{
+			{Field: "login", Code: userStor.CodeTooShort, Message: "login must have at least 3 characters"},
+			{Field: "password", Code: userStor.CodeTooWeak, Message: "password must contain a letter and a digit or a symbol"},
+		}, body.Errors)
+	})
 }
 
 func TestLoginHandler(t *testing.T) {
@@ -194,13 +186,11 @@ func TestLoginHandler(t *testing.T) {
 }
 
 func TestCheckUserTokenMiddleware(t *testing.T) {
-	createBalancesTable()
-
 	key := "qwerty"
 
 	r := chi.NewRouter()
 
-	userStorage := userStor.Init(databaseURI)
+	userStorage := initUserStorage()
 
 	r.Group(func(r chi.Router) {
 		registrationHandlers.InitRouter(r, userStorage)
@@ -219,10 +209,7 @@ func TestCheckUserTokenMiddleware(t *testing.T) {
 
 	ts := httptest.NewServer(r)
 	endpointURL := ts.URL
-	defer func() {
-		ts.Close()
-		cleanDatabase()
-	}()
+	defer ts.Close()
 
 	userData, err := json.Marshal(userObj)
 	require.NoError(t, err)
@@ -277,3 +264,413 @@ func TestCheckUserTokenMiddleware(t *testing.T) {
 		assert.NotEqual(t, key, hex.EncodeToString(bodyBytes))
 	})
 }
+
+func createPrivateTestEnv(sessionTTL time.Duration) (string, func()) {
+	gophermartStorage := gophermartStor.InitMemory("", "", 0)
+	userStorage := userStor.InitMemory(gophermartStorage, sessionTTL, userStor.DefaultHashPolicy)
+
+	return createPrivateTestEnvWith(userStorage, gophermartStorage)
+}
+
+func createPrivateTestEnvWith(
+	userStorage userStor.Interface,
+	gophermartStorage gophermartStor.Interface,
+) (string, func()) {
+	r := chi.NewRouter()
+
+	r.Group(func(r chi.Router) {
+		registrationHandlers.InitRouter(r, userStorage)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(func(h http.Handler) http.Handler {
+			return registrationHandlers.CheckUserTokenMiddleware(h, userStorage)
+		})
+
+		registrationHandlers.InitPrivateRouter(r, userStorage)
+		registrationHandlers.InitProfileRouter(r, userStorage, gophermartStorage)
+
+		r.Get("/test", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	})
+
+	ts := httptest.NewServer(r)
+
+	return ts.URL, ts.Close
+}
+
+func sessionRequest(t *testing.T, method string, url string, cookie *http.Cookie, body []byte) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	return resp
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	endpointURL, destructor := createPrivateTestEnv(userStor.DefaultSessionTTL)
+	defer destructor()
+
+	userData, err := json.Marshal(userObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	registerCookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, registerCookie, (*http.Cookie)(nil))
+
+	t.Run("Cookie attributes", func(t *testing.T) {
+		assert.Equal(t, true, registerCookie.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, registerCookie.SameSite)
+		assert.Equal(t, true, registerCookie.Expires.After(time.Now()))
+	})
+
+	t.Run("Login rotates the token", func(t *testing.T) {
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+		firstCookie := getSessionCookie(resp.Cookies())
+		require.NotEqual(t, firstCookie, (*http.Cookie)(nil))
+
+		resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", firstCookie, userData)
+		secondCookie := getSessionCookie(resp.Cookies())
+		require.NotEqual(t, secondCookie, (*http.Cookie)(nil))
+
+		assert.NotEqual(t, firstCookie.Value, secondCookie.Value)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", firstCookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", secondCookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// another device is not affected
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", registerCookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+		cookie := getSessionCookie(resp.Cookies())
+		require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+		resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/logout", cookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		clearedCookie := getSessionCookie(resp.Cookies())
+		require.NotEqual(t, clearedCookie, (*http.Cookie)(nil))
+		assert.Equal(t, "", clearedCookie.Value)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", registerCookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Logout everywhere", func(t *testing.T) {
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+		cookie := getSessionCookie(resp.Cookies())
+		require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+		resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/logout/all", cookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", registerCookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	sessionTTL := 200 * time.Millisecond
+
+	endpointURL, destructor := createPrivateTestEnv(sessionTTL)
+	defer destructor()
+
+	userData, err := json.Marshal(userObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	cookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+	// every request prolongs the session
+	for i := 0; i < 3; i++ {
+		time.Sleep(sessionTTL / 2)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	time.Sleep(sessionTTL + 50*time.Millisecond)
+
+	resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestJWTSessions(t *testing.T) {
+	key, err := jwt.NewHS256Key("hs-1", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+
+	keys, err := jwt.NewKeySet("hs-1", key)
+	require.NoError(t, err)
+
+	gophermartStorage := gophermartStor.InitMemory("", "", 0)
+	userStorage := userStor.InitMemory(gophermartStorage, userStor.DefaultSessionTTL, userStor.DefaultHashPolicy)
+
+	endpointURL, destructor := createPrivateTestEnvWith(userStor.InitJWT(userStorage, keys), gophermartStorage)
+	defer destructor()
+
+	userData, err := json.Marshal(userObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	cookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+	claims, err := keys.Verify(cookie.Value, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "1", claims.UserID)
+
+	resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	t.Run("Forged token", func(t *testing.T) {
+		segments := strings.Split(cookie.Value, ".")
+		segments[2] = segments[2][1:] + segments[2][:1]
+
+		forgedCookie := &http.Cookie{Name: cookie.Name, Value: strings.Join(segments, ".")}
+
+		resp := sessionRequest(t, http.MethodGet, endpointURL+"/test", forgedCookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Revoked token", func(t *testing.T) {
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/logout", cookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	endpointURL, destructor := createPrivateTestEnv(userStor.DefaultSessionTTL)
+	defer destructor()
+
+	userData, err := json.Marshal(userObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	cookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+	resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+	anotherCookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, anotherCookie, (*http.Cookie)(nil))
+
+	newUserObj := userObj
+	newUserObj.Password += "2"
+
+	t.Run("Wrong old password", func(t *testing.T) {
+		passwordData, err := json.Marshal(registrationHandlers.ChangePasswordRequest{
+			OldPassword: newUserObj.Password,
+			NewPassword: newUserObj.Password,
+		})
+		require.NoError(t, err)
+
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/password", cookie, passwordData)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", anotherCookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Weak new password", func(t *testing.T) {
+		passwordData, err := json.Marshal(registrationHandlers.ChangePasswordRequest{
+			OldPassword: userObj.Password,
+			NewPassword: "qwertyqwerty",
+		})
+		require.NoError(t, err)
+
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/password", cookie, passwordData)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", anotherCookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		passwordData, err := json.Marshal(registrationHandlers.ChangePasswordRequest{
+			OldPassword: userObj.Password,
+			NewPassword: newUserObj.Password,
+		})
+		require.NoError(t, err)
+
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/password", cookie, passwordData)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", anotherCookie, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		newUserData, err := json.Marshal(newUserObj)
+		require.NoError(t, err)
+
+		resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, newUserData)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	endpointURL, destructor := createPrivateTestEnv(userStor.DefaultSessionTTL)
+	defer destructor()
+
+	userData, err := json.Marshal(userObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	cookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+	resp = sessionRequest(t, http.MethodDelete, endpointURL+"/api/user", cookie, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = sessionRequest(t, http.MethodGet, endpointURL+"/test", cookie, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the login is free again
+	resp = registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLoginBruteForce(t *testing.T) {
+	endpointURL, destructor := createPrivateTestEnv(userStor.DefaultSessionTTL)
+	defer destructor()
+
+	userData, err := json.Marshal(userObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	wrongUserObj := userObj
+	wrongUserObj.Password += "@"
+
+	wrongUserData, err := json.Marshal(wrongUserObj)
+	require.NoError(t, err)
+
+	// a few failures are free, the next one blocks the login for a second
+	for i := 0; i < 4; i++ {
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, wrongUserData)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	t.Run("Blocked", func(t *testing.T) {
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	})
+
+	t.Run("Other logins are not blocked", func(t *testing.T) {
+		anotherUserObj := userObj
+		anotherUserObj.Login += "2"
+
+		anotherUserData, err := json.Marshal(anotherUserObj)
+		require.NoError(t, err)
+
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, anotherUserData)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Unblocked after Retry-After", func(t *testing.T) {
+		time.Sleep(time.Second)
+
+		resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, userData)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// success resets the counter
+		for i := 0; i < 3; i++ {
+			resp := sessionRequest(t, http.MethodPost, endpointURL+"/api/user/login", nil, wrongUserData)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+}
+
+func TestProfile(t *testing.T) {
+	endpointURL, destructor := createPrivateTestEnv(userStor.DefaultSessionTTL)
+	defer destructor()
+
+	registeredAt := time.Now().Truncate(time.Second)
+
+	fullwidthUserObj := userObj
+	fullwidthUserObj.Login = "Ｑｗｅｒｔｙ"
+
+	userData, err := json.Marshal(fullwidthUserObj)
+	require.NoError(t, err)
+
+	resp := registerUser(t, endpointURL, userData)
+	resp.Body.Close()
+
+	cookie := getSessionCookie(resp.Cookies())
+	require.NotEqual(t, cookie, (*http.Cookie)(nil))
+
+	t.Run("Success", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, endpointURL+"/api/user/me", nil)
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		profile := registrationHandlers.ProfileResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&profile))
+
+		assert.Equal(t, "1", profile.UserID)
+		assert.Equal(t, userObj.Login, profile.Login)
+		assert.Equal(t, gophermartStor.Balance{}, profile.Balance)
+		assert.Equal(t, 0, profile.OrdersCount)
+		assert.Equal(t, 0, profile.WithdrawalsCount)
+
+		parsedRegisteredAt, err := time.Parse(time.RFC3339, profile.RegisteredAt)
+		require.NoError(t, err)
+		assert.Equal(t, false, parsedRegisteredAt.Before(registeredAt))
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp := sessionRequest(t, http.MethodGet, endpointURL+"/api/user/me", nil, nil)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"log"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
@@ -25,12 +25,12 @@ const (
 type Order struct {
 	Order   string      `json:"order"`
 	Status  OrderStatus `json:"status"`
-	Accrual float64     `json:"accrual"`
+	Accrual money.Money `json:"accrual"`
 }
 
 type Good struct {
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
 }
 
 type OrderPackage struct {
@@ -45,16 +45,71 @@ const (
 	RewardTypePT      RewardType = "pt"
 )
 
+// GoodReward is a reward rule. Rules matching a good are resolved by the
+// one with the highest priority, see Resolution. Zero caps and minimum
+// basket price mean no limit.
 type GoodReward struct {
-	Match      string     `json:"match"`
-	Reward     float64    `json:"reward"`
-	RewardType RewardType `json:"reward_type"`
+	Match      string      `json:"match"`
+	MatchType  MatchType   `json:"match_type,omitempty"`
+	Reward     money.Money `json:"reward"`
+	RewardType RewardType  `json:"reward_type"`
+
+	// rules with higher priority are checked first
+	Priority   int        `json:"priority,omitempty"`
+	Resolution Resolution `json:"resolution,omitempty"`
+
+	// the biggest reward for one good
+	MaxPerItem money.Money `json:"max_per_item,omitempty"`
+	// the biggest reward of the rule for one order
+	MaxPerOrder money.Money `json:"max_per_order,omitempty"`
+	// the rule is skipped for orders cheaper than this
+	MinBasketPrice money.Money `json:"min_basket_price,omitempty"`
+
+	// the rule rewards orders registered in [ValidFrom, ValidUntil), nil
+	// means no bound
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+// GoodRewardVersion is a rule as it was from CreatedAt until DeletedAt.
+type GoodRewardVersion struct {
+	GoodReward
+
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	// nil for the live version of the rule
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type GoodRewardsForEachHandler func(goodReward *GoodReward) error
+type GoodRewardVersionsForEachHandler func(version *GoodRewardVersion) error
+
+// GoodRewards manages reward rules. Updates and deletes keep the replaced
+// version, so a rule has a history. Orders keep the accrual they got.
+type GoodRewards interface {
+	// SetGoodReward creates a rule, ErrGoodRewardAlreadyAccepted if the
+	// match has a live rule.
+	SetGoodReward(goodReward GoodReward) error
+	GetGoodReward(match string) (*GoodReward, error)
+	// UpdateGoodReward replaces the live rule of goodReward.Match.
+	UpdateGoodReward(goodReward GoodReward) error
+	DeleteGoodReward(match string) error
+
+	// GoodRewardsForEach iterates live rules in the state, every live rule
+	// for GoodRewardStateAny, by priority.
+	GoodRewardsForEach(state GoodRewardState, page common.Page, handler GoodRewardsForEachHandler) error
+	// GoodRewardHistoryForEach iterates every version of the rule, the
+	// oldest first.
+	GoodRewardHistoryForEach(match string, handler GoodRewardVersionsForEachHandler) error
 }
 
 type Interface interface {
+	APIKeys
+	GoodRewards
+
 	GetOrder(orderID string) (*Order, error)
+	GetOrderBreakdown(orderID string) (*Breakdown, error)
 	SetOrder(orderPackage OrderPackage) error
-	SetGoodReward(goodReward GoodReward) error
 }
 
 func InitCheckRequestsLimiter(requestCountLimit uint16) func() bool {
@@ -93,6 +148,9 @@ type storageObject struct {
 	dbPool *pgxpool.Pool
 
 	checkRequestsLimit func() bool
+
+	rules           *ruleCache
+	calculationWake chan struct{}
 }
 
 var (
@@ -102,6 +160,7 @@ var (
 	ErrInvalidOrderIDFormat      = errors.New("invalid order id format")
 	ErrExceededRequestsNumber    = errors.New("too many requests")
 	ErrUnknownOrderID            = errors.New("unknown order id")
+	ErrUnknownGoodReward         = errors.New("unknown good reward")
 )
 
 var (
@@ -111,57 +170,11 @@ var (
 	// INSERT INTO ordersReward (orderID, status, accrual) VALUES ($1, $2, $3)
 	insertOrderSQL = "INSERT INTO ordersReward (orderID, status, accrual) VALUES ($1, $2, $3)"
 
-	// UPDATE ordersReward SET status=$2 WHERE orderID=$1
-	setOrderStatusSQL = "UPDATE ordersReward SET status=$2 WHERE orderID=$1"
-
-	// UPDATE ordersReward SET status='PROCESSED', accrual=$2 WHERE orderID=$1
-	setOrderAccrualSQL = "UPDATE ordersReward SET " +
-		"status='" + string(OrderStatusProcessed) + "', accrual=$2 WHERE orderID=$1"
-
-	// INSERT INTO goodsBaskets (orderID, description, price) VALUES ($1, $2, $3)
-	setGoodsBasketsSQL = "INSERT INTO goodsBaskets (orderID, description, price) VALUES ($1, $2, $3)"
-
-	// INSERT INTO goods (match, reward, reward_type) VALUES ($1, $2, $3)
-	setGoodRewardSQL = "INSERT INTO goods (match, reward, reward_type) VALUES ($1, $2, $3)"
-
-	// SELECT match, reward, reward_type FROM goods
-	selectGoodRewardSQL = "SELECT match, reward, reward_type FROM goods"
+	// INSERT INTO goodsBaskets (orderID, description, price, position) VALUES ($1, $2, $3, $4)
+	setGoodsBasketsSQL = "INSERT INTO goodsBaskets (orderID, description, price, position) VALUES ($1, $2, $3, $4)"
 )
 
-func CreateOrdersRewardTable(tx pgx.Tx) error {
-	sql := "CREATE TABLE IF NOT EXISTS ordersReward (" +
-		"orderID text UNIQUE, " +
-		"status text, " +
-		"accrual decimal" +
-		")"
-
-	_, err := tx.Exec(context.TODO(), sql)
-	return err
-}
-
-func CreateGoodsTable(tx pgx.Tx) error {
-	sql := "CREATE TABLE IF NOT EXISTS goods (" +
-		"match text UNIQUE, " +
-		"reward decimal, " +
-		"reward_type text" +
-		")"
-
-	_, err := tx.Exec(context.TODO(), sql)
-	return err
-}
-
-func CreateGoodsBasketsTable(tx pgx.Tx) error {
-	sql := "CREATE TABLE IF NOT EXISTS goodsBaskets (" +
-		"orderID text, " +
-		"description text, " +
-		"price decimal" +
-		")"
-
-	_, err := tx.Exec(context.TODO(), sql)
-	return err
-}
-
-func Init(databaseURI string, requestCountLimit uint16) Interface {
+func Init(databaseURI string, requestCountLimit uint16, calculationWorkersCount uint) Interface {
 	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -169,40 +182,22 @@ func Init(databaseURI string, requestCountLimit uint16) Interface {
 
 	log.Printf("Connected to DB %s successfully\n", databaseURI)
 
-	tx, err := conn.Begin(context.TODO())
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	defer tx.Rollback(context.TODO())
-
-	{
-		err = CreateOrdersRewardTable(tx)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-
-		err = CreateGoodsTable(tx)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-
-		err = CreateGoodsBasketsTable(tx)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-	}
-
-	err = tx.Commit(context.TODO())
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	log.Println("Created Tables (ordersReward, goods, goodsBaskets) successfully")
-
-	return &storageObject{
+	stor := &storageObject{
 		dbPool:             conn,
 		checkRequestsLimit: InitCheckRequestsLimiter(requestCountLimit),
+		calculationWake:    make(chan struct{}, 1),
 	}
+	stor.rules = newRuleCache(stor.liveGoodRewardVersions)
+
+	startCalculationWorkers(
+		context.Background(),
+		calculationWorkersCount,
+		stor,
+		stor.rules,
+		stor.calculationWake,
+	)
+
+	return stor
 }
 
 func (stor *storageObject) GetOrder(orderID string) (*Order, error) {
@@ -232,142 +227,48 @@ func (stor *storageObject) GetOrder(orderID string) (*Order, error) {
 	return order, nil
 }
 
-func (stor *storageObject) startCalculateAccrual(orderPackage OrderPackage) {
-	var err error
-	defer func() {
-		if err != nil {
-			log.Println("Order Calculating order ", orderPackage.Order, err)
-			stor.dbPool.Exec(
-				context.TODO(),
-				setOrderStatusSQL,
-				orderPackage.Order,
-				OrderStatusInvalid,
-			)
-		}
-	}()
-
-	_, err = stor.dbPool.Exec(
-		context.TODO(),
-		setOrderStatusSQL,
-		orderPackage.Order,
-		OrderStatusProcessing,
-	)
-	if err != nil {
-		return
-	}
-
-	rows, err := stor.dbPool.Query(context.TODO(), selectGoodRewardSQL)
-	if err != nil {
-		return
-	}
-
-	accrual := float64(0)
-	goodReward := GoodReward{}
-
-	for rows.Next() {
-		err = rows.Scan(&goodReward.Match, &goodReward.Reward, &goodReward.RewardType)
-		if err != nil {
-			return
-		}
-
-		for i := 0; i != len(orderPackage.Goods); i++ {
-			if strings.Contains(orderPackage.Goods[i].Description, goodReward.Match) {
-				switch goodReward.RewardType {
-				case RewardTypePT:
-					accrual += goodReward.Reward
-				case RewardTypePercent:
-					accrual += float64(orderPackage.Goods[i].Price) * float64(goodReward.Reward) / 100
-				}
-			}
-		}
-	}
-
-	_, err = stor.dbPool.Exec(
-		context.TODO(),
-		setOrderAccrualSQL,
-		orderPackage.Order,
-		accrual,
-	)
-}
-
 func (stor *storageObject) SetOrder(orderPackage OrderPackage) error {
 	if !common.CheckOrderIDFormat(orderPackage.Order) {
 		return ErrInvalidOrderIDFormat
 	}
 
-	_, err := stor.dbPool.Exec(
-		context.TODO(),
-		insertOrderSQL,
-		orderPackage.Order,
-		OrderStatusRegistered,
-		float64(0),
-	)
-	if err != nil {
-		if common.IsAlreadyCreatedRowErr(err) {
-			return ErrOrderAlreadyAccepted
-		}
-
-		return err
-	}
-
-	tx, err := stor.dbPool.Begin(context.TODO())
-	if err != nil {
-		return err
-	}
-
-	defer func(stor *storageObject, orderPackage OrderPackage) {
-		if errors.Is(tx.Rollback(context.TODO()), pgx.ErrTxClosed) && err == nil {
-			stor.startCalculateAccrual(orderPackage)
-		}
-	}(stor, orderPackage)
-
-	for i := 0; i != len(orderPackage.Goods); i++ {
-		_, err = tx.Exec(context.TODO(),
-			setGoodsBasketsSQL,
+	// workers claim REGISTERED orders, so the order and its goods appear
+	// together
+	err := stor.dbPool.BeginFunc(context.TODO(), func(tx pgx.Tx) error {
+		_, err := tx.Exec(
+			context.TODO(),
+			insertOrderSQL,
 			orderPackage.Order,
-			orderPackage.Goods[i].Description,
-			orderPackage.Goods[i].Price,
+			OrderStatusRegistered,
+			money.Money(0),
 		)
 		if err != nil {
 			return err
 		}
-	}
-
-	err = tx.Commit(context.TODO())
-	return err
-}
 
-func checkGoodRewardType(rewardType string) bool {
-	switch rewardType {
-	case string(RewardTypePT):
-	case string(RewardTypePercent):
-	default:
-		return false
-	}
-
-	return true
-}
-
-func (stor *storageObject) SetGoodReward(goodReward GoodReward) error {
-	if goodReward.Match == "" || goodReward.Reward < 0 || !checkGoodRewardType(string(goodReward.RewardType)) {
-		return ErrInvalidGoodReward
-	}
-
-	_, err := stor.dbPool.Exec(
-		context.TODO(),
-		setGoodRewardSQL,
-		goodReward.Match,
-		goodReward.Reward,
-		goodReward.RewardType,
-	)
+		for i, good := range orderPackage.Goods {
+			_, err = tx.Exec(context.TODO(),
+				setGoodsBasketsSQL,
+				orderPackage.Order,
+				good.Description,
+				good.Price,
+				i,
+			)
+			if err != nil {
+				return err
+			}
+		}
 
+		return nil
+	})
 	if err != nil {
 		if common.IsAlreadyCreatedRowErr(err) {
-			return ErrGoodRewardAlreadyAccepted
+			return ErrOrderAlreadyAccepted
 		}
 
 		return err
 	}
 
+	wakeCalculationWorker(stor.calculationWake)
 	return nil
 }
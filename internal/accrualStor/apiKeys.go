@@ -0,0 +1,327 @@
+package accrualstor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Scope is what a key is allowed to do, a key may have several.
+type Scope string
+
+const (
+	// GET /api/orders/{orderID} and its breakdown, the gophermart poller needs
+	// only this one
+	ScopeOrdersRead Scope = "orders:read"
+	// POST /api/orders
+	ScopeOrdersWrite Scope = "orders:write"
+	// GET /api/goods
+	ScopeGoodsRead Scope = "goods:read"
+	// POST /api/goods
+	ScopeGoodsWrite Scope = "goods:write"
+)
+
+var Scopes = []Scope{ScopeOrdersRead, ScopeOrdersWrite, ScopeGoodsRead, ScopeGoodsWrite}
+
+// APIKey is handed out as "<KeyID>.<Secret>", see String. The secret is
+// either sent as is in X-API-Key or used to sign requests, see Sign.
+type APIKey struct {
+	KeyID     string
+	Secret    string
+	Scopes    []Scope
+	CreatedAt time.Time
+	// zero for active keys
+	RevokedAt time.Time
+}
+
+func (key *APIKey) String() string {
+	return key.KeyID + "." + key.Secret
+}
+
+func (key *APIKey) HasScope(scope Scope) bool {
+	for _, keyScope := range key.Scopes {
+		if keyScope == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type APIKeysForEachHandler func(key *APIKey) error
+
+// APIKeys manages keys of the accrual system clients.
+type APIKeys interface {
+	CreateAPIKey(scopes []Scope) (*APIKey, error)
+	// GetAPIKey returns ErrUnknownAPIKey for unknown and revoked keys.
+	GetAPIKey(keyID string) (*APIKey, error)
+	// APIKeysForEach iterates revoked keys too, the oldest first.
+	APIKeysForEach(handler APIKeysForEachHandler) error
+	RevokeAPIKey(keyID string) error
+}
+
+var (
+	ErrUnknownAPIKey = errors.New("unknown api key")
+	ErrInvalidAPIKey = errors.New("api key must look like <key id>.<secret>")
+	ErrUnknownScope  = errors.New("unknown api key scope")
+)
+
+const (
+	// INSERT INTO apiKeys (keyID, secret, scopes) VALUES ($1, $2, $3) RETURNING created_at
+	insertAPIKeySQL = "INSERT INTO apiKeys (keyID, secret, scopes) VALUES ($1, $2, $3) RETURNING created_at"
+
+	// SELECT keyID, secret, scopes, created_at FROM apiKeys WHERE keyID=$1 AND revoked_at IS NULL
+	getAPIKeySQL = "SELECT keyID, secret, scopes, created_at FROM apiKeys WHERE keyID=$1 AND revoked_at IS NULL"
+
+	// SELECT keyID, secret, scopes, created_at, revoked_at FROM apiKeys ORDER BY created_at
+	selectAPIKeysSQL = "SELECT keyID, secret, scopes, created_at, revoked_at FROM apiKeys ORDER BY created_at"
+
+	// UPDATE apiKeys SET revoked_at=NOW() WHERE keyID=$1 AND revoked_at IS NULL
+	revokeAPIKeySQL = "UPDATE apiKeys SET revoked_at=NOW() WHERE keyID=$1 AND revoked_at IS NULL"
+)
+
+func randomHex(size int) (string, error) {
+	bytes := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+func newAPIKey(scopes []Scope) (*APIKey, error) {
+	if len(scopes) == 0 {
+		return nil, ErrUnknownScope
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, knownScope := range Scopes {
+			known = known || scope == knownScope
+		}
+
+		if !known {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+
+	keyID, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKey{
+		KeyID:  keyID,
+		Secret: secret,
+		Scopes: append([]Scope{}, scopes...),
+	}, nil
+}
+
+// ParseAPIKey splits "<key id>.<secret>".
+func ParseAPIKey(str string) (keyID string, secret string, err error) {
+	keyID, secret, ok := strings.Cut(str, ".")
+	if !ok || keyID == "" || secret == "" {
+		return "", "", ErrInvalidAPIKey
+	}
+
+	return keyID, secret, nil
+}
+
+// A request carries either the whole key:
+//
+//	X-API-Key: <key id>.<secret>
+//
+// or the key ID and the signature of the request, see Sign:
+//
+//	X-Key-ID: <key id>
+//	X-Timestamp: <unix seconds>
+//	X-Signature: <hex hmac-sha256>
+const (
+	APIKeyHeader    = "X-API-Key"
+	KeyIDHeader     = "X-Key-ID"
+	TimestampHeader = "X-Timestamp"
+	SignatureHeader = "X-Signature"
+)
+
+// signed requests older or newer than this are refused
+const MaxClockSkew = 5 * time.Minute
+
+// Sign returns the hex HMAC-SHA256 of a request, both the accrual system
+// and its client build it the same way:
+//
+//	METHOD\nREQUEST URI\nUNIX TIMESTAMP\nhex(sha256(body))
+func Sign(secret string, method string, requestURI string, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func scopesToStrings(scopes []Scope) []string {
+	arr := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		arr = append(arr, string(scope))
+	}
+
+	return arr
+}
+
+func scopesFromStrings(arr []string) []Scope {
+	scopes := make([]Scope, 0, len(arr))
+	for _, str := range arr {
+		scopes = append(scopes, Scope(str))
+	}
+
+	return scopes
+}
+
+func (stor *storageObject) CreateAPIKey(scopes []Scope) (*APIKey, error) {
+	key, err := newAPIKey(scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stor.dbPool.QueryRow(
+		context.TODO(),
+		insertAPIKeySQL,
+		key.KeyID,
+		key.Secret,
+		scopesToStrings(key.Scopes),
+	).Scan(&key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (stor *storageObject) GetAPIKey(keyID string) (*APIKey, error) {
+	key := &APIKey{}
+	scopes := []string{}
+
+	err := stor.dbPool.QueryRow(context.TODO(), getAPIKeySQL, keyID).
+		Scan(&key.KeyID, &key.Secret, &scopes, &key.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownAPIKey
+		}
+
+		return nil, err
+	}
+
+	key.Scopes = scopesFromStrings(scopes)
+	return key, nil
+}
+
+func (stor *storageObject) APIKeysForEach(handler APIKeysForEachHandler) error {
+	rows, err := stor.dbPool.Query(context.TODO(), selectAPIKeysSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key := &APIKey{}
+		scopes := []string{}
+		var revokedAt *time.Time
+
+		err := rows.Scan(&key.KeyID, &key.Secret, &scopes, &key.CreatedAt, &revokedAt)
+		if err != nil {
+			return err
+		}
+
+		key.Scopes = scopesFromStrings(scopes)
+		if revokedAt != nil {
+			key.RevokedAt = *revokedAt
+		}
+
+		err = handler(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (stor *storageObject) RevokeAPIKey(keyID string) error {
+	tag, err := stor.dbPool.Exec(context.TODO(), revokeAPIKeySQL, keyID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownAPIKey
+	}
+
+	return nil
+}
+
+// APIKeysCommand runs "accrual keys create <scope>...|list|revoke <key id>".
+// The whole key is printed only once, on create.
+func APIKeysCommand(keys APIKeys, args []string, out io.Writer) error {
+	usage := errors.New("usage: accrual [flags] keys create <scope>...|list|revoke <key id>, scopes: " +
+		strings.Join(scopesToStrings(Scopes), " "))
+
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		key, err := keys.CreateAPIKey(scopesFromStrings(args[1:]))
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(out, key.String())
+		return err
+	case "list":
+		if len(args) != 1 {
+			return usage
+		}
+
+		return keys.APIKeysForEach(func(key *APIKey) error {
+			state := "active"
+			if !key.RevokedAt.IsZero() {
+				state = "revoked " + key.RevokedAt.UTC().Format(time.RFC3339)
+			}
+
+			_, err := fmt.Fprintf(
+				out,
+				"%s\t%s\t%s\t%s\n",
+				key.KeyID,
+				strings.Join(scopesToStrings(key.Scopes), ","),
+				key.CreatedAt.UTC().Format(time.RFC3339),
+				state,
+			)
+
+			return err
+		})
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+
+		return keys.RevokeAPIKey(args[1])
+	}
+
+	return usage
+}
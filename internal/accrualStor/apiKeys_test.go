@@ -0,0 +1,50 @@
+package accrualstor_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeysCommand(t *testing.T) {
+	stor := accrualStor.InitMemory(10, 0)
+	out := &bytes.Buffer{}
+
+	require.NoError(t, accrualStor.APIKeysCommand(stor, []string{"create", "orders:read"}, out))
+
+	keyID, secret, err := accrualStor.ParseAPIKey(strings.TrimSpace(out.String()))
+	require.NoError(t, err)
+
+	key, err := stor.GetAPIKey(keyID)
+	require.NoError(t, err)
+	assert.Equal(t, secret, key.Secret)
+	assert.True(t, key.HasScope(accrualStor.ScopeOrdersRead))
+	assert.False(t, key.HasScope(accrualStor.ScopeGoodsWrite))
+
+	err = accrualStor.APIKeysCommand(stor, []string{"create", "orders:delete"}, out)
+	assert.ErrorIs(t, err, accrualStor.ErrUnknownScope)
+
+	out.Reset()
+	require.NoError(t, accrualStor.APIKeysCommand(stor, []string{"list"}, out))
+	assert.Contains(t, out.String(), keyID+"\torders:read\t")
+	assert.NotContains(t, out.String(), secret)
+	assert.Contains(t, out.String(), "active")
+
+	require.NoError(t, accrualStor.APIKeysCommand(stor, []string{"revoke", keyID}, out))
+
+	_, err = stor.GetAPIKey(keyID)
+	assert.ErrorIs(t, err, accrualStor.ErrUnknownAPIKey)
+
+	err = accrualStor.APIKeysCommand(stor, []string{"revoke", keyID}, out)
+	assert.ErrorIs(t, err, accrualStor.ErrUnknownAPIKey)
+
+	out.Reset()
+	require.NoError(t, accrualStor.APIKeysCommand(stor, []string{"list"}, out))
+	assert.Contains(t, out.String(), "revoked")
+
+	assert.Error(t, accrualStor.APIKeysCommand(stor, []string{"rotate"}, out))
+}
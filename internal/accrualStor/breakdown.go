@@ -0,0 +1,126 @@
+package accrualstor
+
+import (
+	"context"
+	"errors"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/jackc/pgx/v4"
+)
+
+// BreakdownItem is the reward of one rule for one good of an order.
+type BreakdownItem struct {
+	// index of the good in OrderPackage.Goods
+	Position    int         `json:"position"`
+	Description string      `json:"description"`
+	Price       money.Money `json:"price"`
+
+	Match       string      `json:"match"`
+	RuleVersion int         `json:"rule_version"`
+	RewardType  RewardType  `json:"reward_type"`
+	Reward      money.Money `json:"reward"`
+
+	Accrual money.Money `json:"accrual"`
+}
+
+// Breakdown explains the accrual of an order. Items are empty until the
+// order is processed and for orders processed before breakdowns were kept.
+type Breakdown struct {
+	Order   string          `json:"order"`
+	Status  OrderStatus     `json:"status"`
+	Accrual money.Money     `json:"accrual"`
+	Items   []BreakdownItem `json:"items"`
+}
+
+const (
+	// INSERT INTO accrualBreakdown (orderID, position, description, price, match,
+	// rule_version, reward_type, reward, accrual) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	insertBreakdownItemSQL = "INSERT INTO accrualBreakdown (orderID, position, description, price, match, " +
+		"rule_version, reward_type, reward, accrual) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+
+	// SELECT position, description, price, match, rule_version, reward_type, reward, accrual
+	// FROM accrualBreakdown WHERE orderID=$1 ORDER BY position, match
+	selectBreakdownSQL = "SELECT position, description, price, match, rule_version, reward_type, reward, accrual " +
+		"FROM accrualBreakdown WHERE orderID=$1 ORDER BY position, match"
+)
+
+func insertBreakdown(tx pgx.Tx, orderID string, items []BreakdownItem) error {
+	for _, item := range items {
+		_, err := tx.Exec(
+			context.TODO(),
+			insertBreakdownItemSQL,
+			orderID,
+			item.Position,
+			item.Description,
+			item.Price,
+			item.Match,
+			item.RuleVersion,
+			item.RewardType,
+			item.Reward,
+			item.Accrual,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stor *storageObject) GetOrderBreakdown(orderID string) (*Breakdown, error) {
+	if !common.CheckOrderIDFormat(orderID) {
+		return nil, ErrInvalidOrderIDFormat
+	}
+
+	if !stor.checkRequestsLimit() {
+		return nil, ErrExceededRequestsNumber
+	}
+
+	breakdown := &Breakdown{
+		Order: orderID,
+		Items: make([]BreakdownItem, 0),
+	}
+
+	err := stor.dbPool.QueryRow(context.TODO(), getOrderSQL, orderID).
+		Scan(&breakdown.Status, &breakdown.Accrual)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownOrderID
+		}
+
+		return nil, err
+	}
+
+	rows, err := stor.dbPool.Query(context.TODO(), selectBreakdownSQL, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := BreakdownItem{}
+
+		err := rows.Scan(
+			&item.Position,
+			&item.Description,
+			&item.Price,
+			&item.Match,
+			&item.RuleVersion,
+			&item.RewardType,
+			&item.Reward,
+			&item.Accrual,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		breakdown.Items = append(breakdown.Items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
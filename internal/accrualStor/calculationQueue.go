@@ -0,0 +1,261 @@
+package accrualstor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// a claimed order is invisible to other workers for this time, then the
+	// order of a crashed worker is calculated again
+	calculationLease = time.Minute
+	// worker sleep when there are no registered orders
+	calculationIdleDelay = 200 * time.Millisecond
+	// rules changed by other replicas are picked up after this time
+	ruleCacheTTL = time.Minute
+	// an order which failed this many calculations, or crashed its
+	// workers, is invalid
+	calculationMaxAttempts = 10
+
+	DefaultCalculationWorkersCount = 4
+)
+
+// errCalculationClaimLost means the lease of the order expired and another
+// worker has claimed it.
+var errCalculationClaimLost = errors.New("order calculation claim is lost")
+
+type calculationJob struct {
+	OrderID      string
+	Goods        []Good
+	RegisteredAt time.Time
+	// identifies the claim, only its worker may save the order
+	ClaimedAt time.Time
+	// claims of the order, this one included
+	Attempts uint
+}
+
+type calculationQueue interface {
+	// claimJob leases one registered order and marks it PROCESSING, it
+	// returns nil if there are none.
+	claimJob(ctx context.Context) (*calculationJob, error)
+	// finishJob saves the breakdown and marks the order PROCESSED.
+	finishJob(ctx context.Context, job *calculationJob, items []BreakdownItem) error
+	// failJob marks the order INVALID.
+	failJob(ctx context.Context, job *calculationJob) error
+}
+
+// ruleCache keeps the compiled live rules between orders. Writers of the
+// rules invalidate it.
+type ruleCache struct {
+	load func() ([]GoodRewardVersion, error)
+
+	mux      sync.Mutex
+	rules    []*rule
+	loadedAt time.Time
+	// bumped by invalidate, so a load racing with a write is not kept
+	generation uint64
+}
+
+func newRuleCache(load func() ([]GoodRewardVersion, error)) *ruleCache {
+	return &ruleCache{load: load}
+}
+
+func (cache *ruleCache) get() ([]*rule, error) {
+	cache.mux.Lock()
+	if cache.rules != nil && time.Since(cache.loadedAt) < ruleCacheTTL {
+		defer cache.mux.Unlock()
+		return cache.rules, nil
+	}
+	generation := cache.generation
+	cache.mux.Unlock()
+
+	versions, err := cache.load()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := compileRules(versions)
+
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if generation == cache.generation {
+		cache.rules = rules
+		cache.loadedAt = time.Now()
+	}
+
+	return rules, nil
+}
+
+func (cache *ruleCache) invalidate() {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	cache.rules = nil
+	cache.generation++
+}
+
+// wakeCalculationWorker tells an idle worker there is a new order, it
+// never blocks.
+func wakeCalculationWorker(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func processCalculationJob(ctx context.Context, queue calculationQueue, job *calculationJob, cache *ruleCache) error {
+	if job.Attempts > calculationMaxAttempts {
+		log.Println("calculation error, gave up on the order", job.OrderID)
+		return queue.failJob(ctx, job)
+	}
+
+	rules, err := cache.get()
+	if err != nil {
+		// the order is calculated again when the lease expires
+		return err
+	}
+
+	items := calculateAccrual(job.Goods, rules, job.RegisteredAt)
+
+	return queue.finishJob(ctx, job, items)
+}
+
+// startCalculationWorkers runs workersCount goroutines which share the
+// queue. With Postgres the queue can be shared by several replicas.
+func startCalculationWorkers(
+	ctx context.Context,
+	workersCount uint,
+	queue calculationQueue,
+	cache *ruleCache,
+	wake chan struct{},
+) {
+	for i := uint(0); i < workersCount; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				job, err := queue.claimJob(ctx)
+				if err != nil {
+					log.Println("calculation queue error", err)
+				}
+
+				if err != nil || job == nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-wake:
+					case <-time.After(calculationIdleDelay):
+					}
+
+					continue
+				}
+
+				err = processCalculationJob(ctx, queue, job, cache)
+				if err != nil {
+					log.Println("calculation queue error", job.OrderID, err)
+				}
+			}
+		}()
+	}
+}
+
+const (
+	// UPDATE ordersReward SET status='PROCESSING', claimed_at=NOW(), attempts=attempts+1
+	// WHERE orderID=(SELECT ... FOR UPDATE SKIP LOCKED)
+	// RETURNING orderID, registered_at, claimed_at, attempts
+	//
+	// orders left PROCESSING by a crashed worker, or by versions which
+	// calculated on the request goroutine, are claimed again
+	claimCalculationJobSQL = "UPDATE ordersReward SET " +
+		"status='" + string(OrderStatusProcessing) + "', claimed_at=NOW(), attempts=attempts+1 " +
+		"WHERE orderID=(" +
+		"SELECT orderID FROM ordersReward WHERE status='" + string(OrderStatusRegistered) + "' " +
+		"OR (status='" + string(OrderStatusProcessing) + "' " +
+		"AND (claimed_at IS NULL OR claimed_at<NOW()-make_interval(secs => $1))) " +
+		"ORDER BY registered_at LIMIT 1 FOR UPDATE SKIP LOCKED" +
+		") RETURNING orderID, registered_at, claimed_at, attempts"
+
+	// SELECT description, price FROM goodsBaskets WHERE orderID=$1 ORDER BY position
+	selectGoodsBasketSQL = "SELECT description, price FROM goodsBaskets WHERE orderID=$1 ORDER BY position"
+
+	// UPDATE ordersReward SET status='PROCESSED', accrual=$2 WHERE orderID=$1 AND claimed_at=$3
+	setOrderAccrualSQL = "UPDATE ordersReward SET " +
+		"status='" + string(OrderStatusProcessed) + "', accrual=$2 WHERE orderID=$1 AND claimed_at=$3"
+
+	// UPDATE ordersReward SET status='INVALID' WHERE orderID=$1 AND claimed_at=$2
+	setOrderInvalidSQL = "UPDATE ordersReward SET " +
+		"status='" + string(OrderStatusInvalid) + "' WHERE orderID=$1 AND claimed_at=$2"
+)
+
+func (stor *storageObject) claimJob(ctx context.Context) (*calculationJob, error) {
+	job := &calculationJob{
+		Goods: make([]Good, 0),
+	}
+
+	err := stor.dbPool.QueryRow(ctx, claimCalculationJobSQL, calculationLease.Seconds()).
+		Scan(&job.OrderID, &job.RegisteredAt, &job.ClaimedAt, &job.Attempts)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	rows, err := stor.dbPool.Query(ctx, selectGoodsBasketSQL, job.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		good := Good{}
+
+		err := rows.Scan(&good.Description, &good.Price)
+		if err != nil {
+			return nil, err
+		}
+
+		job.Goods = append(job.Goods, good)
+	}
+
+	return job, rows.Err()
+}
+
+func (stor *storageObject) finishJob(ctx context.Context, job *calculationJob, items []BreakdownItem) error {
+	return stor.dbPool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, setOrderAccrualSQL, job.OrderID, sumAccrual(items), job.ClaimedAt)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			return errCalculationClaimLost
+		}
+
+		return insertBreakdown(tx, job.OrderID, items)
+	})
+}
+
+func (stor *storageObject) failJob(ctx context.Context, job *calculationJob) error {
+	tag, err := stor.dbPool.Exec(ctx, setOrderInvalidSQL, job.OrderID, job.ClaimedAt)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return errCalculationClaimLost
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package accrualstor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleCache(t *testing.T) {
+	loads := 0
+	cache := newRuleCache(func() ([]GoodRewardVersion, error) {
+		loads++
+		return []GoodRewardVersion{{GoodReward: normalizeGoodReward(GoodReward{Match: "Bork"})}}, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		rules, err := cache.get()
+		require.NoError(t, err)
+		require.Len(t, rules, 1)
+	}
+	assert.Equal(t, 1, loads)
+
+	cache.invalidate()
+
+	_, err := cache.get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, loads)
+}
+
+func TestCalculationWorkers(t *testing.T) {
+	stor := InitMemory(10, 2)
+
+	orderStatus := func(orderID string) (OrderStatus, money.Money) {
+		stor.mux.RLock()
+		defer stor.mux.RUnlock()
+
+		order := stor.orders[orderID].order
+		return order.Status, order.Accrual
+	}
+
+	calculate := func(orderID string, expected string) {
+		require.NoError(t, stor.SetOrder(OrderPackage{
+			Order: orderID,
+			Goods: []Good{{Description: "Bork kettle", Price: money.MustParse("100")}},
+		}))
+
+		require.Eventually(t, func() bool {
+			status, _ := orderStatus(orderID)
+			return status == OrderStatusProcessed
+		}, time.Second, 10*time.Millisecond)
+
+		_, accrual := orderStatus(orderID)
+		assert.Equal(t, money.MustParse(expected), accrual, orderID)
+	}
+
+	goodReward := GoodReward{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePT}
+	require.NoError(t, stor.SetGoodReward(goodReward))
+	calculate("70757088342", "10")
+
+	// the cached rules are replaced on update
+	goodReward.Reward = money.MustParse("20")
+	require.NoError(t, stor.UpdateGoodReward(goodReward))
+	calculate("12345678903", "20")
+
+	require.NoError(t, stor.DeleteGoodReward(goodReward.Match))
+	calculate("4561261212345467", "0")
+}
+
+func TestCalculationGivesUpOnFailingOrder(t *testing.T) {
+	const orderID = "70757088342"
+
+	stor := InitMemory(10, 0)
+	require.NoError(t, stor.SetOrder(OrderPackage{
+		Order: orderID,
+		Goods: []Good{{Description: "Bork kettle", Price: money.MustParse("100")}},
+	}))
+
+	cache := newRuleCache(func() ([]GoodRewardVersion, error) {
+		return nil, errors.New("database is down")
+	})
+
+	ctx := context.Background()
+
+	for i := 0; i < calculationMaxAttempts; i++ {
+		job, err := stor.claimJob(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, job)
+
+		assert.Error(t, processCalculationJob(ctx, stor, job, cache))
+
+		// the lease expires
+		stor.mux.Lock()
+		stor.orders[orderID].claimedAt = time.Now().Add(-calculationLease)
+		stor.mux.Unlock()
+	}
+
+	job, err := stor.claimJob(ctx)
+	require.NoError(t, err)
+	require.NoError(t, processCalculationJob(ctx, stor, job, cache))
+
+	order, err := stor.GetOrder(orderID)
+	require.NoError(t, err)
+	assert.Equal(t, OrderStatusInvalid, order.Status)
+
+	job, err = stor.claimJob(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+}
@@ -0,0 +1,266 @@
+package accrualstor
+
+import (
+	"context"
+	"errors"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/jackc/pgx/v4"
+)
+
+// Every version of a rule is a row of goods, replaced and deleted
+// versions have deleted_at set and only the live one has not.
+const (
+	goodRewardColumns = "match, match_type, reward, reward_type, priority, resolution, " +
+		"max_per_item, max_per_order, min_basket_price, valid_from, valid_until"
+
+	// INSERT INTO goods (match, ..., valid_until, version) VALUES ($1, ..., $11,
+	// (SELECT COALESCE(MAX(version), 0)+1 FROM goods WHERE match=$1))
+	insertGoodRewardSQL = "INSERT INTO goods (" + goodRewardColumns + ", version) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, " +
+		"(SELECT COALESCE(MAX(version), 0)+1 FROM goods WHERE match=$1))"
+
+	// UPDATE goods SET deleted_at=NOW() WHERE match=$1 AND deleted_at IS NULL
+	deleteGoodRewardSQL = "UPDATE goods SET deleted_at=NOW() WHERE match=$1 AND deleted_at IS NULL"
+
+	// SELECT match, ..., valid_until FROM goods WHERE deleted_at IS NULL
+	selectLiveGoodRewardsSQL = "SELECT " + goodRewardColumns + " FROM goods WHERE deleted_at IS NULL"
+
+	// SELECT match, ..., valid_until FROM goods WHERE deleted_at IS NULL AND match=$1
+	getGoodRewardSQL = selectLiveGoodRewardsSQL + " AND match=$1"
+
+	// SELECT match, ..., valid_until, version, created_at, deleted_at FROM goods
+	selectGoodRewardVersionsSQL = "SELECT " + goodRewardColumns + ", version, created_at, deleted_at FROM goods"
+
+	// SELECT match, ..., valid_until, version, created_at, deleted_at FROM goods
+	// WHERE deleted_at IS NULL ORDER BY priority DESC, match
+	selectLiveGoodRewardVersionsSQL = selectGoodRewardVersionsSQL + " WHERE deleted_at IS NULL ORDER BY priority DESC, match"
+
+	// SELECT match, ..., valid_until, version, created_at, deleted_at FROM goods
+	// WHERE match=$1 ORDER BY version
+	selectGoodRewardHistorySQL = selectGoodRewardVersionsSQL + " WHERE match=$1 ORDER BY version"
+)
+
+// conditions of selectLiveGoodRewardsSQL
+var goodRewardStatesSQL = map[GoodRewardState]string{
+	GoodRewardStateAny: "",
+	GoodRewardStateActive: " AND (valid_from IS NULL OR valid_from<=NOW()) " +
+		"AND (valid_until IS NULL OR valid_until>NOW())",
+	GoodRewardStateUpcoming: " AND valid_from>NOW()",
+	GoodRewardStateExpired:  " AND valid_until<=NOW()",
+}
+
+func goodRewardArgs(goodReward GoodReward) []interface{} {
+	return []interface{}{
+		goodReward.Match,
+		goodReward.MatchType,
+		goodReward.Reward,
+		goodReward.RewardType,
+		goodReward.Priority,
+		goodReward.Resolution,
+		goodReward.MaxPerItem,
+		goodReward.MaxPerOrder,
+		goodReward.MinBasketPrice,
+		goodReward.ValidFrom,
+		goodReward.ValidUntil,
+	}
+}
+
+func goodRewardDest(goodReward *GoodReward) []interface{} {
+	return []interface{}{
+		&goodReward.Match,
+		&goodReward.MatchType,
+		&goodReward.Reward,
+		&goodReward.RewardType,
+		&goodReward.Priority,
+		&goodReward.Resolution,
+		&goodReward.MaxPerItem,
+		&goodReward.MaxPerOrder,
+		&goodReward.MinBasketPrice,
+		&goodReward.ValidFrom,
+		&goodReward.ValidUntil,
+	}
+}
+
+func scanGoodReward(row pgx.Row, goodReward *GoodReward) error {
+	return row.Scan(goodRewardDest(goodReward)...)
+}
+
+func scanGoodRewardVersion(row pgx.Row, version *GoodRewardVersion) error {
+	dest := append(goodRewardDest(&version.GoodReward), &version.Version, &version.CreatedAt, &version.DeletedAt)
+	return row.Scan(dest...)
+}
+
+func (stor *storageObject) liveGoodRewardVersions() ([]GoodRewardVersion, error) {
+	rows, err := stor.dbPool.Query(context.TODO(), selectLiveGoodRewardVersionsSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]GoodRewardVersion, 0)
+	for rows.Next() {
+		version := GoodRewardVersion{}
+
+		err := scanGoodRewardVersion(rows, &version)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func (stor *storageObject) SetGoodReward(goodReward GoodReward) error {
+	goodReward = normalizeGoodReward(goodReward)
+
+	err := checkGoodReward(goodReward)
+	if err != nil {
+		return err
+	}
+
+	_, err = stor.dbPool.Exec(context.TODO(), insertGoodRewardSQL, goodRewardArgs(goodReward)...)
+	if err != nil {
+		if common.IsAlreadyCreatedRowErr(err) {
+			return ErrGoodRewardAlreadyAccepted
+		}
+
+		return err
+	}
+
+	stor.rules.invalidate()
+	return nil
+}
+
+func (stor *storageObject) GetGoodReward(match string) (*GoodReward, error) {
+	goodReward := &GoodReward{}
+
+	err := scanGoodReward(stor.dbPool.QueryRow(context.TODO(), getGoodRewardSQL, match), goodReward)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownGoodReward
+		}
+
+		return nil, err
+	}
+
+	return goodReward, nil
+}
+
+func (stor *storageObject) UpdateGoodReward(goodReward GoodReward) error {
+	goodReward = normalizeGoodReward(goodReward)
+
+	err := checkGoodReward(goodReward)
+	if err != nil {
+		return err
+	}
+
+	err = stor.dbPool.BeginFunc(context.TODO(), func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.TODO(), deleteGoodRewardSQL, goodReward.Match)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			return ErrUnknownGoodReward
+		}
+
+		_, err = tx.Exec(context.TODO(), insertGoodRewardSQL, goodRewardArgs(goodReward)...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	stor.rules.invalidate()
+	return nil
+}
+
+func (stor *storageObject) DeleteGoodReward(match string) error {
+	tag, err := stor.dbPool.Exec(context.TODO(), deleteGoodRewardSQL, match)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownGoodReward
+	}
+
+	stor.rules.invalidate()
+	return nil
+}
+
+func (stor *storageObject) GoodRewardsForEach(
+	state GoodRewardState,
+	page common.Page,
+	handler GoodRewardsForEachHandler,
+) error {
+	where, ok := goodRewardStatesSQL[state]
+	if !ok {
+		return ErrUnknownGoodRewardState
+	}
+
+	rows, err := stor.dbPool.Query(
+		context.TODO(),
+		selectLiveGoodRewardsSQL+where+" ORDER BY priority DESC, match LIMIT $1 OFFSET $2",
+		page.Limit,
+		page.Offset,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		goodReward := &GoodReward{}
+
+		err := scanGoodReward(rows, goodReward)
+		if err != nil {
+			return err
+		}
+
+		err = handler(goodReward)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (stor *storageObject) GoodRewardHistoryForEach(match string, handler GoodRewardVersionsForEachHandler) error {
+	rows, err := stor.dbPool.Query(context.TODO(), selectGoodRewardHistorySQL, match)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		version := &GoodRewardVersion{}
+
+		err := scanGoodRewardVersion(rows, version)
+		if err != nil {
+			return err
+		}
+
+		found = true
+
+		err = handler(version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrUnknownGoodReward
+	}
+
+	return nil
+}
@@ -0,0 +1,468 @@
+package accrualstor
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+)
+
+type memoryOrder struct {
+	order        Order
+	goods        []Good
+	registeredAt time.Time
+	breakdown    []BreakdownItem
+	claimedAt    time.Time
+	attempts     uint
+}
+
+// MemoryStorage keeps orders and reward rules in process memory.
+type MemoryStorage struct {
+	Interface
+
+	mux sync.RWMutex
+
+	orders map[string]*memoryOrder
+	// every version of every rule in insertion order, like a table scan
+	// of goods
+	goodRewards []*GoodRewardVersion
+	// apiKeys in creation order
+	apiKeys []*APIKey
+	// IDs of REGISTERED orders, the oldest first
+	registered []string
+	// IDs of PROCESSING orders, the earliest claimed first
+	claimed []string
+
+	checkRequestsLimit func() bool
+
+	rules           *ruleCache
+	calculationWake chan struct{}
+}
+
+func InitMemory(requestCountLimit uint16, calculationWorkersCount uint) *MemoryStorage {
+	log.Println("Created in-memory accrualStor")
+
+	stor := &MemoryStorage{
+		orders:             make(map[string]*memoryOrder),
+		goodRewards:        make([]*GoodRewardVersion, 0),
+		apiKeys:            make([]*APIKey, 0),
+		registered:         make([]string, 0),
+		claimed:            make([]string, 0),
+		checkRequestsLimit: InitCheckRequestsLimiter(requestCountLimit),
+		calculationWake:    make(chan struct{}, 1),
+	}
+	stor.rules = newRuleCache(func() ([]GoodRewardVersion, error) {
+		stor.mux.RLock()
+		defer stor.mux.RUnlock()
+
+		return stor.liveGoodRewards(), nil
+	})
+
+	startCalculationWorkers(
+		context.Background(),
+		calculationWorkersCount,
+		stor,
+		stor.rules,
+		stor.calculationWake,
+	)
+
+	return stor
+}
+
+func (stor *MemoryStorage) GetOrder(orderID string) (*Order, error) {
+	if !common.CheckOrderIDFormat(orderID) {
+		return nil, ErrInvalidOrderIDFormat
+	}
+
+	if !stor.checkRequestsLimit() {
+		return nil, ErrExceededRequestsNumber
+	}
+
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	memOrder, ok := stor.orders[orderID]
+	if !ok {
+		return nil, ErrUnknownOrderID
+	}
+
+	order := memOrder.order
+	return &order, nil
+}
+
+func (stor *MemoryStorage) GetOrderBreakdown(orderID string) (*Breakdown, error) {
+	if !common.CheckOrderIDFormat(orderID) {
+		return nil, ErrInvalidOrderIDFormat
+	}
+
+	if !stor.checkRequestsLimit() {
+		return nil, ErrExceededRequestsNumber
+	}
+
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	memOrder, ok := stor.orders[orderID]
+	if !ok {
+		return nil, ErrUnknownOrderID
+	}
+
+	return &Breakdown{
+		Order:   orderID,
+		Status:  memOrder.order.Status,
+		Accrual: memOrder.order.Accrual,
+		Items:   append(make([]BreakdownItem, 0, len(memOrder.breakdown)), memOrder.breakdown...),
+	}, nil
+}
+
+func (stor *MemoryStorage) claimJob(ctx context.Context) (*calculationJob, error) {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	now := time.Now()
+
+	orderID := ""
+	switch {
+	case len(stor.registered) > 0:
+		orderID = stor.registered[0]
+		stor.registered = stor.registered[1:]
+	case len(stor.claimed) > 0 && now.Sub(stor.orders[stor.claimed[0]].claimedAt) >= calculationLease:
+		orderID = stor.claimed[0]
+		stor.claimed = stor.claimed[1:]
+	default:
+		return nil, nil
+	}
+
+	memOrder := stor.orders[orderID]
+	memOrder.order.Status = OrderStatusProcessing
+	memOrder.claimedAt = now
+	memOrder.attempts++
+
+	stor.claimed = append(stor.claimed, orderID)
+
+	return &calculationJob{
+		OrderID:      memOrder.order.Order,
+		Goods:        append(make([]Good, 0, len(memOrder.goods)), memOrder.goods...),
+		RegisteredAt: memOrder.registeredAt,
+		ClaimedAt:    memOrder.claimedAt,
+		Attempts:     memOrder.attempts,
+	}, nil
+}
+
+// releaseClaim must be called with the lock held.
+func (stor *MemoryStorage) releaseClaim(job *calculationJob) (*memoryOrder, error) {
+	memOrder := stor.orders[job.OrderID]
+	if !memOrder.claimedAt.Equal(job.ClaimedAt) {
+		return nil, errCalculationClaimLost
+	}
+
+	for i, orderID := range stor.claimed {
+		if orderID == job.OrderID {
+			stor.claimed = append(stor.claimed[:i], stor.claimed[i+1:]...)
+			break
+		}
+	}
+
+	return memOrder, nil
+}
+
+func (stor *MemoryStorage) finishJob(ctx context.Context, job *calculationJob, items []BreakdownItem) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	memOrder, err := stor.releaseClaim(job)
+	if err != nil {
+		return err
+	}
+
+	memOrder.breakdown = items
+	memOrder.order.Accrual = sumAccrual(items)
+	memOrder.order.Status = OrderStatusProcessed
+
+	return nil
+}
+
+func (stor *MemoryStorage) failJob(ctx context.Context, job *calculationJob) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	memOrder, err := stor.releaseClaim(job)
+	if err != nil {
+		return err
+	}
+
+	memOrder.order.Status = OrderStatusInvalid
+
+	return nil
+}
+
+func (stor *MemoryStorage) SetOrder(orderPackage OrderPackage) error {
+	if !common.CheckOrderIDFormat(orderPackage.Order) {
+		return ErrInvalidOrderIDFormat
+	}
+
+	stor.mux.Lock()
+
+	if _, ok := stor.orders[orderPackage.Order]; ok {
+		stor.mux.Unlock()
+		return ErrOrderAlreadyAccepted
+	}
+
+	goods := make([]Good, len(orderPackage.Goods))
+	copy(goods, orderPackage.Goods)
+
+	stor.orders[orderPackage.Order] = &memoryOrder{
+		order: Order{
+			Order:  orderPackage.Order,
+			Status: OrderStatusRegistered,
+		},
+		goods:        goods,
+		registeredAt: time.Now(),
+	}
+	stor.registered = append(stor.registered, orderPackage.Order)
+
+	stor.mux.Unlock()
+
+	wakeCalculationWorker(stor.calculationWake)
+	return nil
+}
+
+// liveGoodRewards expects stor.mux to be locked.
+func (stor *MemoryStorage) liveGoodRewards() []GoodRewardVersion {
+	versions := make([]GoodRewardVersion, 0, len(stor.goodRewards))
+	for _, version := range stor.goodRewards {
+		if version.DeletedAt == nil {
+			versions = append(versions, *version)
+		}
+	}
+
+	return versions
+}
+
+// liveGoodReward expects stor.mux to be locked.
+func (stor *MemoryStorage) liveGoodReward(match string) *GoodRewardVersion {
+	for _, version := range stor.goodRewards {
+		if version.Match == match && version.DeletedAt == nil {
+			return version
+		}
+	}
+
+	return nil
+}
+
+// addGoodReward expects stor.mux to be locked.
+func (stor *MemoryStorage) addGoodReward(goodReward GoodReward) {
+	version := &GoodRewardVersion{
+		GoodReward: goodReward,
+		Version:    1,
+		CreatedAt:  time.Now(),
+	}
+
+	for _, storedVersion := range stor.goodRewards {
+		if storedVersion.Match == goodReward.Match && storedVersion.Version >= version.Version {
+			version.Version = storedVersion.Version + 1
+		}
+	}
+
+	stor.goodRewards = append(stor.goodRewards, version)
+}
+
+func (stor *MemoryStorage) SetGoodReward(goodReward GoodReward) error {
+	goodReward = normalizeGoodReward(goodReward)
+
+	err := checkGoodReward(goodReward)
+	if err != nil {
+		return err
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	if stor.liveGoodReward(goodReward.Match) != nil {
+		return ErrGoodRewardAlreadyAccepted
+	}
+
+	stor.addGoodReward(goodReward)
+	stor.rules.invalidate()
+	return nil
+}
+
+func (stor *MemoryStorage) GetGoodReward(match string) (*GoodReward, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	version := stor.liveGoodReward(match)
+	if version == nil {
+		return nil, ErrUnknownGoodReward
+	}
+
+	goodReward := version.GoodReward
+	return &goodReward, nil
+}
+
+func (stor *MemoryStorage) UpdateGoodReward(goodReward GoodReward) error {
+	goodReward = normalizeGoodReward(goodReward)
+
+	err := checkGoodReward(goodReward)
+	if err != nil {
+		return err
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	version := stor.liveGoodReward(goodReward.Match)
+	if version == nil {
+		return ErrUnknownGoodReward
+	}
+
+	now := time.Now()
+	version.DeletedAt = &now
+
+	stor.addGoodReward(goodReward)
+	stor.rules.invalidate()
+	return nil
+}
+
+func (stor *MemoryStorage) DeleteGoodReward(match string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	version := stor.liveGoodReward(match)
+	if version == nil {
+		return ErrUnknownGoodReward
+	}
+
+	now := time.Now()
+	version.DeletedAt = &now
+
+	stor.rules.invalidate()
+	return nil
+}
+
+func (stor *MemoryStorage) GoodRewardsForEach(
+	state GoodRewardState,
+	page common.Page,
+	handler GoodRewardsForEachHandler,
+) error {
+	if _, ok := goodRewardStatesSQL[state]; !ok {
+		return ErrUnknownGoodRewardState
+	}
+
+	now := time.Now()
+
+	stor.mux.RLock()
+	goodRewards := make([]GoodReward, 0, len(stor.goodRewards))
+	for _, version := range stor.liveGoodRewards() {
+		if state == GoodRewardStateAny || version.State(now) == state {
+			goodRewards = append(goodRewards, version.GoodReward)
+		}
+	}
+	stor.mux.RUnlock()
+
+	sort.SliceStable(goodRewards, func(i, j int) bool {
+		if goodRewards[i].Priority != goodRewards[j].Priority {
+			return goodRewards[i].Priority > goodRewards[j].Priority
+		}
+
+		return goodRewards[i].Match < goodRewards[j].Match
+	})
+
+	for i := page.Offset; i < uint64(len(goodRewards)) && i < page.Offset+page.Limit; i++ {
+		err := handler(&goodRewards[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) GoodRewardHistoryForEach(match string, handler GoodRewardVersionsForEachHandler) error {
+	stor.mux.RLock()
+	versions := make([]GoodRewardVersion, 0)
+	for _, version := range stor.goodRewards {
+		if version.Match == match {
+			versions = append(versions, *version)
+		}
+	}
+	stor.mux.RUnlock()
+
+	if len(versions) == 0 {
+		return ErrUnknownGoodReward
+	}
+
+	for i := range versions {
+		err := handler(&versions[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) CreateAPIKey(scopes []Scope) (*APIKey, error) {
+	key, err := newAPIKey(scopes)
+	if err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.Now()
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	stor.apiKeys = append(stor.apiKeys, key)
+
+	created := *key
+	return &created, nil
+}
+
+func (stor *MemoryStorage) GetAPIKey(keyID string) (*APIKey, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	for _, key := range stor.apiKeys {
+		if key.KeyID == keyID && key.RevokedAt.IsZero() {
+			found := *key
+			return &found, nil
+		}
+	}
+
+	return nil, ErrUnknownAPIKey
+}
+
+func (stor *MemoryStorage) APIKeysForEach(handler APIKeysForEachHandler) error {
+	stor.mux.RLock()
+	keys := make([]APIKey, 0, len(stor.apiKeys))
+	for _, key := range stor.apiKeys {
+		keys = append(keys, *key)
+	}
+	stor.mux.RUnlock()
+
+	for i := range keys {
+		err := handler(&keys[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) RevokeAPIKey(keyID string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	for _, key := range stor.apiKeys {
+		if key.KeyID == keyID && key.RevokedAt.IsZero() {
+			key.RevokedAt = time.Now()
+			return nil
+		}
+	}
+
+	return ErrUnknownAPIKey
+}
@@ -0,0 +1,295 @@
+package accrualstor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/money"
+)
+
+type MatchType string
+
+const (
+	// the description contains Match, the default
+	MatchTypeContains MatchType = "contains"
+	MatchTypeExact    MatchType = "exact"
+	MatchTypePrefix   MatchType = "prefix"
+	// Match is an RE2 regular expression, see regexp/syntax
+	MatchTypeRegex MatchType = "regex"
+)
+
+// Resolution decides which of the rules matching a good are rewarded. The
+// matching rule with the highest priority picks it for the good.
+type Resolution string
+
+const (
+	// every matching rule is rewarded, the default
+	ResolutionStack Resolution = "stack"
+	// only the matching rule with the highest priority is rewarded
+	ResolutionFirst Resolution = "first"
+	// only the matching rule with the biggest reward is rewarded
+	ResolutionBest Resolution = "best"
+)
+
+// GoodRewardState is where now is relative to the validity of a rule.
+type GoodRewardState string
+
+const (
+	GoodRewardStateAny      GoodRewardState = ""
+	GoodRewardStateActive   GoodRewardState = "active"
+	GoodRewardStateUpcoming GoodRewardState = "upcoming"
+	GoodRewardStateExpired  GoodRewardState = "expired"
+)
+
+var ErrUnknownGoodRewardState = errors.New("unknown good reward state")
+
+// State returns the state of the rule at t.
+func (goodReward *GoodReward) State(t time.Time) GoodRewardState {
+	switch {
+	case goodReward.ValidFrom != nil && t.Before(*goodReward.ValidFrom):
+		return GoodRewardStateUpcoming
+	case goodReward.ValidUntil != nil && !t.Before(*goodReward.ValidUntil):
+		return GoodRewardStateExpired
+	}
+
+	return GoodRewardStateActive
+}
+
+// the longest Match of regex rules
+const maxRegexLen = 256
+
+// rule is a version of a GoodReward prepared for matching.
+type rule struct {
+	GoodRewardVersion
+
+	regexp *regexp.Regexp
+}
+
+func compileRule(version GoodRewardVersion) (*rule, error) {
+	r := &rule{GoodRewardVersion: version}
+
+	if version.MatchType == MatchTypeRegex {
+		if len(version.Match) > maxRegexLen {
+			return nil, fmt.Errorf("%w: regex is longer than %d", ErrInvalidGoodReward, maxRegexLen)
+		}
+
+		var err error
+		r.regexp, err = regexp.Compile(version.Match)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidGoodReward, err.Error())
+		}
+	}
+
+	return r, nil
+}
+
+// compileRules returns rules by priority, then by match, so the first match
+// does not depend on the order of the versions. A rule which does not compile, e.g. a regex stored before
+// validation, is skipped so it can not fail the orders.
+func compileRules(versions []GoodRewardVersion) []*rule {
+	rules := make([]*rule, 0, len(versions))
+
+	for _, version := range versions {
+		r, err := compileRule(version)
+		if err != nil {
+			log.Println("Good reward is skipped", version.Match, version.Version, err)
+			continue
+		}
+
+		rules = append(rules, r)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+
+		return rules[i].Match < rules[j].Match
+	})
+
+	return rules
+}
+
+func (r *rule) matches(description string) bool {
+	switch r.MatchType {
+	case MatchTypeExact:
+		return description == r.Match
+	case MatchTypePrefix:
+		return strings.HasPrefix(description, r.Match)
+	case MatchTypeRegex:
+		return r.regexp.MatchString(description)
+	}
+
+	return strings.Contains(description, r.Match)
+}
+
+func (r *rule) itemReward(good Good) money.Money {
+	reward := money.Money(0)
+
+	switch r.RewardType {
+	case RewardTypePT:
+		reward = r.Reward
+	case RewardTypePercent:
+		reward = good.Price.Percent(r.Reward)
+	}
+
+	if r.MaxPerItem > 0 && reward > r.MaxPerItem {
+		reward = r.MaxPerItem
+	}
+
+	return reward
+}
+
+// resolve picks the rewarded rules out of rules matching the good.
+func resolve(good Good, matched []*rule) []*rule {
+	switch matched[0].Resolution {
+	case ResolutionFirst:
+		return matched[:1]
+	case ResolutionBest:
+		best := matched[0]
+		for _, r := range matched[1:] {
+			if r.itemReward(good) > best.itemReward(good) {
+				best = r
+			}
+		}
+
+		return []*rule{best}
+	}
+
+	return matched
+}
+
+// calculateAccrual returns the reward of every rule for every good it
+// matched, rules capped to zero included. Only rules active at
+// registeredAt of the order count, rules are expected by priority, see
+// compileRules.
+func calculateAccrual(goods []Good, rules []*rule, registeredAt time.Time) []BreakdownItem {
+	basketPrice := money.Money(0)
+	for _, good := range goods {
+		basketPrice += good.Price
+	}
+
+	// rewarded by every rule so far, for MaxPerOrder
+	rewarded := make(map[*rule]money.Money)
+	items := make([]BreakdownItem, 0)
+
+	for position, good := range goods {
+		matched := make([]*rule, 0)
+		for _, r := range rules {
+			if r.State(registeredAt) == GoodRewardStateActive &&
+				basketPrice >= r.MinBasketPrice &&
+				r.matches(good.Description) {
+				matched = append(matched, r)
+			}
+		}
+
+		if len(matched) == 0 {
+			continue
+		}
+
+		for _, r := range resolve(good, matched) {
+			reward := r.itemReward(good)
+
+			if r.MaxPerOrder > 0 && rewarded[r]+reward > r.MaxPerOrder {
+				reward = r.MaxPerOrder - rewarded[r]
+			}
+
+			rewarded[r] += reward
+
+			items = append(items, BreakdownItem{
+				Position:    position,
+				Description: good.Description,
+				Price:       good.Price,
+				Match:       r.Match,
+				RuleVersion: r.Version,
+				RewardType:  r.RewardType,
+				Reward:      r.Reward,
+				Accrual:     reward,
+			})
+		}
+	}
+
+	return items
+}
+
+func sumAccrual(items []BreakdownItem) money.Money {
+	accrual := money.Money(0)
+	for _, item := range items {
+		accrual += item.Accrual
+	}
+
+	return accrual
+}
+
+func checkGoodRewardType(rewardType RewardType) bool {
+	switch rewardType {
+	case RewardTypePT:
+	case RewardTypePercent:
+	default:
+		return false
+	}
+
+	return true
+}
+
+// normalizeGoodReward fills defaults of the fields added after match,
+// reward and reward_type, so old clients keep the old behaviour.
+func normalizeGoodReward(goodReward GoodReward) GoodReward {
+	if goodReward.MatchType == "" {
+		goodReward.MatchType = MatchTypeContains
+	}
+
+	if goodReward.Resolution == "" {
+		goodReward.Resolution = ResolutionStack
+	}
+
+	return goodReward
+}
+
+// checkGoodReward expects a normalized goodReward.
+func checkGoodReward(goodReward GoodReward) error {
+	if goodReward.Match == "" {
+		return fmt.Errorf("%w: empty match", ErrInvalidGoodReward)
+	}
+
+	switch goodReward.MatchType {
+	case MatchTypeContains, MatchTypeExact, MatchTypePrefix:
+	case MatchTypeRegex:
+		_, err := compileRule(GoodRewardVersion{GoodReward: goodReward})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown match_type %q", ErrInvalidGoodReward, goodReward.MatchType)
+	}
+
+	if goodReward.Reward < 0 {
+		return fmt.Errorf("%w: negative reward", ErrInvalidGoodReward)
+	}
+
+	if !checkGoodRewardType(goodReward.RewardType) {
+		return fmt.Errorf("%w: unknown reward_type %q", ErrInvalidGoodReward, goodReward.RewardType)
+	}
+
+	switch goodReward.Resolution {
+	case ResolutionStack, ResolutionFirst, ResolutionBest:
+	default:
+		return fmt.Errorf("%w: unknown resolution %q", ErrInvalidGoodReward, goodReward.Resolution)
+	}
+
+	if goodReward.MaxPerItem < 0 || goodReward.MaxPerOrder < 0 || goodReward.MinBasketPrice < 0 {
+		return fmt.Errorf("%w: negative cap or minimum basket price", ErrInvalidGoodReward)
+	}
+
+	if goodReward.ValidFrom != nil && goodReward.ValidUntil != nil &&
+		!goodReward.ValidUntil.After(*goodReward.ValidFrom) {
+		return fmt.Errorf("%w: valid_until is not after valid_from", ErrInvalidGoodReward)
+	}
+
+	return nil
+}
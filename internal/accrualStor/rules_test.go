@@ -0,0 +1,214 @@
+package accrualstor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getRules(t *testing.T, goodRewards ...GoodReward) []*rule {
+	versions := make([]GoodRewardVersion, 0, len(goodRewards))
+	for _, goodReward := range goodRewards {
+		versions = append(versions, GoodRewardVersion{GoodReward: normalizeGoodReward(goodReward), Version: 1})
+	}
+
+	return compileRules(versions)
+}
+
+func TestCompileRulesSkipsBadRule(t *testing.T) {
+	versions := []GoodRewardVersion{
+		{GoodReward: normalizeGoodReward(GoodReward{Match: "Bork(", MatchType: MatchTypeRegex}), Version: 1},
+		{GoodReward: normalizeGoodReward(GoodReward{Match: "Bork"}), Version: 1},
+	}
+
+	rules := compileRules(versions)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "Bork", rules[0].Match)
+}
+
+func TestCalculateAccrual(t *testing.T) {
+	goods := []Good{
+		{Description: "Bork kettle", Price: money.MustParse("100")},
+		{Description: "Bork iron", Price: money.MustParse("300")},
+		{Description: "LG fridge", Price: money.MustParse("1000")},
+	}
+
+	tests := []struct {
+		name        string
+		goodRewards []GoodReward
+		accrual     string
+	}{
+		{
+			name: "Every contains rule stacks",
+			goodRewards: []GoodReward{
+				{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent},
+				{Match: "iron", Reward: money.MustParse("5"), RewardType: RewardTypePT},
+			},
+			accrual: "45",
+		},
+		{
+			name: "Exact, prefix and regex",
+			goodRewards: []GoodReward{
+				{Match: "Bork", MatchType: MatchTypeExact, Reward: money.MustParse("1"), RewardType: RewardTypePT},
+				{Match: "LG ", MatchType: MatchTypePrefix, Reward: money.MustParse("2"), RewardType: RewardTypePT},
+				{Match: `^Bork (iron|toaster)$`, MatchType: MatchTypeRegex, Reward: money.MustParse("3"), RewardType: RewardTypePT},
+			},
+			accrual: "5",
+		},
+		{
+			name: "First match wins",
+			goodRewards: []GoodReward{
+				{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent},
+				{Match: "iron", Reward: money.MustParse("1"), RewardType: RewardTypePT, Priority: 1, Resolution: ResolutionFirst},
+			},
+			accrual: "11",
+		},
+		{
+			name: "First match of equal priority is by match",
+			goodRewards: []GoodReward{
+				{Match: "iron", Reward: money.MustParse("1"), RewardType: RewardTypePT, Priority: 1, Resolution: ResolutionFirst},
+				{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent, Priority: 1, Resolution: ResolutionFirst},
+			},
+			accrual: "40",
+		},
+		{
+			name: "Best reward wins",
+			goodRewards: []GoodReward{
+				{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent},
+				{Match: "iron", Reward: money.MustParse("1"), RewardType: RewardTypePT, Priority: 1, Resolution: ResolutionBest},
+			},
+			accrual: "40",
+		},
+		{
+			name: "Caps",
+			goodRewards: []GoodReward{
+				{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent, MaxPerItem: money.MustParse("20")},
+				{Match: ".", MatchType: MatchTypeRegex, Reward: money.MustParse("50"), RewardType: RewardTypePT, MaxPerOrder: money.MustParse("120")},
+			},
+			accrual: "150",
+		},
+		{
+			name: "Minimum basket price",
+			goodRewards: []GoodReward{
+				{Match: "Bork", Reward: money.MustParse("1"), RewardType: RewardTypePT, MinBasketPrice: money.MustParse("1400")},
+				{Match: "LG", Reward: money.MustParse("1"), RewardType: RewardTypePT, MinBasketPrice: money.MustParse("1400.01")},
+			},
+			accrual: "2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := calculateAccrual(goods, getRules(t, test.goodRewards...), time.Now())
+			assert.Equal(t, money.MustParse(test.accrual), sumAccrual(items))
+		})
+	}
+}
+
+func TestCalculateAccrualCampaigns(t *testing.T) {
+	weekendStart := time.Date(2022, 5, 7, 0, 0, 0, 0, time.UTC)
+	weekendEnd := weekendStart.Add(48 * time.Hour)
+
+	goods := []Good{{Description: "Bork kettle", Price: money.MustParse("100")}}
+	rules := getRules(
+		t,
+		GoodReward{Match: "Bork", Reward: money.MustParse("1"), RewardType: RewardTypePT},
+		GoodReward{
+			Match:      "kettle",
+			Reward:     money.MustParse("10"),
+			RewardType: RewardTypePT,
+			ValidFrom:  &weekendStart,
+			ValidUntil: &weekendEnd,
+		},
+	)
+
+	for registeredAt, expected := range map[time.Time]string{
+		weekendStart.Add(-time.Second): "1",
+		weekendStart:                   "11",
+		weekendEnd.Add(-time.Second):   "11",
+		weekendEnd:                     "1",
+	} {
+		items := calculateAccrual(goods, rules, registeredAt)
+		assert.Equal(t, money.MustParse(expected), sumAccrual(items), registeredAt)
+	}
+
+	assert.Equal(t, GoodRewardStateUpcoming, rules[1].State(weekendStart.Add(-time.Second)))
+	assert.Equal(t, GoodRewardStateActive, rules[1].State(weekendStart))
+	assert.Equal(t, GoodRewardStateExpired, rules[1].State(weekendEnd))
+}
+
+func TestCalculateAccrualBreakdown(t *testing.T) {
+	goods := []Good{
+		{Description: "Bork kettle", Price: money.MustParse("100")},
+		{Description: "LG fridge", Price: money.MustParse("1000")},
+	}
+
+	items := calculateAccrual(goods, getRules(
+		t,
+		GoodReward{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent},
+		GoodReward{Match: "e", Reward: money.MustParse("1"), RewardType: RewardTypePT, MaxPerOrder: money.MustParse("1")},
+	), time.Now())
+
+	assert.Equal(t, []BreakdownItem{
+		{
+			Position:    0,
+			Description: "Bork kettle",
+			Price:       money.MustParse("100"),
+			Match:       "Bork",
+			RuleVersion: 1,
+			RewardType:  RewardTypePercent,
+			Reward:      money.MustParse("10"),
+			Accrual:     money.MustParse("10"),
+		},
+		{
+			Position:    0,
+			Description: "Bork kettle",
+			Price:       money.MustParse("100"),
+			Match:       "e",
+			RuleVersion: 1,
+			RewardType:  RewardTypePT,
+			Reward:      money.MustParse("1"),
+			Accrual:     money.MustParse("1"),
+		},
+		{
+			Position:    1,
+			Description: "LG fridge",
+			Price:       money.MustParse("1000"),
+			Match:       "e",
+			RuleVersion: 1,
+			RewardType:  RewardTypePT,
+			Reward:      money.MustParse("1"),
+			Accrual:     0,
+		},
+	}, items)
+}
+
+func TestCheckGoodReward(t *testing.T) {
+	valid := GoodReward{Match: "Bork", Reward: money.MustParse("10"), RewardType: RewardTypePercent}
+	assert.NoError(t, checkGoodReward(normalizeGoodReward(valid)))
+
+	invalid := []func(goodReward *GoodReward){
+		func(goodReward *GoodReward) { goodReward.Match = "" },
+		func(goodReward *GoodReward) { goodReward.MatchType = "suffix" },
+		func(goodReward *GoodReward) { goodReward.MatchType, goodReward.Match = MatchTypeRegex, "Bork(" },
+		func(goodReward *GoodReward) { goodReward.Reward = -1 },
+		func(goodReward *GoodReward) { goodReward.RewardType = "?" },
+		func(goodReward *GoodReward) { goodReward.Resolution = "random" },
+		func(goodReward *GoodReward) { goodReward.MaxPerItem = -1 },
+		func(goodReward *GoodReward) { goodReward.MinBasketPrice = -1 },
+		func(goodReward *GoodReward) {
+			now := time.Now()
+			goodReward.ValidFrom, goodReward.ValidUntil = &now, &now
+		},
+	}
+
+	for _, change := range invalid {
+		goodReward := valid
+		change(&goodReward)
+
+		assert.ErrorIs(t, checkGoodReward(normalizeGoodReward(goodReward)), ErrInvalidGoodReward)
+	}
+}
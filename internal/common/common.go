@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -17,13 +18,57 @@ const (
 type ContextKey uint
 
 const (
-	UserIDContextKey ContextKey = 1
+	UserIDContextKey       ContextKey = 1
+	SessionTokenContextKey ContextKey = 2
 )
 
 func GetContextUserID(r *http.Request) string {
 	return r.Context().Value(UserIDContextKey).(string)
 }
 
+func GetContextSessionToken(r *http.Request) string {
+	return r.Context().Value(SessionTokenContextKey).(string)
+}
+
+type Page struct {
+	Offset uint64
+	Limit  uint64
+}
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 100
+)
+
+var ErrInvalidPage = errors.New("invalid limit/offset query parameters")
+
+// GetPage reads ?limit=&offset= query parameters.
+func GetPage(r *http.Request) (Page, error) {
+	page := Page{Limit: DefaultPageLimit}
+
+	query := r.URL.Query()
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.ParseUint(limitStr, 10, 64)
+		if err != nil || limit == 0 || limit > MaxPageLimit {
+			return page, ErrInvalidPage
+		}
+
+		page.Limit = limit
+	}
+
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		offset, err := strconv.ParseUint(offsetStr, 10, 64)
+		if err != nil {
+			return page, ErrInvalidPage
+		}
+
+		page.Offset = offset
+	}
+
+	return page, nil
+}
+
 func CheckOrderIDFormat(orderID string) bool {
 	number, err := strconv.ParseUint(orderID, 10, 64)
 	if err != nil {
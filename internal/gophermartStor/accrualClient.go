@@ -0,0 +1,157 @@
+package gophermartstor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	accrualClient "github.com/GermanVor/go-tpl/pkg/accrualClient"
+)
+
+type AccrualResultKind uint
+
+const (
+	// 200, Order is set
+	AccrualResultOrder AccrualResultKind = iota
+	// 204, the accrual system does not know the order
+	AccrualResultUnknown
+	// 429, RetryAfter is set
+	AccrualResultThrottled
+	// 5xx and other unexpected statuses
+	AccrualResultServerError
+	// 401 and 403, the API key is wrong, revoked or has no orders:read scope
+	AccrualResultUnauthorized
+)
+
+type AccrualResult struct {
+	Kind       AccrualResultKind
+	StatusCode int
+	Order      *accrualStor.Order
+	RetryAfter time.Duration
+}
+
+// AccrualClient requests orders from the accrual system. When the system
+// throttles, the client pauses every caller until Retry-After passes.
+type AccrualClient struct {
+	client *accrualClient.Client
+
+	mux         sync.RWMutex
+	pausedUntil time.Time
+}
+
+// NewAccrualClient creates a client which authenticates with apiKey, the
+// key needs only the orders:read scope. Empty apiKey means no key.
+func NewAccrualClient(address string, apiKey string) (*AccrualClient, error) {
+	client := accrualClient.NewClient(address, &http.Client{Timeout: 10 * time.Second})
+
+	if apiKey != "" {
+		err := client.SetAPIKey(apiKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &AccrualClient{
+		client: client,
+	}, nil
+}
+
+// PausedFor returns how long the client is going to wait before the next request.
+func (client *AccrualClient) PausedFor() time.Duration {
+	client.mux.RLock()
+	defer client.mux.RUnlock()
+
+	if pause := time.Until(client.pausedUntil); pause > 0 {
+		return pause
+	}
+
+	return 0
+}
+
+func (client *AccrualClient) pause(delay time.Duration) {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+
+	if pausedUntil := time.Now().Add(delay); pausedUntil.After(client.pausedUntil) {
+		client.pausedUntil = pausedUntil
+	}
+}
+
+func (client *AccrualClient) wait(ctx context.Context) error {
+	pause := client.PausedFor()
+	if pause == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (client *AccrualClient) GetOrder(ctx context.Context, orderID string) (*AccrualResult, error) {
+	err := client.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.client.GetOrder(ctx, orderID)
+
+	result := &AccrualResult{StatusCode: http.StatusOK, Order: order}
+
+	var throttledErr *accrualClient.ThrottledError
+	var statusErr *accrualClient.StatusError
+
+	switch {
+	case err == nil:
+		result.Kind = AccrualResultOrder
+	case errors.Is(err, accrualClient.ErrUnknownOrderID):
+		result.Kind = AccrualResultUnknown
+		result.StatusCode = http.StatusNoContent
+	case errors.As(err, &throttledErr):
+		client.pause(throttledErr.RetryAfter)
+
+		result.Kind = AccrualResultThrottled
+		result.StatusCode = http.StatusTooManyRequests
+		result.RetryAfter = throttledErr.RetryAfter
+	case errors.As(err, &statusErr):
+		result.Kind = AccrualResultServerError
+		result.StatusCode = statusErr.StatusCode
+
+		if statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden {
+			result.Kind = AccrualResultUnauthorized
+		}
+	default:
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetOrderBreakdown returns the items of the processed order's accrual.
+func (client *AccrualClient) GetOrderBreakdown(ctx context.Context, orderID string) ([]accrualStor.BreakdownItem, error) {
+	err := client.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown, err := client.client.GetOrderBreakdown(ctx, orderID)
+	if err != nil {
+		var throttledErr *accrualClient.ThrottledError
+		if errors.As(err, &throttledErr) {
+			client.pause(throttledErr.RetryAfter)
+		}
+
+		return nil, err
+	}
+
+	return breakdown.Items, nil
+}
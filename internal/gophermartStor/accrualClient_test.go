@@ -0,0 +1,169 @@
+package gophermartstor_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	orderID      = "70757088342"
+	pollerAPIKey = "poller.secret"
+)
+
+func initAccrualServerMock(handler http.HandlerFunc) (*gophermartStor.AccrualClient, func()) {
+	authorized := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(accrualStor.APIKeyHeader) != pollerAPIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+
+	r := chi.NewRouter()
+	r.Get("/api/orders/{orderID}", authorized)
+	r.Get("/api/orders/{orderID}/breakdown", authorized)
+
+	ts := httptest.NewServer(r)
+
+	client, err := gophermartStor.NewAccrualClient(ts.URL, pollerAPIKey)
+	if err != nil {
+		panic(err)
+	}
+
+	return client, ts.Close
+}
+
+func TestNewAccrualClientInvalidAPIKey(t *testing.T) {
+	_, err := gophermartStor.NewAccrualClient("http://localhost", "secret")
+	assert.ErrorIs(t, err, accrualStor.ErrInvalidAPIKey)
+}
+
+func TestAccrualClientOrder(t *testing.T) {
+	client, destructor := initAccrualServerMock(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(accrualStor.Order{
+			Order:   chi.URLParam(r, "orderID"),
+			Status:  accrualStor.OrderStatusProcessed,
+			Accrual: money.MustParse("500"),
+		})
+	})
+	defer destructor()
+
+	result, err := client.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+
+	assert.Equal(t, gophermartStor.AccrualResultOrder, result.Kind)
+	assert.Equal(t, orderID, result.Order.Order)
+	assert.Equal(t, money.MustParse("500"), result.Order.Accrual)
+}
+
+func TestAccrualClientOrderBreakdown(t *testing.T) {
+	items := []accrualStor.BreakdownItem{{
+		Description: "Bork kettle",
+		Price:       money.MustParse("5000"),
+		Match:       "Bork",
+		RuleVersion: 2,
+		RewardType:  accrualStor.RewardTypePercent,
+		Reward:      money.MustParse("10"),
+		Accrual:     money.MustParse("500"),
+	}}
+
+	client, destructor := initAccrualServerMock(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(accrualStor.Breakdown{
+			Order:   chi.URLParam(r, "orderID"),
+			Status:  accrualStor.OrderStatusProcessed,
+			Accrual: money.MustParse("500"),
+			Items:   items,
+		})
+	})
+	defer destructor()
+
+	breakdown, err := client.GetOrderBreakdown(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, items, breakdown)
+}
+
+func TestAccrualClientUnknownAndServerError(t *testing.T) {
+	status := http.StatusNoContent
+
+	client, destructor := initAccrualServerMock(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	defer destructor()
+
+	result, err := client.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, gophermartStor.AccrualResultUnknown, result.Kind)
+
+	status = http.StatusInternalServerError
+
+	result, err = client.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, gophermartStor.AccrualResultServerError, result.Kind)
+	assert.Equal(t, http.StatusInternalServerError, result.StatusCode)
+}
+
+func TestAccrualClientUnauthorized(t *testing.T) {
+	client, destructor := initAccrualServerMock(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer destructor()
+
+	result, err := client.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+	assert.Equal(t, gophermartStor.AccrualResultUnauthorized, result.Kind)
+	assert.Equal(t, http.StatusForbidden, result.StatusCode)
+}
+
+func TestAccrualClientThrottled(t *testing.T) {
+	requests := 0
+
+	client, destructor := initAccrualServerMock(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer destructor()
+
+	result, err := client.GetOrder(context.Background(), orderID)
+	require.NoError(t, err)
+
+	assert.Equal(t, gophermartStor.AccrualResultThrottled, result.Kind)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Greater(t, client.PausedFor(), time.Duration(0))
+
+	t.Run("Paused client respects context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := client.GetOrder(ctx, orderID)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, requests)
+	})
+
+	t.Run("Paused client waits for Retry-After", func(t *testing.T) {
+		start := time.Now()
+
+		result, err := client.GetOrder(context.Background(), orderID)
+		require.NoError(t, err)
+
+		assert.Equal(t, gophermartStor.AccrualResultUnknown, result.Kind)
+		assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	})
+}
@@ -0,0 +1,196 @@
+package gophermartstor
+
+import (
+	"context"
+	"errors"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+// Admin is the part of the storage behind /api/admin. Every change is
+// recorded in the audit log with the ID of the admin who made it.
+type Admin interface {
+	// RepollOrder puts the order back into the polling queue, as if it was
+	// just uploaded. An accrual is never credited twice.
+	RepollOrder(adminID string, orderID string) error
+	// AdjustBalance adds amount, negative to take points away, to the
+	// current balance of the user.
+	AdjustBalance(adminID string, userID string, amount money.Money, reason string) error
+	AuditForEach(page common.Page, handler AuditForEachHandler) error
+}
+
+type AuditAction string
+
+const (
+	AuditActionRepoll            AuditAction = "repoll"
+	AuditActionBalanceAdjustment AuditAction = "balance_adjustment"
+)
+
+type AuditEntry struct {
+	ID        int64       `json:"id"`
+	AdminID   string      `json:"admin_id"`
+	Action    AuditAction `json:"action"`
+	UserID    string      `json:"user_id,omitempty"`
+	Order     string      `json:"order,omitempty"`
+	Amount    money.Money `json:"amount,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+	CreatedAt string      `json:"created_at"`
+}
+type AuditForEachHandler func(entry *AuditEntry) error
+
+var (
+	ErrUnknownOrder      = errors.New("unknown order")
+	ErrInvalidAdjustment = errors.New("balance adjustment needs a non-zero amount and a reason")
+)
+
+// the other side of manual balance adjustments in the ledger
+const adjustmentAccount = "@adjustment"
+
+const LedgerEntryKindAdjustment LedgerEntryKind = "adjustment"
+
+const (
+	// INSERT INTO pollingJobs (orderID, userID) SELECT orderID, userID FROM ordersPool
+	// WHERE orderID=$1 AND userID<>'@deleted' ON CONFLICT (orderID) DO UPDATE SET
+	// accrualStatus=DEFAULT, attempts=0, next_attempt_at=NOW() RETURNING userID
+	repollOrderSQL = "INSERT INTO pollingJobs (orderID, userID) " +
+		"SELECT orderID, userID FROM ordersPool WHERE orderID=$1 AND userID<>'" + deletedUserAccount + "' " +
+		"ON CONFLICT (orderID) DO UPDATE SET accrualStatus=DEFAULT, attempts=0, next_attempt_at=NOW() " +
+		"RETURNING userID"
+
+	// UPDATE balances SET current=current+$2 WHERE userID=$1 AND current+$2>=0
+	adjustBalanceSQL = "UPDATE balances SET current=current+$2 WHERE userID=$1 AND current+$2>=0"
+
+	// INSERT INTO adminAudit (adminID, action, userID, orderID, amount, reason) VALUES ($1, $2, $3, $4, $5, $6)
+	insertAuditEntrySQL = "INSERT INTO adminAudit (adminID, action, userID, orderID, amount, reason) " +
+		"VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, NULLIF($6, ''))"
+
+	// SELECT auditID, adminID, action, userID, orderID, amount, reason, created_at FROM adminAudit
+	// ORDER BY auditID DESC LIMIT $1 OFFSET $2
+	selectAuditSQL = "SELECT auditID, adminID, action, COALESCE(userID, ''), COALESCE(orderID, ''), " +
+		"COALESCE(amount, 0), COALESCE(reason, ''), " +
+		"TO_CHAR(created_at AT TIME ZONE 'UTC', " + rfc3339SQL + ") FROM adminAudit " +
+		"ORDER BY auditID DESC LIMIT $1 OFFSET $2"
+)
+
+func getAdjustmentTransactionID() string {
+	return "adjustment:" + uuid.New().String()
+}
+
+func addAuditEntry(tx pgx.Tx, entry *AuditEntry) error {
+	_, err := tx.Exec(
+		context.TODO(),
+		insertAuditEntrySQL,
+		entry.AdminID,
+		entry.Action,
+		entry.UserID,
+		entry.Order,
+		entry.Amount,
+		entry.Reason,
+	)
+
+	return err
+}
+
+func (stor *storageObject) RepollOrder(adminID string, orderID string) error {
+	return stor.dbPool.BeginFunc(context.TODO(), func(tx pgx.Tx) error {
+		userID := ""
+		err := tx.QueryRow(context.TODO(), repollOrderSQL, orderID).Scan(&userID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrUnknownOrder
+			}
+
+			return err
+		}
+
+		return addAuditEntry(tx, &AuditEntry{
+			AdminID: adminID,
+			Action:  AuditActionRepoll,
+			UserID:  userID,
+			Order:   orderID,
+		})
+	})
+}
+
+func (stor *storageObject) AdjustBalance(adminID string, userID string, amount money.Money, reason string) error {
+	if amount == 0 || reason == "" {
+		return ErrInvalidAdjustment
+	}
+
+	return stor.dbPool.BeginFunc(context.TODO(), func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.TODO(), adjustBalanceSQL, userID, amount)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			balance := &Balance{}
+			err = tx.QueryRow(context.TODO(), selectBalanceSQL, userID).Scan(&balance.Current, &balance.Withdrawn)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrUnknownBalance
+			}
+			if err != nil {
+				return err
+			}
+
+			return ErrNotEnoughFunds
+		}
+
+		_, err = addLedgerTransaction(
+			tx,
+			getAdjustmentTransactionID(),
+			adjustmentAccount,
+			userID,
+			"",
+			LedgerEntryKindAdjustment,
+			amount,
+		)
+		if err != nil {
+			return err
+		}
+
+		return addAuditEntry(tx, &AuditEntry{
+			AdminID: adminID,
+			Action:  AuditActionBalanceAdjustment,
+			UserID:  userID,
+			Amount:  amount,
+			Reason:  reason,
+		})
+	})
+}
+
+func (stor *storageObject) AuditForEach(page common.Page, handler AuditForEachHandler) error {
+	rows, err := stor.dbPool.Query(context.TODO(), selectAuditSQL, page.Limit, page.Offset)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := &AuditEntry{}
+
+		err := rows.Scan(
+			&entry.ID,
+			&entry.AdminID,
+			&entry.Action,
+			&entry.UserID,
+			&entry.Order,
+			&entry.Amount,
+			&entry.Reason,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = handler(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
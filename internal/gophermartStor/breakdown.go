@@ -0,0 +1,79 @@
+package gophermartstor
+
+import (
+	"context"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// INSERT INTO orderBreakdown (orderID, position, description, price, match,
+	// rule_version, reward_type, reward, accrual) VALUES ($1, ..., $9) ON CONFLICT DO NOTHING
+	insertBreakdownItemSQL = "INSERT INTO orderBreakdown (orderID, position, description, price, match, " +
+		"rule_version, reward_type, reward, accrual) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) " +
+		"ON CONFLICT DO NOTHING"
+
+	// SELECT b.orderID, b.position, ..., b.accrual FROM orderBreakdown b
+	// JOIN ordersPool o ON o.orderID=b.orderID WHERE o.userID=$1 ORDER BY b.orderID, b.position, b.match
+	selectUserBreakdownsSQL = "SELECT b.orderID, b.position, b.description, b.price, b.match, " +
+		"b.rule_version, b.reward_type, b.reward, b.accrual FROM orderBreakdown b " +
+		"JOIN ordersPool o ON o.orderID=b.orderID WHERE o.userID=$1 ORDER BY b.orderID, b.position, b.match"
+)
+
+func insertBreakdown(tx pgx.Tx, orderID string, items []accrualStor.BreakdownItem) error {
+	for _, item := range items {
+		_, err := tx.Exec(
+			context.TODO(),
+			insertBreakdownItemSQL,
+			orderID,
+			item.Position,
+			item.Description,
+			item.Price,
+			item.Match,
+			item.RuleVersion,
+			item.RewardType,
+			item.Reward,
+			item.Accrual,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// userBreakdowns returns breakdowns of the user orders by order ID.
+func (stor *storageObject) userBreakdowns(userID string) (map[string][]accrualStor.BreakdownItem, error) {
+	rows, err := stor.dbPool.Query(context.TODO(), selectUserBreakdownsSQL, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breakdowns := make(map[string][]accrualStor.BreakdownItem)
+	for rows.Next() {
+		orderID := ""
+		item := accrualStor.BreakdownItem{}
+
+		err := rows.Scan(
+			&orderID,
+			&item.Position,
+			&item.Description,
+			&item.Price,
+			&item.Match,
+			&item.RuleVersion,
+			&item.RewardType,
+			&item.Reward,
+			&item.Accrual,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		breakdowns[orderID] = append(breakdowns[orderID], item)
+	}
+
+	return breakdowns, rows.Err()
+}
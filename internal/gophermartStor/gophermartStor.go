@@ -2,16 +2,13 @@ package gophermartstor
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"io"
 	"log"
-	"math"
-	"net/http"
-	"time"
 
 	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
 	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
@@ -36,15 +33,17 @@ const (
 type OrdersForEachObject struct {
 	Number     string      `json:"number"`
 	Status     OrderStatus `json:"status"`
-	Accrual    float64     `json:"accrual,omitempty"`
+	Accrual    money.Money `json:"accrual,omitempty"`
 	UploadedAt string      `json:"uploaded_at"`
+	// which goods and rules the accrual is for, only processed orders have it
+	Breakdown []accrualStor.BreakdownItem `json:"breakdown,omitempty"`
 }
 type OrdersForEachHandler func(order *OrdersForEachObject) error
 
 type WithdrawalObject struct {
-	Order       string  `json:"order"`
-	Sum         float64 `json:"sum"`
-	ProcessedAt string  `json:"processed_at"`
+	Order       string      `json:"order"`
+	Sum         money.Money `json:"sum"`
+	ProcessedAt string      `json:"processed_at"`
 }
 type WithdrawalsForEachHandler func(withdrawal *WithdrawalObject) error
 
@@ -52,16 +51,31 @@ type Interface interface {
 	InitOrder(userID string, orderID string) (SetOrderStatus, error)
 	OrdersForEach(userID string, handler OrdersForEachHandler) error
 	GetBalance(userID string) (*Balance, error)
-	MakeWithdrawBalance(userID string, orderID string, sum float64) error
+	MakeWithdrawBalance(userID string, orderID string, sum money.Money) error
 	WithdrawalsForEach(userID string, handler WithdrawalsForEachHandler) error
+	LedgerForEach(userID string, page common.Page, handler LedgerForEachHandler) error
+	GetUserStats(userID string) (*UserStats, error)
+
+	Admin
+}
+
+type UserStats struct {
+	OrdersCount      int `json:"orders_count"`
+	WithdrawalsCount int `json:"withdrawals_count"`
+}
+
+// UserData is the part of the storage which userStor manages along with
+// users. Storages that are not backed by Postgres implement it instead of
+// the package level CreateBalance and DeleteUserData.
+type UserData interface {
+	CreateBalance(userID string) error
+	DeleteUserData(userID string) error
 }
 
 type storageObject struct {
 	Interface
 
 	dbPool *pgxpool.Pool
-
-	accrualAddress string
 }
 
 var (
@@ -69,7 +83,9 @@ var (
 	ErrInvalidOrderFormat   = errors.New("invalid order format")
 
 	ErrNotEnoughFunds       = errors.New("there are not enough funds in the account")
+	ErrInvalidWithdrawSum   = errors.New("withdraw sum is not positive")
 	ErrInvalidOrderIDFormat = errors.New("invalid order id format")
+	ErrUnknownBalance       = errors.New("unknown user balance")
 )
 
 const (
@@ -82,13 +98,23 @@ const (
 	// UPDATE ordersPool SET (status, accrual) = ($2, $3, $4) WHERE orderID=$1
 	setOrderSQL = "UPDATE ordersPool SET (status, accrual) = ($2, $3) WHERE orderID=$1"
 
+	// UPDATE ordersPool SET (status, accrual) = ($2, $3) WHERE orderID=$1 AND status<>'PROCESSED'
+	//
+	// a repoll does not downgrade a credited order
+	setPendingOrderSQL = setOrderSQL + " AND status<>'" + string(OrderStatusProcessed) + "'"
+
+	// UPDATE ordersPool SET status=$2 WHERE orderID=$1
+	setOrderStatusSQL = "UPDATE ordersPool SET status=$2 WHERE orderID=$1"
+
 	// SELECT orderID, status, TO_CHAR(uploaded_at, 'YYYY-MM-DD HH:MI:SS.MSOF'), accrual
 	// FROM ordersPool WHERE userID=$1 ORDER BY uploaded_at
 	selectOrderSQL = "SELECT orderID, status, TO_CHAR(uploaded_at, 'YYYY-MM-DD\"T\"HH:MI:SS\"Z\"TZ'), accrual " +
 		"FROM ordersPool WHERE userID=$1 ORDER BY uploaded_at"
 
-	// UPDATE balances SET current=current-$2 WHERE current-$2>=0 AND userID=$1
-	spendBalanceSQL = "UPDATE balances SET current=current-$2, withdrawn=$2 WHERE current-$2>=0 AND userID=$1"
+	// UPDATE balances SET current=current-$2::DECIMAL, withdrawn=withdrawn+$2::DECIMAL
+	// WHERE current-$2::DECIMAL>=0 AND userID=$1
+	spendBalanceSQL = "UPDATE balances SET current=current-$2::DECIMAL, withdrawn=withdrawn+$2::DECIMAL " +
+		"WHERE current-$2::DECIMAL>=0 AND userID=$1"
 
 	// UPDATE balances SET current=current+$2 WHERE userID=$1
 	increaseBalanceSQL = "UPDATE balances SET current=current+$2 WHERE userID=$1"
@@ -101,135 +127,83 @@ const (
 	selectWithdrawalSQL = "SELECT orderID, sum, TO_CHAR(processed_at, 'YYYY-MM-DD\"T\"HH:MI:SS\"Z\"TZ') FROM orderHistory " +
 		"WHERE userID=$1 ORDER BY processed_at"
 
-	// SELECT userId, orderID FROM ordersPool
-	// WHERE status!=string(OrderStatusProcessed) AND status!=string(OrderStatusInvalid)
-	selectProcessedOrderSQL = "SELECT userId, orderID FROM ordersPool " +
-		"WHERE status!='" + string(OrderStatusProcessed) + "' AND status!='" + string(OrderStatusInvalid) + "'"
+	// SELECT (SELECT COUNT(*) FROM ordersPool WHERE userID=$1),
+	// (SELECT COUNT(*) FROM orderHistory WHERE userID=$1)
+	selectUserStatsSQL = "SELECT (SELECT COUNT(*) FROM ordersPool WHERE userID=$1), " +
+		"(SELECT COUNT(*) FROM orderHistory WHERE userID=$1)"
 
 	// INSERT INTO orderHistory (userID, orderID, sum, processed_at) VALUES ($1, $2, $3, $4)
 	addWithdrawalSQL = "INSERT INTO orderHistory (userID, orderID, sum) VALUES ($1, $2, $3)"
 
 	// INSERT INTO balances (userID, current, withdrawn) VALUES ($1, 0, 0)
 	CreateBalanceSQL = "INSERT INTO balances (userID, current, withdrawn) VALUES ($1, 0, 0)"
-)
-
-func CreateOrdersPoolTable(tx pgx.Tx) error {
-	sql := "CREATE TABLE IF NOT EXISTS ordersPool (" +
-		"userID TEXT, " +
-		"orderID TEXT UNIQUE, " +
-		"status TEXT, " +
-		"accrual DECIMAL DEFAULT 0, " +
-		"uploaded_at TIMESTAMP DEFAULT NOW()" +
-		")"
 
-	_, err := tx.Exec(context.TODO(), sql)
-	return err
-}
-
-func CreateBalancesTable(tx pgx.Tx) error {
-	sql := "CREATE TABLE IF NOT EXISTS balances (" +
-		"userID TEXT UNIQUE, " +
-		"current DECIMAL DEFAULT 0, " +
-		"withdrawn DECIMAL DEFAULT 0" +
-		")"
-
-	_, err := tx.Exec(context.TODO(), sql)
-	return err
-}
+	// DELETE FROM balances WHERE userID=$1
+	deleteBalanceSQL = "DELETE FROM balances WHERE userID=$1"
 
-func CreateOrderHistoryTable(tx pgx.Tx) error {
-	sql := "CREATE TABLE IF NOT EXISTS orderHistory (" +
-		"userID TEXT UNIQUE, " +
-		"orderID TEXT, " +
-		"sum DECIMAL, " +
-		"processed_at TIMESTAMP DEFAULT NOW()" +
-		")"
+	// DELETE FROM pollingJobs WHERE userID=$1
+	deleteUserPollingJobsSQL = "DELETE FROM pollingJobs WHERE userID=$1"
 
-	_, err := tx.Exec(context.TODO(), sql)
-	return err
-}
+	// UPDATE ordersPool SET userID='@deleted' WHERE userID=$1
+	anonymizeOrdersSQL = "UPDATE ordersPool SET userID='" + deletedUserAccount + "' WHERE userID=$1"
 
-func Init(databaseURI string, accrualAddress string) Interface {
-	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
+	// UPDATE orderHistory SET userID='@deleted' WHERE userID=$1
+	anonymizeWithdrawalsSQL = "UPDATE orderHistory SET userID='" + deletedUserAccount + "' WHERE userID=$1"
 
-	log.Printf("Connected to DB %s successfully, gophermartStor\n", databaseURI)
+	// UPDATE ledger SET account='@deleted' WHERE account=$1
+	anonymizeLedgerSQL = "UPDATE ledger SET account='" + deletedUserAccount + "' WHERE account=$1"
+)
 
-	tx, err := conn.Begin(context.TODO())
+func Init(databaseURI string, accrualAddress string, accrualAPIKey string, pollingWorkersCount uint) Interface {
+	client, err := NewAccrualClient(accrualAddress, accrualAPIKey)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-	defer tx.Rollback(context.TODO())
-
-	{
-
-		err = CreateOrdersPoolTable(tx)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-
-		err = CreateBalancesTable(tx)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-
-		err = CreateOrderHistoryTable(tx)
-		if err != nil {
-			log.Fatalln(err.Error())
-		}
-	}
 
-	err = tx.Commit(context.TODO())
+	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 
-	log.Println("Created Tables (ordersPool, orderHistory, balances) successfully")
+	log.Printf("Connected to DB %s successfully, gophermartStor\n", databaseURI)
 
 	stor := &storageObject{
-		dbPool:         conn,
-		accrualAddress: accrualAddress,
+		dbPool: conn,
 	}
 
-	go RecoverPollingProcesses(stor)
+	startPollingWorkers(
+		context.Background(),
+		pollingWorkersCount,
+		stor,
+		client,
+		stor.setOrder,
+	)
 
 	return stor
 }
 
-func RecoverPollingProcesses(stor *storageObject) {
-	rows, err := stor.dbPool.Query(context.TODO(), selectProcessedOrderSQL)
-	if err != nil {
-		log.Fatalln(err.Error())
+func getOrderStatus(status accrualStor.OrderStatus) OrderStatus {
+	switch status {
+	case accrualStor.OrderStatusProcessing:
+		return OrderStatusProcessing
+	case accrualStor.OrderStatusProcessed:
+		return OrderStatusProcessed
 	}
 
-	userID := ""
-	orderID := ""
-
-	for rows.Next() {
-		err := rows.Scan(&userID, &orderID)
-		if err == nil {
-			stor.startPolling(userID, orderID)
-		}
-	}
+	return OrderStatusInvalid
 }
 
-func (stor *storageObject) setOrder(userID string, order accrualStor.Order) error {
-	order.Accrual = math.Ceil(order.Accrual*100) / 100
-
-	status := OrderStatusInvalid
-	switch order.Status {
-	case accrualStor.OrderStatusProcessing:
-		status = OrderStatusProcessing
-	case accrualStor.OrderStatusProcessed:
-		status = OrderStatusProcessed
-	}
+func (stor *storageObject) setOrder(
+	userID string,
+	order accrualStor.Order,
+	breakdown []accrualStor.BreakdownItem,
+) error {
+	status := getOrderStatus(order.Status)
 
 	if order.Status != accrualStor.OrderStatusProcessed {
 		_, err := stor.dbPool.Exec(
 			context.TODO(),
-			setOrderSQL,
+			setPendingOrderSQL,
 			order.Order,
 			status,
 			order.Accrual,
@@ -244,113 +218,51 @@ func (stor *storageObject) setOrder(userID string, order accrualStor.Order) erro
 	}
 	defer tx.Rollback(context.TODO())
 
-	_, err = tx.Exec(
-		context.TODO(),
-		setOrderSQL,
-		order.Order,
-		status,
-		order.Accrual,
-	)
-
-	if err != nil {
-		return err
-	}
-
-	_, err = stor.dbPool.Exec(
-		context.TODO(),
-		increaseBalanceSQL,
+	isNew, err := addLedgerTransaction(
+		tx,
+		getAccrualTransactionID(order.Order),
+		accrualAccount,
 		userID,
+		order.Order,
+		LedgerEntryKindAccrual,
 		order.Accrual,
 	)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit(context.TODO())
-}
-
-func pollFunc(url string) (*accrualStor.Order, error) {
-	req, err := http.NewRequest(
-		http.MethodGet,
-		url,
-		nil,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusTooManyRequests {
-			time.Sleep(10 * time.Second)
+	if isNew {
+		_, err = tx.Exec(
+			context.TODO(),
+			setOrderSQL,
+			order.Order,
+			status,
+			order.Accrual,
+		)
+		if err != nil {
+			return err
 		}
-		return nil, nil
-	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+		_, err = tx.Exec(
+			context.TODO(),
+			increaseBalanceSQL,
+			userID,
+			order.Accrual,
+		)
+	} else {
+		// a repolled order keeps the accrual it was credited with
+		_, err = tx.Exec(context.TODO(), setOrderStatusSQL, order.Order, status)
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	order := accrualStor.Order{}
-	err = json.Unmarshal(bodyBytes, &order)
+	err = insertBreakdown(tx, order.Order, breakdown)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &order, nil
-}
-
-func (stor *storageObject) startPolling(userID string, orderID string) {
-	ticker := time.NewTicker(time.Second)
-
-	go func() {
-		defer func() {
-			ticker.Stop()
-		}()
-
-		prevAccrualOrderStatus := accrualStor.OrderStatusRegistered
-
-		for {
-			<-ticker.C
-			order, err := pollFunc(stor.accrualAddress + "/api/orders/" + orderID)
-			if err != nil {
-				log.Println("polling error", userID, err)
-				continue
-			}
-
-			if order == nil {
-				continue
-			}
-
-			if order.Order != orderID {
-				continue
-			}
-
-			if prevAccrualOrderStatus == order.Status {
-				continue
-			}
-
-			err = stor.setOrder(userID, *order)
-			if err != nil {
-				log.Println("polling error", userID, order, err)
-				continue
-			}
-
-			prevAccrualOrderStatus = order.Status
-
-			if order.Status == accrualStor.OrderStatusInvalid ||
-				order.Status == accrualStor.OrderStatusProcessed {
-				break
-			}
-		}
-	}()
+	return tx.Commit(context.TODO())
 }
 
 func (stor *storageObject) InitOrder(userID string, orderID string) (SetOrderStatus, error) {
@@ -358,13 +270,22 @@ func (stor *storageObject) InitOrder(userID string, orderID string) (SetOrderSta
 		return SetOrderStatusErr, ErrInvalidOrderIDFormat
 	}
 
-	_, err := stor.dbPool.Exec(
+	tx, err := stor.dbPool.Begin(context.TODO())
+	if err != nil {
+		return SetOrderStatusErr, err
+	}
+	defer tx.Rollback(context.TODO())
+
+	_, err = tx.Exec(
 		context.TODO(),
 		initOrderSQL,
 		userID,
 		orderID,
 		OrderStatusNew,
 	)
+	if err == nil {
+		_, err = tx.Exec(context.TODO(), insertPollingJobSQL, orderID, userID)
+	}
 	if err != nil {
 		if common.IsAlreadyCreatedRowErr(err) {
 			tableUserID := ""
@@ -386,11 +307,20 @@ func (stor *storageObject) InitOrder(userID string, orderID string) (SetOrderSta
 		return SetOrderStatusErr, err
 	}
 
-	stor.startPolling(userID, orderID)
+	err = tx.Commit(context.TODO())
+	if err != nil {
+		return SetOrderStatusErr, err
+	}
+
 	return SetOrderStatusAccepted, nil
 }
 
 func (stor *storageObject) OrdersForEach(userID string, handler OrdersForEachHandler) error {
+	breakdowns, err := stor.userBreakdowns(userID)
+	if err != nil {
+		return err
+	}
+
 	rows, err := stor.dbPool.Query(context.TODO(), selectOrderSQL, userID)
 	if err != nil {
 		return err
@@ -399,7 +329,7 @@ func (stor *storageObject) OrdersForEach(userID string, handler OrdersForEachHan
 	for rows.Next() {
 		order := &OrdersForEachObject{}
 
-		accrual := float64(0)
+		accrual := money.Money(0)
 		err := rows.Scan(&order.Number, &order.Status, &order.UploadedAt, &accrual)
 		if err != nil {
 			return err
@@ -409,6 +339,8 @@ func (stor *storageObject) OrdersForEach(userID string, handler OrdersForEachHan
 			order.Accrual = accrual
 		}
 
+		order.Breakdown = breakdowns[order.Number]
+
 		handler(order)
 	}
 
@@ -416,8 +348,8 @@ func (stor *storageObject) OrdersForEach(userID string, handler OrdersForEachHan
 }
 
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   money.Money `json:"current"`
+	Withdrawn money.Money `json:"withdrawn"`
 }
 
 func (stor *storageObject) GetBalance(userID string) (*Balance, error) {
@@ -426,17 +358,37 @@ func (stor *storageObject) GetBalance(userID string) (*Balance, error) {
 	err := stor.dbPool.QueryRow(context.TODO(), selectBalanceSQL, userID).
 		Scan(&balance.Current, &balance.Withdrawn)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownBalance
+		}
+
 		return nil, err
 	}
 
 	return balance, nil
 }
 
-func (stor *storageObject) MakeWithdrawBalance(userID string, orderID string, sum float64) error {
+func (stor *storageObject) GetUserStats(userID string) (*UserStats, error) {
+	stats := &UserStats{}
+
+	err := stor.dbPool.QueryRow(context.TODO(), selectUserStatsSQL, userID).
+		Scan(&stats.OrdersCount, &stats.WithdrawalsCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (stor *storageObject) MakeWithdrawBalance(userID string, orderID string, sum money.Money) error {
 	if !common.CheckOrderIDFormat(orderID) {
 		return ErrInvalidOrderIDFormat
 	}
 
+	if sum <= 0 {
+		return ErrInvalidWithdrawSum
+	}
+
 	tx, err := stor.dbPool.Begin(context.TODO())
 	if err != nil {
 		return err
@@ -464,6 +416,19 @@ func (stor *storageObject) MakeWithdrawBalance(userID string, orderID string, su
 		return err
 	}
 
+	_, err = addLedgerTransaction(
+		tx,
+		uuid.New().String(),
+		userID,
+		withdrawalAccount,
+		orderID,
+		LedgerEntryKindWithdrawal,
+		sum,
+	)
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit(context.TODO())
 }
 
@@ -492,3 +457,24 @@ func CreateBalance(tx pgx.Tx, userID string) error {
 	_, err := tx.Exec(context.TODO(), CreateBalanceSQL, userID)
 	return err
 }
+
+// DeleteUserData drops the balance cache and pending polls of the user.
+// Orders, withdrawals and ledger entries are needed for accounting, so they
+// are moved to the anonymous deletedUserAccount instead. Order numbers stay
+// taken, an accrual can not be credited twice.
+func DeleteUserData(tx pgx.Tx, userID string) error {
+	for _, sql := range []string{
+		deleteBalanceSQL,
+		deleteUserPollingJobsSQL,
+		anonymizeOrdersSQL,
+		anonymizeWithdrawalsSQL,
+		anonymizeLedgerSQL,
+	} {
+		_, err := tx.Exec(context.TODO(), sql, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package gophermartstor
+
+import (
+	"context"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/jackc/pgx/v4"
+)
+
+type LedgerEntryKind string
+
+const (
+	LedgerEntryKindAccrual    LedgerEntryKind = "accrual"
+	LedgerEntryKindWithdrawal LedgerEntryKind = "withdrawal"
+)
+
+// System accounts are the other side of user ledger entries.
+const (
+	accrualAccount    = "@accrual"
+	withdrawalAccount = "@withdrawal"
+	// entries of deleted users
+	deletedUserAccount = "@deleted"
+)
+
+type LedgerEntry struct {
+	ID        int64           `json:"id"`
+	Kind      LedgerEntryKind `json:"kind"`
+	Order     string          `json:"order,omitempty"`
+	Amount    money.Money     `json:"amount"`
+	CreatedAt string          `json:"created_at"`
+}
+type LedgerForEachHandler func(entry *LedgerEntry) error
+
+const (
+	// INSERT INTO ledger (transactionID, account, orderID, kind, amount) VALUES ($1, $2, $3, $4, $5)
+	// ON CONFLICT (transactionID, account) DO NOTHING
+	insertLedgerEntrySQL = "INSERT INTO ledger (transactionID, account, orderID, kind, amount) " +
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (transactionID, account) DO NOTHING"
+
+	// TO_CHAR format of UTC timestamps, RFC3339 like getTimeStr
+	rfc3339SQL = "'YYYY-MM-DD\"T\"HH24:MI:SS\"Z\"'"
+
+	// SELECT entryID, kind, orderID, amount, TO_CHAR(created_at AT TIME ZONE 'UTC', rfc3339SQL) FROM ledger
+	// WHERE account=$1 ORDER BY entryID DESC LIMIT $2 OFFSET $3
+	selectLedgerSQL = "SELECT entryID, kind, COALESCE(orderID, ''), amount, " +
+		"TO_CHAR(created_at AT TIME ZONE 'UTC', " + rfc3339SQL + ") FROM ledger " +
+		"WHERE account=$1 ORDER BY entryID DESC LIMIT $2 OFFSET $3"
+)
+
+func getAccrualTransactionID(orderID string) string {
+	// one accrual per order, so repeated polling results are not credited twice
+	return "accrual:" + orderID
+}
+
+// addLedgerTransaction moves amount from one account to another as two
+// ledger entries. It returns false if the transaction was already recorded.
+func addLedgerTransaction(
+	tx pgx.Tx,
+	transactionID string,
+	from string,
+	to string,
+	orderID string,
+	kind LedgerEntryKind,
+	amount money.Money,
+) (bool, error) {
+	tag, err := tx.Exec(context.TODO(), insertLedgerEntrySQL, transactionID, to, orderID, kind, amount)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(context.TODO(), insertLedgerEntrySQL, transactionID, from, orderID, kind, -amount)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (stor *storageObject) LedgerForEach(userID string, page common.Page, handler LedgerForEachHandler) error {
+	rows, err := stor.dbPool.Query(context.TODO(), selectLedgerSQL, userID, page.Limit, page.Offset)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := &LedgerEntry{}
+
+		err := rows.Scan(&entry.ID, &entry.Kind, &entry.Order, &entry.Amount, &entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = handler(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
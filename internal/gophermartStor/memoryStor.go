@@ -0,0 +1,512 @@
+package gophermartstor
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/google/uuid"
+)
+
+type memoryOrder struct {
+	userID string
+	order  OrdersForEachObject
+}
+
+// MemoryStorage keeps orders, balances and withdrawals in process memory.
+type MemoryStorage struct {
+	Interface
+
+	mux sync.RWMutex
+
+	orders      map[string]*memoryOrder
+	userOrders  map[string][]*memoryOrder
+	balances    map[string]*Balance
+	withdrawals map[string][]WithdrawalObject
+
+	// ledger entries by account
+	ledger         map[string][]LedgerEntry
+	transactionIDs map[string]struct{}
+	lastEntryID    int64
+
+	audit []AuditEntry
+
+	jobs *memoryPollingQueue
+}
+
+type memoryPollingJob struct {
+	job           pollingJob
+	nextAttemptAt time.Time
+}
+
+// memoryPollingQueue is the in-memory analogue of the pollingJobs table.
+type memoryPollingQueue struct {
+	mux  sync.Mutex
+	jobs map[string]*memoryPollingJob
+}
+
+func (queue *memoryPollingQueue) addJob(userID string, orderID string) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	queue.jobs[orderID] = &memoryPollingJob{
+		job: pollingJob{
+			OrderID:       orderID,
+			UserID:        userID,
+			AccrualStatus: accrualStor.OrderStatusRegistered,
+		},
+		nextAttemptAt: time.Now(),
+	}
+}
+
+func (queue *memoryPollingQueue) removeJob(orderID string) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	delete(queue.jobs, orderID)
+}
+
+func (queue *memoryPollingQueue) claimJob(ctx context.Context) (*pollingJob, error) {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	now := time.Now()
+
+	var due *memoryPollingJob
+	for _, memJob := range queue.jobs {
+		if !memJob.nextAttemptAt.After(now) && (due == nil || memJob.nextAttemptAt.Before(due.nextAttemptAt)) {
+			due = memJob
+		}
+	}
+
+	if due == nil {
+		return nil, nil
+	}
+
+	due.nextAttemptAt = now.Add(pollingLease)
+	due.job.Attempts++
+
+	job := due.job
+	return &job, nil
+}
+
+func (queue *memoryPollingQueue) finishJob(ctx context.Context, job *pollingJob) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	delete(queue.jobs, job.OrderID)
+	return nil
+}
+
+func (queue *memoryPollingQueue) rescheduleJob(ctx context.Context, job *pollingJob, delay time.Duration) error {
+	queue.mux.Lock()
+	defer queue.mux.Unlock()
+
+	if memJob, ok := queue.jobs[job.OrderID]; ok {
+		memJob.job = *job
+		memJob.nextAttemptAt = time.Now().Add(delay)
+	}
+
+	return nil
+}
+
+func InitMemory(accrualAddress string, accrualAPIKey string, pollingWorkersCount uint) *MemoryStorage {
+	client, err := NewAccrualClient(accrualAddress, accrualAPIKey)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	log.Println("Created in-memory gophermartStor")
+
+	stor := &MemoryStorage{
+		orders:         make(map[string]*memoryOrder),
+		userOrders:     make(map[string][]*memoryOrder),
+		balances:       make(map[string]*Balance),
+		withdrawals:    make(map[string][]WithdrawalObject),
+		ledger:         make(map[string][]LedgerEntry),
+		transactionIDs: make(map[string]struct{}),
+		jobs: &memoryPollingQueue{
+			jobs: make(map[string]*memoryPollingJob),
+		},
+	}
+
+	startPollingWorkers(
+		context.Background(),
+		pollingWorkersCount,
+		stor.jobs,
+		client,
+		stor.setOrder,
+	)
+
+	return stor
+}
+
+func getTimeStr(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// CreateBalance is the in-memory analogue of the package level CreateBalance.
+func (stor *MemoryStorage) CreateBalance(userID string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	if _, ok := stor.balances[userID]; !ok {
+		stor.balances[userID] = &Balance{}
+	}
+
+	return nil
+}
+
+// DeleteUserData is the in-memory analogue of the package level DeleteUserData.
+func (stor *MemoryStorage) DeleteUserData(userID string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	delete(stor.balances, userID)
+
+	for _, memOrder := range stor.userOrders[userID] {
+		memOrder.userID = deletedUserAccount
+		stor.jobs.removeJob(memOrder.order.Number)
+	}
+	stor.userOrders[deletedUserAccount] = append(stor.userOrders[deletedUserAccount], stor.userOrders[userID]...)
+	delete(stor.userOrders, userID)
+
+	stor.withdrawals[deletedUserAccount] = append(stor.withdrawals[deletedUserAccount], stor.withdrawals[userID]...)
+	delete(stor.withdrawals, userID)
+
+	stor.ledger[deletedUserAccount] = append(stor.ledger[deletedUserAccount], stor.ledger[userID]...)
+	delete(stor.ledger, userID)
+
+	return nil
+}
+
+// addLedgerTransaction is the in-memory analogue of the package level
+// addLedgerTransaction, stor.mux must be locked.
+func (stor *MemoryStorage) addLedgerTransaction(
+	transactionID string,
+	from string,
+	to string,
+	orderID string,
+	kind LedgerEntryKind,
+	amount money.Money,
+) bool {
+	if _, ok := stor.transactionIDs[transactionID]; ok {
+		return false
+	}
+	stor.transactionIDs[transactionID] = struct{}{}
+
+	createdAt := getTimeStr(time.Now())
+	for _, account := range []string{to, from} {
+		stor.lastEntryID++
+		stor.ledger[account] = append(stor.ledger[account], LedgerEntry{
+			ID:        stor.lastEntryID,
+			Kind:      kind,
+			Order:     orderID,
+			Amount:    amount,
+			CreatedAt: createdAt,
+		})
+
+		amount = -amount
+	}
+
+	return true
+}
+
+func (stor *MemoryStorage) setOrder(
+	userID string,
+	order accrualStor.Order,
+	breakdown []accrualStor.BreakdownItem,
+) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	memOrder, ok := stor.orders[order.Order]
+	if !ok {
+		return nil
+	}
+
+	if order.Status != accrualStor.OrderStatusProcessed {
+		// a repoll does not downgrade a credited order
+		if memOrder.order.Status != OrderStatusProcessed {
+			memOrder.order.Status = getOrderStatus(order.Status)
+			memOrder.order.Accrual = order.Accrual
+		}
+
+		return nil
+	}
+
+	memOrder.order.Status = OrderStatusProcessed
+
+	balance, ok := stor.balances[userID]
+	if !ok {
+		return ErrUnknownBalance
+	}
+
+	if memOrder.order.Breakdown == nil && len(breakdown) > 0 {
+		memOrder.order.Breakdown = append([]accrualStor.BreakdownItem{}, breakdown...)
+	}
+
+	isNew := stor.addLedgerTransaction(
+		getAccrualTransactionID(order.Order),
+		accrualAccount,
+		userID,
+		order.Order,
+		LedgerEntryKindAccrual,
+		order.Accrual,
+	)
+
+	// a repolled order keeps the accrual it was credited with
+	if isNew {
+		memOrder.order.Accrual = order.Accrual
+		balance.Current += order.Accrual
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) InitOrder(userID string, orderID string) (SetOrderStatus, error) {
+	if !common.CheckOrderIDFormat(orderID) {
+		return SetOrderStatusErr, ErrInvalidOrderIDFormat
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	if memOrder, ok := stor.orders[orderID]; ok {
+		if memOrder.userID == userID {
+			return SetOrderStatusAlreadyAccepted, nil
+		}
+
+		return SetOrderStatusErr, ErrOrderAlreadyAccepted
+	}
+
+	memOrder := &memoryOrder{
+		userID: userID,
+		order: OrdersForEachObject{
+			Number:     orderID,
+			Status:     OrderStatusNew,
+			UploadedAt: getTimeStr(time.Now()),
+		},
+	}
+
+	stor.orders[orderID] = memOrder
+	stor.userOrders[userID] = append(stor.userOrders[userID], memOrder)
+
+	stor.jobs.addJob(userID, orderID)
+	return SetOrderStatusAccepted, nil
+}
+
+func (stor *MemoryStorage) OrdersForEach(userID string, handler OrdersForEachHandler) error {
+	stor.mux.RLock()
+	orders := make([]OrdersForEachObject, 0, len(stor.userOrders[userID]))
+	for _, memOrder := range stor.userOrders[userID] {
+		orders = append(orders, memOrder.order)
+	}
+	stor.mux.RUnlock()
+
+	for i := range orders {
+		order := orders[i]
+		if order.Status == OrderStatusNew {
+			order.Accrual = 0
+		}
+
+		if err := handler(&order); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) GetBalance(userID string) (*Balance, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	balance, ok := stor.balances[userID]
+	if !ok {
+		return nil, ErrUnknownBalance
+	}
+
+	balanceCopy := *balance
+	return &balanceCopy, nil
+}
+
+func (stor *MemoryStorage) GetUserStats(userID string) (*UserStats, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	return &UserStats{
+		OrdersCount:      len(stor.userOrders[userID]),
+		WithdrawalsCount: len(stor.withdrawals[userID]),
+	}, nil
+}
+
+func (stor *MemoryStorage) MakeWithdrawBalance(userID string, orderID string, sum money.Money) error {
+	if !common.CheckOrderIDFormat(orderID) {
+		return ErrInvalidOrderIDFormat
+	}
+
+	if sum <= 0 {
+		return ErrInvalidWithdrawSum
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	balance, ok := stor.balances[userID]
+	if !ok || balance.Current-sum < 0 {
+		return ErrNotEnoughFunds
+	}
+
+	balance.Current -= sum
+	balance.Withdrawn += sum
+
+	stor.withdrawals[userID] = append(stor.withdrawals[userID], WithdrawalObject{
+		Order:       orderID,
+		Sum:         sum,
+		ProcessedAt: getTimeStr(time.Now()),
+	})
+
+	stor.addLedgerTransaction(
+		uuid.New().String(),
+		userID,
+		withdrawalAccount,
+		orderID,
+		LedgerEntryKindWithdrawal,
+		sum,
+	)
+
+	return nil
+}
+
+func (stor *MemoryStorage) WithdrawalsForEach(userID string, handler WithdrawalsForEachHandler) error {
+	stor.mux.RLock()
+	withdrawals := make([]WithdrawalObject, len(stor.withdrawals[userID]))
+	copy(withdrawals, stor.withdrawals[userID])
+	stor.mux.RUnlock()
+
+	for i := range withdrawals {
+		if err := handler(&withdrawals[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) LedgerForEach(userID string, page common.Page, handler LedgerForEachHandler) error {
+	stor.mux.RLock()
+	entries := make([]LedgerEntry, 0, page.Limit)
+
+	// newest first, like ORDER BY entryID DESC
+	accountEntries := stor.ledger[userID]
+	if page.Offset < uint64(len(accountEntries)) {
+		last := len(accountEntries) - 1 - int(page.Offset)
+		for i := last; i >= 0 && uint64(len(entries)) < page.Limit; i-- {
+			entries = append(entries, accountEntries[i])
+		}
+	}
+	stor.mux.RUnlock()
+
+	for i := range entries {
+		if err := handler(&entries[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addAuditEntry must be called with stor.mux locked.
+func (stor *MemoryStorage) addAuditEntry(entry AuditEntry) {
+	entry.ID = int64(len(stor.audit)) + 1
+	entry.CreatedAt = getTimeStr(time.Now())
+
+	stor.audit = append(stor.audit, entry)
+}
+
+func (stor *MemoryStorage) RepollOrder(adminID string, orderID string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	memOrder, ok := stor.orders[orderID]
+	if !ok || memOrder.userID == deletedUserAccount {
+		return ErrUnknownOrder
+	}
+
+	stor.jobs.addJob(memOrder.userID, orderID)
+
+	stor.addAuditEntry(AuditEntry{
+		AdminID: adminID,
+		Action:  AuditActionRepoll,
+		UserID:  memOrder.userID,
+		Order:   orderID,
+	})
+
+	return nil
+}
+
+func (stor *MemoryStorage) AdjustBalance(adminID string, userID string, amount money.Money, reason string) error {
+	if amount == 0 || reason == "" {
+		return ErrInvalidAdjustment
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	balance, ok := stor.balances[userID]
+	if !ok {
+		return ErrUnknownBalance
+	}
+
+	if balance.Current+amount < 0 {
+		return ErrNotEnoughFunds
+	}
+
+	balance.Current += amount
+
+	stor.addLedgerTransaction(
+		getAdjustmentTransactionID(),
+		adjustmentAccount,
+		userID,
+		"",
+		LedgerEntryKindAdjustment,
+		amount,
+	)
+
+	stor.addAuditEntry(AuditEntry{
+		AdminID: adminID,
+		Action:  AuditActionBalanceAdjustment,
+		UserID:  userID,
+		Amount:  amount,
+		Reason:  reason,
+	})
+
+	return nil
+}
+
+func (stor *MemoryStorage) AuditForEach(page common.Page, handler AuditForEachHandler) error {
+	stor.mux.RLock()
+	entries := make([]AuditEntry, 0, page.Limit)
+
+	// newest first, like ORDER BY auditID DESC
+	if page.Offset < uint64(len(stor.audit)) {
+		last := len(stor.audit) - 1 - int(page.Offset)
+		for i := last; i >= 0 && uint64(len(entries)) < page.Limit; i-- {
+			entries = append(entries, stor.audit[i])
+		}
+	}
+	stor.mux.RUnlock()
+
+	for i := range entries {
+		if err := handler(&entries[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package gophermartstor
+
+import (
+	"testing"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOrderKeepsCreditedAccrual(t *testing.T) {
+	const userID, orderID = "1", "70757088342"
+
+	stor := InitMemory("", "", 0)
+	require.NoError(t, stor.CreateBalance(userID))
+
+	_, err := stor.InitOrder(userID, orderID)
+	require.NoError(t, err)
+
+	processed := accrualStor.Order{Order: orderID, Status: accrualStor.OrderStatusProcessed}
+
+	processed.Accrual = money.MustParse("10")
+	require.NoError(t, stor.setOrder(userID, processed, nil))
+
+	// repolled after the accrual system changed its mind
+	processed.Accrual = money.MustParse("20")
+	require.NoError(t, stor.setOrder(userID, processed, nil))
+
+	// or forgot the order
+	require.NoError(t, stor.setOrder(userID, accrualStor.Order{Order: orderID, Status: accrualStor.OrderStatusInvalid}, nil))
+
+	orders := []*OrdersForEachObject{}
+	require.NoError(t, stor.OrdersForEach(userID, func(order *OrdersForEachObject) error {
+		orders = append(orders, order)
+		return nil
+	}))
+	require.Len(t, orders, 1)
+	assert.Equal(t, OrderStatusProcessed, orders[0].Status)
+	assert.Equal(t, money.MustParse("10"), orders[0].Accrual)
+
+	balance, err := stor.GetBalance(userID)
+	require.NoError(t, err)
+	assert.Equal(t, money.MustParse("10"), balance.Current)
+}
@@ -0,0 +1,260 @@
+package gophermartstor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	accrualClient "github.com/GermanVor/go-tpl/pkg/accrualClient"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// delay after the accrual status has changed
+	pollingBaseDelay = time.Second
+	// backoff limit for failing or unchanged polls
+	pollingMaxDelay = time.Minute
+	// a claimed job is invisible to other workers for this time
+	pollingLease = 30 * time.Second
+	// worker sleep when there are no due jobs
+	pollingIdleDelay = 200 * time.Millisecond
+	// a processed order is credited, then its breakdown is polled this many times
+	pollingMaxBreakdownAttempts = 20
+
+	DefaultPollingWorkersCount = 4
+)
+
+type pollingJob struct {
+	OrderID string
+	UserID  string
+	// last accrual status saved to ordersPool
+	AccrualStatus accrualStor.OrderStatus
+	// polls since the last status change
+	Attempts uint
+}
+
+type pollingQueue interface {
+	// claimJob leases one due job, it returns nil if there are none.
+	claimJob(ctx context.Context) (*pollingJob, error)
+	finishJob(ctx context.Context, job *pollingJob) error
+	rescheduleJob(ctx context.Context, job *pollingJob, delay time.Duration) error
+}
+
+const (
+	// INSERT INTO pollingJobs (orderID, userID) VALUES ($1, $2)
+	insertPollingJobSQL = "INSERT INTO pollingJobs (orderID, userID) VALUES ($1, $2)"
+
+	// UPDATE pollingJobs SET next_attempt_at=NOW()+$1, attempts=attempts+1
+	// WHERE orderID=(SELECT ... FOR UPDATE SKIP LOCKED)
+	// RETURNING orderID, userID, accrualStatus, attempts
+	claimPollingJobSQL = "UPDATE pollingJobs SET " +
+		"next_attempt_at=NOW()+make_interval(secs => $1), attempts=attempts+1 " +
+		"WHERE orderID=(" +
+		"SELECT orderID FROM pollingJobs WHERE next_attempt_at<=NOW() " +
+		"ORDER BY next_attempt_at LIMIT 1 FOR UPDATE SKIP LOCKED" +
+		") RETURNING orderID, userID, accrualStatus, attempts"
+
+	// DELETE FROM pollingJobs WHERE orderID=$1
+	deletePollingJobSQL = "DELETE FROM pollingJobs WHERE orderID=$1"
+
+	// UPDATE pollingJobs SET next_attempt_at=NOW()+$2, accrualStatus=$3, attempts=$4 WHERE orderID=$1
+	reschedulePollingJobSQL = "UPDATE pollingJobs SET " +
+		"next_attempt_at=NOW()+make_interval(secs => $2), accrualStatus=$3, attempts=$4 " +
+		"WHERE orderID=$1"
+)
+
+func (stor *storageObject) claimJob(ctx context.Context) (*pollingJob, error) {
+	job := &pollingJob{}
+
+	err := stor.dbPool.QueryRow(ctx, claimPollingJobSQL, pollingLease.Seconds()).
+		Scan(&job.OrderID, &job.UserID, &job.AccrualStatus, &job.Attempts)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (stor *storageObject) finishJob(ctx context.Context, job *pollingJob) error {
+	_, err := stor.dbPool.Exec(ctx, deletePollingJobSQL, job.OrderID)
+	return err
+}
+
+func (stor *storageObject) rescheduleJob(ctx context.Context, job *pollingJob, delay time.Duration) error {
+	_, err := stor.dbPool.Exec(
+		ctx,
+		reschedulePollingJobSQL,
+		job.OrderID,
+		delay.Seconds(),
+		job.AccrualStatus,
+		job.Attempts,
+	)
+
+	return err
+}
+
+// getBackoff doubles the delay with every poll which brought nothing new.
+func getBackoff(attempts uint) time.Duration {
+	delay := pollingBaseDelay
+	for i := uint(1); i < attempts && delay < pollingMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > pollingMaxDelay {
+		return pollingMaxDelay
+	}
+
+	return delay
+}
+
+// setOrderFunc saves the order polled from the accrual system, breakdown is
+// nil unless the order is processed.
+type setOrderFunc func(userID string, order accrualStor.Order, breakdown []accrualStor.BreakdownItem) error
+
+func processPollingJob(
+	ctx context.Context,
+	queue pollingQueue,
+	job *pollingJob,
+	client *AccrualClient,
+	setOrder setOrderFunc,
+) error {
+	result, err := client.GetOrder(ctx, job.OrderID)
+	if err != nil {
+		log.Println("polling error", job.UserID, err)
+		return queue.rescheduleJob(ctx, job, getBackoff(job.Attempts))
+	}
+
+	switch result.Kind {
+	case AccrualResultThrottled:
+		// not the order's fault, so the attempt does not count
+		job.Attempts--
+		return queue.rescheduleJob(ctx, job, result.RetryAfter)
+	case AccrualResultUnknown:
+		// the order may reach the accrual system late, so it is polled
+		// until it does
+		return queue.rescheduleJob(ctx, job, getBackoff(job.Attempts))
+	case AccrualResultUnauthorized:
+		// no order can be polled until the key is fixed, so every worker
+		// pauses and the attempt does not count
+		log.Println("polling error, the accrual system refused the API key, check -x or ACCRUAL_API_KEY",
+			result.StatusCode)
+		client.pause(pollingMaxDelay)
+
+		job.Attempts--
+		return queue.rescheduleJob(ctx, job, pollingMaxDelay)
+	case AccrualResultServerError:
+		log.Println("polling error, accrual system responded", job.UserID, result.StatusCode)
+		return queue.rescheduleJob(ctx, job, getBackoff(job.Attempts))
+	}
+
+	order := result.Order
+
+	// a processed order credited without its breakdown is polled again
+	// for it only
+	missingBreakdown := order.Status == accrualStor.OrderStatusProcessed &&
+		job.AccrualStatus == accrualStor.OrderStatusProcessed
+
+	if order.Order != job.OrderID || (order.Status == job.AccrualStatus && !missingBreakdown) {
+		return queue.rescheduleJob(ctx, job, getBackoff(job.Attempts))
+	}
+
+	var breakdown []accrualStor.BreakdownItem
+	var breakdownErr error
+	if order.Status == accrualStor.OrderStatusProcessed {
+		// the breakdown only explains the accrual, so the order is credited
+		// without it rather than delayed
+		breakdown, breakdownErr = client.GetOrderBreakdown(ctx, job.OrderID)
+		if breakdownErr != nil {
+			log.Println("polling error, no breakdown", job.UserID, job.OrderID, breakdownErr)
+		}
+	}
+
+	err = setOrder(job.UserID, *order, breakdown)
+	if err != nil {
+		log.Println("polling error", job.UserID, order, err)
+		return queue.rescheduleJob(ctx, job, getBackoff(job.Attempts))
+	}
+
+	if breakdownErr != nil {
+		var throttledErr *accrualClient.ThrottledError
+		throttled := errors.As(breakdownErr, &throttledErr)
+
+		switch {
+		case !missingBreakdown:
+			// breakdown attempts count from the credit
+			job.AccrualStatus = order.Status
+			job.Attempts = 0
+		case throttled:
+			// not the order's fault, so the attempt does not count
+			job.Attempts--
+		case job.Attempts >= pollingMaxBreakdownAttempts:
+			log.Println("polling error, gave up on the breakdown", job.UserID, job.OrderID)
+			return queue.finishJob(ctx, job)
+		}
+
+		if throttled {
+			return queue.rescheduleJob(ctx, job, throttledErr.RetryAfter)
+		}
+
+		return queue.rescheduleJob(ctx, job, getBackoff(job.Attempts))
+	}
+
+	if order.Status == accrualStor.OrderStatusInvalid ||
+		order.Status == accrualStor.OrderStatusProcessed {
+		return queue.finishJob(ctx, job)
+	}
+
+	job.AccrualStatus = order.Status
+	job.Attempts = 0
+
+	return queue.rescheduleJob(ctx, job, pollingBaseDelay)
+}
+
+// startPollingWorkers runs workersCount goroutines which share the queue
+// and the client. With Postgres the queue can be shared by several replicas.
+func startPollingWorkers(
+	ctx context.Context,
+	workersCount uint,
+	queue pollingQueue,
+	client *AccrualClient,
+	setOrder setOrderFunc,
+) {
+	for i := uint(0); i < workersCount; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				// do not lease jobs while the accrual system throttles us
+				if pause := client.PausedFor(); pause > 0 {
+					time.Sleep(pause)
+					continue
+				}
+
+				job, err := queue.claimJob(ctx)
+				if err != nil {
+					log.Println("polling queue error", err)
+				}
+
+				if err != nil || job == nil {
+					time.Sleep(pollingIdleDelay)
+					continue
+				}
+
+				err = processPollingJob(ctx, queue, job, client, setOrder)
+				if err != nil {
+					log.Println("polling queue error", job.OrderID, err)
+				}
+			}
+		}()
+	}
+}
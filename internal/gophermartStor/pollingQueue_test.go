@@ -0,0 +1,100 @@
+package gophermartstor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollingRetriesThrottledBreakdown(t *testing.T) {
+	const userID, orderID, apiKey = "1", "70757088342", "poller.secret"
+
+	items := []accrualStor.BreakdownItem{{
+		Description: "Bork kettle",
+		Price:       money.MustParse("5000"),
+		Match:       "Bork",
+		RuleVersion: 1,
+		RewardType:  accrualStor.RewardTypePercent,
+		Reward:      money.MustParse("10"),
+		Accrual:     money.MustParse("500"),
+	}}
+
+	breakdownRequests := 0
+
+	r := chi.NewRouter()
+	r.Get("/api/orders/{orderID}", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(accrualStor.Order{
+			Order:   orderID,
+			Status:  accrualStor.OrderStatusProcessed,
+			Accrual: money.MustParse("500"),
+		})
+	})
+	r.Get("/api/orders/{orderID}/breakdown", func(w http.ResponseWriter, r *http.Request) {
+		breakdownRequests++
+		if breakdownRequests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		json.NewEncoder(w).Encode(accrualStor.Breakdown{
+			Order:   orderID,
+			Status:  accrualStor.OrderStatusProcessed,
+			Accrual: money.MustParse("500"),
+			Items:   items,
+		})
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	client, err := NewAccrualClient(ts.URL, apiKey)
+	require.NoError(t, err)
+
+	stor := InitMemory(ts.URL, apiKey, 0)
+	require.NoError(t, stor.CreateBalance(userID))
+
+	_, err = stor.InitOrder(userID, orderID)
+	require.NoError(t, err)
+
+	getOrder := func() OrdersForEachObject {
+		stor.mux.RLock()
+		defer stor.mux.RUnlock()
+
+		return stor.orders[orderID].order
+	}
+
+	ctx := context.Background()
+
+	job, err := stor.jobs.claimJob(ctx)
+	require.NoError(t, err)
+	require.NoError(t, processPollingJob(ctx, stor.jobs, job, client, stor.setOrder))
+
+	// credited at once, the job stays for the breakdown
+	assert.Equal(t, OrderStatusProcessed, getOrder().Status)
+	assert.Empty(t, getOrder().Breakdown)
+	require.Contains(t, stor.jobs.jobs, orderID)
+
+	job = &stor.jobs.jobs[orderID].job
+	assert.Equal(t, accrualStor.OrderStatusProcessed, job.AccrualStatus)
+
+	// the client waits for Retry-After
+	jobCopy := *job
+	require.NoError(t, processPollingJob(ctx, stor.jobs, &jobCopy, client, stor.setOrder))
+
+	assert.Equal(t, 2, breakdownRequests)
+	assert.Equal(t, items, getOrder().Breakdown)
+	assert.NotContains(t, stor.jobs.jobs, orderID)
+
+	balance, err := stor.GetBalance(userID)
+	require.NoError(t, err)
+	assert.Equal(t, money.MustParse("500"), balance.Current)
+}
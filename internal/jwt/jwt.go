@@ -0,0 +1,309 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+
+	// shorter HS256 secrets are rejected
+	minSecretLen = 32
+)
+
+// Key file extensions read by LoadKeySet. The file name without the
+// extension is the key ID.
+const (
+	// raw secret bytes, surrounding whitespace is trimmed
+	hs256KeyExt = ".hs256"
+	// PKCS #8 Ed25519 private key or PKIX public key for verification only
+	pemKeyExt = ".pem"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token is expired")
+	ErrUnknownKeyID = errors.New("unknown key id")
+	ErrInvalidKey   = errors.New("invalid key")
+)
+
+type Claims struct {
+	UserID    string `json:"sub"`
+	SessionID string `json:"sid,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type Key struct {
+	ID  string
+	Alg string
+
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func NewHS256Key(id string, secret []byte) (*Key, error) {
+	if len(secret) < minSecretLen {
+		return nil, fmt.Errorf("%w: %s secret is shorter than %d bytes", ErrInvalidKey, id, minSecretLen)
+	}
+
+	return &Key{ID: id, Alg: AlgHS256, secret: secret}, nil
+}
+
+func NewEdDSAKey(id string, private ed25519.PrivateKey) *Key {
+	return &Key{
+		ID:      id,
+		Alg:     AlgEdDSA,
+		private: private,
+		public:  private.Public().(ed25519.PublicKey),
+	}
+}
+
+// NewEdDSAPublicKey creates a key which only verifies tokens.
+func NewEdDSAPublicKey(id string, public ed25519.PublicKey) *Key {
+	return &Key{ID: id, Alg: AlgEdDSA, public: public}
+}
+
+func (key *Key) canSign() bool {
+	return key.secret != nil || key.private != nil
+}
+
+func (key *Key) sign(data []byte) []byte {
+	if key.Alg == AlgHS256 {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+
+	return ed25519.Sign(key.private, data)
+}
+
+func (key *Key) verify(data []byte, signature []byte) bool {
+	if key.Alg == AlgHS256 {
+		return hmac.Equal(key.sign(data), signature)
+	}
+
+	return ed25519.Verify(key.public, data, signature)
+}
+
+// KeySet signs tokens with one key and verifies them with any key of the
+// set, so a key can be rotated while tokens signed by the old one are alive.
+type KeySet struct {
+	signingKey *Key
+	keys       map[string]*Key
+}
+
+func NewKeySet(signingKeyID string, keys ...*Key) (*KeySet, error) {
+	keySet := &KeySet{keys: make(map[string]*Key, len(keys))}
+
+	for _, key := range keys {
+		if _, ok := keySet.keys[key.ID]; ok {
+			return nil, fmt.Errorf("%w: duplicated key id %s", ErrInvalidKey, key.ID)
+		}
+
+		keySet.keys[key.ID] = key
+	}
+
+	signingKey, ok := keySet.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, signingKeyID)
+	}
+
+	if !signingKey.canSign() {
+		return nil, fmt.Errorf("%w: %s is a public key", ErrInvalidKey, signingKeyID)
+	}
+
+	keySet.signingKey = signingKey
+
+	return keySet, nil
+}
+
+func loadPEMKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s is not a PEM file", ErrInvalidKey, id)
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if private, ok := private.(ed25519.PrivateKey); ok {
+			return NewEdDSAKey(id, private), nil
+		}
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if public, ok := public.(ed25519.PublicKey); ok {
+			return NewEdDSAPublicKey(id, public), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s is not an Ed25519 key", ErrInvalidKey, id)
+}
+
+// LoadKeySet reads every <id>.hs256 and <id>.pem file of dir.
+func LoadKeySet(dir string, signingKeyID string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*Key, 0, len(entries))
+
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != hs256KeyExt && ext != pemKeyExt) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ext)
+
+		var key *Key
+		if ext == hs256KeyExt {
+			key, err = NewHS256Key(id, []byte(strings.TrimSpace(string(data))))
+		} else {
+			key, err = loadPEMKey(id, data)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return NewKeySet(signingKeyID, keys...)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if json.Unmarshal(data, v) != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func (keySet *KeySet) Sign(claims Claims) (string, error) {
+	key := keySet.signingKey
+
+	headerSegment, err := encodeSegment(header{Alg: key.Alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	claimsSegment, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := headerSegment + "." + claimsSegment
+	signature := key.sign([]byte(signingInput))
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Parse checks the signature of the token but not its expiry.
+func (keySet *KeySet) Parse(token string) (*Claims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	tokenHeader := header{}
+	err := decodeSegment(segments[0], &tokenHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := keySet.keys[tokenHeader.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, tokenHeader.Kid)
+	}
+
+	// the algorithm is bound to the key, so "none" or HS256 with
+	// a public key as the secret cannot be smuggled in
+	if tokenHeader.Alg != key.Alg {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if !key.verify([]byte(segments[0]+"."+segments[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &Claims{}
+	err = decodeSegment(segments[1], claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Verify checks the signature and the expiry of the token.
+func (keySet *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	claims, err := keySet.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.UserID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	return claims, nil
+}
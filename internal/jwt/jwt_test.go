@@ -0,0 +1,165 @@
+package jwt_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func getClaims(now time.Time) jwt.Claims {
+	return jwt.Claims{
+		UserID:    "1",
+		SessionID: "qwerty",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestHS256(t *testing.T) {
+	key, err := jwt.NewHS256Key("hs-1", secret)
+	require.NoError(t, err)
+
+	keys, err := jwt.NewKeySet("hs-1", key)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	token, err := keys.Sign(getClaims(now))
+	require.NoError(t, err)
+
+	claims, err := keys.Verify(token, now)
+	require.NoError(t, err)
+	assert.Equal(t, getClaims(now), *claims)
+
+	t.Run("Expired", func(t *testing.T) {
+		_, err := keys.Verify(token, now.Add(time.Hour))
+		assert.ErrorIs(t, err, jwt.ErrExpiredToken)
+
+		// Parse does not look at the expiry
+		_, err = keys.Parse(token)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		segments := strings.Split(token, ".")
+
+		anotherToken, err := keys.Sign(jwt.Claims{UserID: "2", ExpiresAt: now.Add(time.Hour).Unix()})
+		require.NoError(t, err)
+
+		segments[1] = strings.Split(anotherToken, ".")[1]
+
+		_, err = keys.Verify(strings.Join(segments, "."), now)
+		assert.ErrorIs(t, err, jwt.ErrInvalidToken)
+
+		_, err = keys.Verify("qwerty", now)
+		assert.ErrorIs(t, err, jwt.ErrInvalidToken)
+	})
+
+	t.Run("Short secret", func(t *testing.T) {
+		_, err := jwt.NewHS256Key("hs-2", secret[:16])
+		assert.ErrorIs(t, err, jwt.ErrInvalidKey)
+	})
+}
+
+func TestRotation(t *testing.T) {
+	oldKey, err := jwt.NewHS256Key("hs-1", secret)
+	require.NoError(t, err)
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newKey := jwt.NewEdDSAKey("ed-1", private)
+
+	oldKeys, err := jwt.NewKeySet("hs-1", oldKey)
+	require.NoError(t, err)
+
+	newKeys, err := jwt.NewKeySet("ed-1", oldKey, newKey)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	oldToken, err := oldKeys.Sign(getClaims(now))
+	require.NoError(t, err)
+
+	newToken, err := newKeys.Sign(getClaims(now))
+	require.NoError(t, err)
+
+	_, err = newKeys.Verify(oldToken, now)
+	assert.NoError(t, err)
+
+	_, err = newKeys.Verify(newToken, now)
+	assert.NoError(t, err)
+
+	_, err = oldKeys.Verify(newToken, now)
+	assert.ErrorIs(t, err, jwt.ErrUnknownKeyID)
+
+	t.Run("Public key can not sign", func(t *testing.T) {
+		publicKey := jwt.NewEdDSAPublicKey("ed-2", private.Public().(ed25519.PublicKey))
+
+		_, err := jwt.NewKeySet("ed-2", publicKey)
+		assert.ErrorIs(t, err, jwt.ErrInvalidKey)
+
+		keys, err := jwt.NewKeySet("hs-1", oldKey, publicKey)
+		require.NoError(t, err)
+
+		signingKeys, err := jwt.NewKeySet("ed-2", jwt.NewEdDSAKey("ed-2", private))
+		require.NoError(t, err)
+
+		signed, err := signingKeys.Sign(getClaims(now))
+		require.NoError(t, err)
+
+		_, err = keys.Verify(signed, now)
+		assert.NoError(t, err)
+	})
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hs-1.hs256"), append(secret, '\n'), 0600))
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ed-1.pem"), privatePEM, 0600))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600))
+
+	keys, err := jwt.LoadKeySet(dir, "ed-1")
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	token, err := keys.Sign(getClaims(now))
+	require.NoError(t, err)
+
+	_, err = keys.Verify(token, now)
+	assert.NoError(t, err)
+
+	oldKeys, err := jwt.LoadKeySet(dir, "hs-1")
+	require.NoError(t, err)
+
+	oldToken, err := oldKeys.Sign(getClaims(now))
+	require.NoError(t, err)
+
+	_, err = keys.Verify(oldToken, now)
+	assert.NoError(t, err)
+
+	_, err = jwt.LoadKeySet(dir, "ed-2")
+	assert.ErrorIs(t, err, jwt.ErrUnknownKeyID)
+}
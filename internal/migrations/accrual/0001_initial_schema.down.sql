@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS goodsBaskets;
+DROP TABLE IF EXISTS goods;
+DROP TABLE IF EXISTS ordersReward;
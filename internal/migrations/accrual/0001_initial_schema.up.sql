@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS ordersReward (
+	orderID text UNIQUE,
+	status text,
+	accrual decimal
+);
+
+CREATE TABLE IF NOT EXISTS goods (
+	match text UNIQUE,
+	reward decimal,
+	reward_type text
+);
+
+CREATE TABLE IF NOT EXISTS goodsBaskets (
+	orderID text,
+	description text,
+	price decimal
+);
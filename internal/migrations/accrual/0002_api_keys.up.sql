@@ -0,0 +1,8 @@
+-- secret is kept as is, HMAC-signed requests are checked with it
+CREATE TABLE IF NOT EXISTS apiKeys (
+	keyID text PRIMARY KEY,
+	secret text NOT NULL,
+	scopes text[] NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	revoked_at timestamptz
+);
@@ -0,0 +1,6 @@
+ALTER TABLE goods DROP COLUMN IF EXISTS min_basket_price;
+ALTER TABLE goods DROP COLUMN IF EXISTS max_per_order;
+ALTER TABLE goods DROP COLUMN IF EXISTS max_per_item;
+ALTER TABLE goods DROP COLUMN IF EXISTS resolution;
+ALTER TABLE goods DROP COLUMN IF EXISTS priority;
+ALTER TABLE goods DROP COLUMN IF EXISTS match_type;
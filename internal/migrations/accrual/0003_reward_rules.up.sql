@@ -0,0 +1,7 @@
+-- defaults keep the substring matching of every rule stacking up
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS match_type text NOT NULL DEFAULT 'contains';
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS priority integer NOT NULL DEFAULT 0;
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS resolution text NOT NULL DEFAULT 'stack';
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS max_per_item decimal NOT NULL DEFAULT 0;
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS max_per_order decimal NOT NULL DEFAULT 0;
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS min_basket_price decimal NOT NULL DEFAULT 0;
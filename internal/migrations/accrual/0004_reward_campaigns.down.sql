@@ -0,0 +1,4 @@
+ALTER TABLE ordersReward DROP COLUMN IF EXISTS registered_at;
+
+ALTER TABLE goods DROP COLUMN IF EXISTS valid_until;
+ALTER TABLE goods DROP COLUMN IF EXISTS valid_from;
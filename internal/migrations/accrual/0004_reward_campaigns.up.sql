@@ -0,0 +1,6 @@
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS valid_from timestamptz;
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS valid_until timestamptz;
+
+-- rules are evaluated against the registration time, orders registered
+-- before the migration get the time of the migration
+ALTER TABLE ordersReward ADD COLUMN IF NOT EXISTS registered_at timestamptz NOT NULL DEFAULT NOW();
@@ -0,0 +1,9 @@
+DELETE FROM goods WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS goods_match_version;
+DROP INDEX IF EXISTS goods_live_match;
+ALTER TABLE goods ADD CONSTRAINT goods_match_key UNIQUE (match);
+
+ALTER TABLE goods DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE goods DROP COLUMN IF EXISTS created_at;
+ALTER TABLE goods DROP COLUMN IF EXISTS version;
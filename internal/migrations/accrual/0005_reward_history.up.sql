@@ -0,0 +1,9 @@
+-- Every version of a rule is a row, replaced and deleted versions have
+-- deleted_at set, so only the live version of a match must be unique.
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT NOW();
+ALTER TABLE goods ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+
+ALTER TABLE goods DROP CONSTRAINT IF EXISTS goods_match_key;
+CREATE UNIQUE INDEX IF NOT EXISTS goods_live_match ON goods (match) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS goods_match_version ON goods (match, version);
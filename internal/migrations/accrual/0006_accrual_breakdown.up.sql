@@ -0,0 +1,13 @@
+-- rewards of every rule for every good of processed orders
+CREATE TABLE IF NOT EXISTS accrualBreakdown (
+	orderID text NOT NULL,
+	position integer NOT NULL,
+	description text NOT NULL,
+	price decimal NOT NULL,
+	match text NOT NULL,
+	rule_version integer NOT NULL,
+	reward_type text NOT NULL,
+	reward decimal NOT NULL,
+	accrual decimal NOT NULL,
+	PRIMARY KEY (orderID, position, match)
+);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS goodsBaskets_order;
+ALTER TABLE goodsBaskets DROP COLUMN IF EXISTS position;
+
+DROP INDEX IF EXISTS ordersReward_pending;
+ALTER TABLE ordersReward DROP COLUMN IF EXISTS attempts;
+ALTER TABLE ordersReward DROP COLUMN IF EXISTS claimed_at;
@@ -0,0 +1,14 @@
+-- orders are calculated by background workers which claim REGISTERED
+-- orders, claimed_at is the lease of the worker
+ALTER TABLE ordersReward ADD COLUMN IF NOT EXISTS claimed_at timestamptz;
+-- claims of the order, one which keeps failing is invalid
+ALTER TABLE ordersReward ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS ordersReward_pending ON ordersReward (registered_at)
+	WHERE status IN ('REGISTERED', 'PROCESSING');
+
+-- the index of the good in the order, baskets registered before the
+-- migration have none
+ALTER TABLE goodsBaskets ADD COLUMN IF NOT EXISTS position integer;
+
+CREATE INDEX IF NOT EXISTS goodsBaskets_order ON goodsBaskets (orderID, position);
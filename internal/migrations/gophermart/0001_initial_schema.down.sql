@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS orderHistory;
+DROP TABLE IF EXISTS balances;
+DROP TABLE IF EXISTS ordersPool;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS users (
+	login text UNIQUE,
+	pass text,
+	salt text,
+	userID SERIAL,
+	sessionToken text
+);
+
+CREATE TABLE IF NOT EXISTS ordersPool (
+	userID TEXT,
+	orderID TEXT UNIQUE,
+	status TEXT,
+	accrual DECIMAL DEFAULT 0,
+	uploaded_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS balances (
+	userID TEXT UNIQUE,
+	current DECIMAL DEFAULT 0,
+	withdrawn DECIMAL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS orderHistory (
+	userID TEXT UNIQUE,
+	orderID TEXT,
+	sum DECIMAL,
+	processed_at TIMESTAMP DEFAULT NOW()
+);
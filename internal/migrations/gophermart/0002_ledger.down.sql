@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS ledger;
+
+-- the old schema holds one withdrawal per user, only the latest one is
+-- kept, so this step can not be fully reversed
+DELETE FROM orderHistory older USING orderHistory newer
+WHERE older.userID = newer.userID AND (older.processed_at, older.ctid) < (newer.processed_at, newer.ctid);
+
+ALTER TABLE orderHistory ADD CONSTRAINT orderhistory_userid_key UNIQUE (userID);
@@ -0,0 +1,39 @@
+-- Double-entry ledger: every transaction is two rows with opposite amounts,
+-- one on the user account (userID) and one on a system account
+-- ('@accrual' or '@withdrawal'). balances is a cache of it.
+CREATE TABLE IF NOT EXISTS ledger (
+	entryID BIGSERIAL PRIMARY KEY,
+	transactionID TEXT NOT NULL,
+	account TEXT NOT NULL,
+	orderID TEXT,
+	kind TEXT NOT NULL,
+	amount DECIMAL NOT NULL,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_transaction_account_idx ON ledger (transactionID, account);
+CREATE INDEX IF NOT EXISTS ledger_account_idx ON ledger (account, entryID);
+
+-- a user could not withdraw twice
+ALTER TABLE orderHistory DROP CONSTRAINT IF EXISTS orderhistory_userid_key;
+
+INSERT INTO ledger (transactionID, account, orderID, kind, amount, created_at)
+SELECT 'accrual:' || orderID, userID, orderID, 'accrual', accrual, uploaded_at
+FROM ordersPool WHERE status = 'PROCESSED' AND accrual > 0;
+
+INSERT INTO ledger (transactionID, account, orderID, kind, amount, created_at)
+SELECT 'accrual:' || orderID, '@accrual', orderID, 'accrual', -accrual, uploaded_at
+FROM ordersPool WHERE status = 'PROCESSED' AND accrual > 0;
+
+INSERT INTO ledger (transactionID, account, orderID, kind, amount, created_at)
+SELECT 'withdrawal:' || userID || ':' || orderID || ':' || processed_at, userID, orderID, 'withdrawal', -sum, processed_at
+FROM orderHistory;
+
+INSERT INTO ledger (transactionID, account, orderID, kind, amount, created_at)
+SELECT 'withdrawal:' || userID || ':' || orderID || ':' || processed_at, '@withdrawal', orderID, 'withdrawal', sum, processed_at
+FROM orderHistory;
+
+-- withdrawn was overwritten by every withdrawal, rebuild the cache
+UPDATE balances SET
+	current = COALESCE((SELECT SUM(amount) FROM ledger WHERE account = balances.userID), 0),
+	withdrawn = COALESCE((SELECT -SUM(amount) FROM ledger WHERE account = balances.userID AND kind = 'withdrawal'), 0);
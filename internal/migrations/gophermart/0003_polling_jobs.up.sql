@@ -0,0 +1,16 @@
+-- Orders waiting for the accrual system. A claimed job is leased by moving
+-- next_attempt_at forward, so it comes back if the replica dies.
+CREATE TABLE IF NOT EXISTS pollingJobs (
+	orderID TEXT PRIMARY KEY,
+	userID TEXT NOT NULL,
+	accrualStatus TEXT NOT NULL DEFAULT 'REGISTERED',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS pollingJobs_next_attempt_at_idx ON pollingJobs (next_attempt_at);
+
+-- these were polled by per-order goroutines before
+INSERT INTO pollingJobs (orderID, userID)
+SELECT orderID, userID FROM ordersPool WHERE status NOT IN ('PROCESSED', 'INVALID')
+ON CONFLICT DO NOTHING;
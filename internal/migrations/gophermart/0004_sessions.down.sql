@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS sessionToken TEXT;
+
+-- the old schema has one token per user, keep the latest one
+UPDATE users SET sessionToken=latest.sessionToken
+FROM (
+	SELECT DISTINCT ON (userID) userID, sessionToken FROM sessions
+	ORDER BY userID, created_at DESC
+) AS latest
+WHERE users.userID::TEXT=latest.userID;
+
+-- the old LogIn scans the token into a string, NULL would break it
+UPDATE users SET sessionToken=md5(random()::TEXT || userID::TEXT) WHERE sessionToken IS NULL;
+
+DROP TABLE IF EXISTS sessions;
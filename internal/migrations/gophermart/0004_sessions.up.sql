@@ -0,0 +1,19 @@
+-- One row per logged in device. users.sessionToken was a single token
+-- which never expired.
+CREATE TABLE IF NOT EXISTS sessions (
+	sessionToken TEXT PRIMARY KEY,
+	userID TEXT NOT NULL,
+	device TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_userid_idx ON sessions (userID);
+
+-- keep existing clients logged in for a day
+INSERT INTO sessions (sessionToken, userID, expires_at)
+SELECT sessionToken, userID::TEXT, NOW() + INTERVAL '1 day' FROM users
+WHERE sessionToken IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users DROP COLUMN IF EXISTS sessionToken;
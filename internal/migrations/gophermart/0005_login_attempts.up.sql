@@ -0,0 +1,7 @@
+-- Failed login counters, attemptKey is 'login:<login hash>' or 'ip:<address>'.
+CREATE TABLE IF NOT EXISTS loginAttempts (
+	attemptKey TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	blocked_until TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
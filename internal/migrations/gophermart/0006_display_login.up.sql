@@ -0,0 +1,4 @@
+-- Logins are normalized (NFKC) since this version, users.login is the sha1 of the
+-- case-folded login and display_login is the login as the user typed it.
+-- Users registered before get display_login on their next login.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_login TEXT;
@@ -0,0 +1,3 @@
+-- Users registered before this version have no registration time.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS registered_at TIMESTAMPTZ;
+ALTER TABLE users ALTER COLUMN registered_at SET DEFAULT NOW();
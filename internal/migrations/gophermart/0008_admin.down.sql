@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS adminAudit;
+
+ALTER TABLE users DROP COLUMN IF EXISTS role;
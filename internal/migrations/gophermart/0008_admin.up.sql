@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+-- Actions of support staff through /api/admin, newest rows are read first.
+CREATE TABLE IF NOT EXISTS adminAudit (
+	auditID BIGSERIAL PRIMARY KEY,
+	adminID TEXT NOT NULL,
+	action TEXT NOT NULL,
+	userID TEXT,
+	orderID TEXT,
+	amount DECIMAL,
+	reason TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
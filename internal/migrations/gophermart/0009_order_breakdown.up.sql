@@ -0,0 +1,13 @@
+-- breakdowns of processed orders as the accrual system explained them
+CREATE TABLE IF NOT EXISTS orderBreakdown (
+	orderID TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	description TEXT NOT NULL,
+	price DECIMAL NOT NULL,
+	match TEXT NOT NULL,
+	rule_version INTEGER NOT NULL,
+	reward_type TEXT NOT NULL,
+	reward DECIMAL NOT NULL,
+	accrual DECIMAL NOT NULL,
+	PRIMARY KEY (orderID, position, match)
+);
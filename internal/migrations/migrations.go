@@ -0,0 +1,441 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed gophermart/*.sql accrual/*.sql
+var migrationsFS embed.FS
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Set is an ordered list of migrations of one service. Name is stored in
+// schema_version, so several services can share one database.
+type Set struct {
+	Name       string
+	Migrations []Migration
+}
+
+var (
+	Gophermart = mustLoadSet("gophermart")
+	Accrual    = mustLoadSet("accrual")
+)
+
+var (
+	ErrInvalidMigrationName = errors.New("invalid migration file name")
+	ErrDuplicatedMigration  = errors.New("duplicated migration version")
+	ErrMissingUpMigration   = errors.New("migration has no up script")
+	ErrMissingDownMigration = errors.New("migration has no down script")
+	ErrUnknownCommand       = errors.New("unknown migrate command, expected up, down or status")
+	ErrUnknownMode          = errors.New("unknown migrate mode")
+)
+
+const (
+	// apply pending migrations on start
+	ModeAuto = "auto"
+	// only print pending migrations on start
+	ModeDryRun = "dry-run"
+	// do not touch the schema on start
+	ModeOff = "off"
+)
+
+const (
+	// CREATE TABLE IF NOT EXISTS schema_version (...)
+	createSchemaVersionSQL = "CREATE TABLE IF NOT EXISTS schema_version (" +
+		"component TEXT, " +
+		"version INTEGER, " +
+		"name TEXT, " +
+		"applied_at TIMESTAMP DEFAULT NOW(), " +
+		"PRIMARY KEY (component, version)" +
+		")"
+
+	// SELECT to_regclass('schema_version') IS NOT NULL
+	hasSchemaVersionSQL = "SELECT to_regclass('schema_version') IS NOT NULL"
+
+	// SELECT version, applied_at FROM schema_version WHERE component=$1
+	selectAppliedSQL = "SELECT version, applied_at FROM schema_version WHERE component=$1"
+
+	// SELECT EXISTS (SELECT 1 FROM schema_version WHERE component=$1 AND version=$2)
+	isAppliedSQL = "SELECT EXISTS (SELECT 1 FROM schema_version WHERE component=$1 AND version=$2)"
+
+	// SELECT pg_advisory_xact_lock(hashtext($1))
+	lockSQL = "SELECT pg_advisory_xact_lock(hashtext($1))"
+
+	// INSERT INTO schema_version (component, version, name) VALUES ($1, $2, $3)
+	insertVersionSQL = "INSERT INTO schema_version (component, version, name) VALUES ($1, $2, $3)"
+
+	// DELETE FROM schema_version WHERE component=$1 AND version=$2
+	deleteVersionSQL = "DELETE FROM schema_version WHERE component=$1 AND version=$2"
+)
+
+var fileNameRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+func loadSet(fsys fs.FS, name string) (Set, error) {
+	set := Set{Name: name}
+
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return set, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+
+	for _, entry := range entries {
+		match := fileNameRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return set, fmt.Errorf("%w: %s", ErrInvalidMigrationName, entry.Name())
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 32)
+		if err != nil {
+			return set, fmt.Errorf("%w: %s", ErrInvalidMigrationName, entry.Name())
+		}
+
+		migration, ok := byVersion[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[uint(version)] = migration
+		} else if migration.Name != match[2] {
+			return set, fmt.Errorf("%w: %d", ErrDuplicatedMigration, version)
+		}
+
+		sqlBytes, err := fs.ReadFile(fsys, path.Join(name, entry.Name()))
+		if err != nil {
+			return set, err
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(sqlBytes)
+		} else {
+			migration.Down = string(sqlBytes)
+		}
+	}
+
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return set, fmt.Errorf("%w: %d", ErrMissingUpMigration, migration.Version)
+		}
+
+		if migration.Down == "" {
+			return set, fmt.Errorf("%w: %d", ErrMissingDownMigration, migration.Version)
+		}
+
+		set.Migrations = append(set.Migrations, *migration)
+	}
+
+	sort.Slice(set.Migrations, func(i, j int) bool {
+		return set.Migrations[i].Version < set.Migrations[j].Version
+	})
+
+	return set, nil
+}
+
+func mustLoadSet(name string) Set {
+	set, err := loadSet(migrationsFS, name)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	return set
+}
+
+// getApplied returns applied versions and their apply time. It does not
+// create schema_version, so it is safe for dry runs.
+func getApplied(ctx context.Context, conn *pgxpool.Pool, set Set) (map[uint]time.Time, error) {
+	applied := make(map[uint]time.Time)
+
+	hasTable := false
+	err := conn.QueryRow(ctx, hasSchemaVersionSQL).Scan(&hasTable)
+	if err != nil || !hasTable {
+		return applied, err
+	}
+
+	rows, err := conn.Query(ctx, selectAppliedSQL, set.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		version := uint(0)
+		appliedAt := time.Time{}
+
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+type Options struct {
+	// DryRun prints scripts instead of executing them
+	DryRun bool
+	// Steps limits the number of migrations, 0 means no limit
+	Steps int
+	// Out receives progress and dry run output
+	Out io.Writer
+}
+
+func (opts Options) out() io.Writer {
+	if opts.Out == nil {
+		return os.Stdout
+	}
+
+	return opts.Out
+}
+
+func (opts Options) limitReached(done int) bool {
+	return opts.Steps > 0 && done >= opts.Steps
+}
+
+// migrate runs script of one migration and moves schema_version in the same
+// transaction. The advisory lock keeps concurrent replicas from applying
+// the same migration twice.
+func migrate(ctx context.Context, conn *pgxpool.Pool, set Set, migration Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, lockSQL, "schema_version:"+set.Name)
+	if err != nil {
+		return err
+	}
+
+	isApplied := false
+	err = tx.QueryRow(ctx, isAppliedSQL, set.Name, migration.Version).Scan(&isApplied)
+	if err != nil {
+		return err
+	}
+
+	// another replica was faster
+	if isApplied == up {
+		return nil
+	}
+
+	script := migration.Down
+	if up {
+		script = migration.Up
+	}
+
+	_, err = tx.Exec(ctx, script)
+	if err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	if up {
+		_, err = tx.Exec(ctx, insertVersionSQL, set.Name, migration.Version, migration.Name)
+	} else {
+		_, err = tx.Exec(ctx, deleteVersionSQL, set.Name, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func Up(ctx context.Context, conn *pgxpool.Pool, set Set, opts Options) error {
+	applied, err := getApplied(ctx, conn, set)
+	if err != nil {
+		return err
+	}
+
+	if !opts.DryRun {
+		_, err = conn.Exec(ctx, createSchemaVersionSQL)
+		if err != nil {
+			return err
+		}
+	}
+
+	done := 0
+	for _, migration := range set.Migrations {
+		if opts.limitReached(done) {
+			break
+		}
+
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Fprintf(opts.out(), "-- %s: %04d_%s up\n%s\n", set.Name, migration.Version, migration.Name, migration.Up)
+		} else {
+			err = migrate(ctx, conn, set, migration, true)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(opts.out(), "%s: applied %04d_%s\n", set.Name, migration.Version, migration.Name)
+		}
+
+		done++
+	}
+
+	return nil
+}
+
+func Down(ctx context.Context, conn *pgxpool.Pool, set Set, opts Options) error {
+	applied, err := getApplied(ctx, conn, set)
+	if err != nil {
+		return err
+	}
+
+	done := 0
+	for i := len(set.Migrations) - 1; i >= 0; i-- {
+		if opts.limitReached(done) {
+			break
+		}
+
+		migration := set.Migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Fprintf(opts.out(), "-- %s: %04d_%s down\n%s\n", set.Name, migration.Version, migration.Name, migration.Down)
+		} else {
+			err = migrate(ctx, conn, set, migration, false)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(opts.out(), "%s: reverted %04d_%s\n", set.Name, migration.Version, migration.Name)
+		}
+
+		done++
+	}
+
+	return nil
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+func Status(ctx context.Context, conn *pgxpool.Pool, set Set) ([]MigrationStatus, error) {
+	applied, err := getApplied(ctx, conn, set)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(set.Migrations))
+	for _, migration := range set.Migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+// OnStart brings the schema up to date according to mode before
+// storages are initialized.
+func OnStart(databaseURI string, set Set, mode string) error {
+	opts := Options{Out: log.Writer()}
+
+	switch mode {
+	case ModeOff:
+		return nil
+	case ModeDryRun:
+		opts.DryRun = true
+	case ModeAuto:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownMode, mode)
+	}
+
+	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return Up(context.TODO(), conn, set, opts)
+}
+
+// Command implements `migrate up|down|status [-dry-run] [-n steps]`.
+// Down reverts one migration unless -n is given.
+func Command(databaseURI string, set Set, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return ErrUnknownCommand
+	}
+
+	command := args[0]
+
+	flagSet := flag.NewFlagSet("migrate "+command, flag.ContinueOnError)
+	flagSet.SetOutput(out)
+
+	opts := Options{Out: out}
+	flagSet.BoolVar(&opts.DryRun, "dry-run", false, "Print scripts instead of executing them")
+	flagSet.IntVar(&opts.Steps, "n", 0, "Number of migrations to apply or revert")
+
+	err := flagSet.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch command {
+	case "up":
+		return Up(context.TODO(), conn, set, opts)
+	case "down":
+		if opts.Steps == 0 {
+			opts.Steps = 1
+		}
+
+		return Down(context.TODO(), conn, set, opts)
+	case "status":
+		statuses, err := Status(context.TODO(), conn, set)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied at " + status.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(out, "%s: %04d_%s %s\n", set.Name, status.Version, status.Name, state)
+		}
+
+		return nil
+	}
+
+	return ErrUnknownCommand
+}
@@ -0,0 +1,24 @@
+package migrations_test
+
+import (
+	"testing"
+
+	"github.com/GermanVor/go-tpl/internal/migrations"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedSets(t *testing.T) {
+	for _, set := range []migrations.Set{migrations.Gophermart, migrations.Accrual} {
+		t.Run(set.Name, func(t *testing.T) {
+			require.NotEmpty(t, set.Migrations)
+
+			for i, migration := range set.Migrations {
+				require.NotEmpty(t, migration.Up)
+				require.NotEmpty(t, migration.Down)
+
+				// versions go one by one starting from 1
+				require.Equal(t, uint(i+1), migration.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount of points stored in hundredths.
+// On the wire it is a plain JSON number, e.g. 21.2 or 0.
+type Money int64
+
+const (
+	scale     = 100
+	scaleLen  = 2
+	halfScale = scale / 2
+)
+
+var ErrInvalidMoney = errors.New("invalid money amount")
+
+var decimalRegexp = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)$`)
+
+// Parse reads a decimal string. Digits beyond hundredths are rounded
+// half away from zero.
+func Parse(s string) (Money, error) {
+	str := strings.TrimSpace(s)
+	if !decimalRegexp.MatchString(str) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimPrefix(strings.TrimPrefix(str, "-"), "+")
+
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	roundUp := false
+	if len(fracPart) > scaleLen {
+		roundUp = fracPart[scaleLen] >= '5'
+		fracPart = fracPart[:scaleLen]
+	}
+	fracPart += strings.Repeat("0", scaleLen-len(fracPart))
+
+	cents, err := strconv.ParseInt(fracPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+
+	if roundUp {
+		cents++
+	}
+
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil || units > (math.MaxInt64-cents)/scale {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidMoney, s)
+	}
+
+	m := Money(units*scale + cents)
+
+	if negative {
+		m = -m
+	}
+
+	return m, nil
+}
+
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+func fromFloat(f float64) Money {
+	return Money(math.Round(f * scale))
+}
+
+// String formats money with exactly two fraction digits, e.g. "21.20".
+func (m Money) String() string {
+	sign := ""
+	abs := int64(m)
+	if abs < 0 {
+		sign = "-"
+		abs = -abs
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, abs/scale, abs%scale)
+}
+
+// Percent returns percent of m, rounded half away from zero.
+// percent itself is a Money, so 10.5% is MustParse("10.5").
+func (m Money) Percent(percent Money) Money {
+	product := int64(m) * int64(percent)
+
+	if product < 0 {
+		return Money((product - halfScale*scale) / (scale * scale))
+	}
+
+	return Money((product + halfScale*scale) / (scale * scale))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	str := strings.TrimRight(m.String(), "0")
+	str = strings.TrimSuffix(str, ".")
+
+	return []byte(str), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	if str == "null" {
+		return nil
+	}
+
+	// strict JSON numbers only, quoted amounts were never accepted
+	if _, err := strconv.ParseFloat(str, 64); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMoney, str)
+	}
+
+	if strings.ContainsAny(str, "eE") {
+		f, _ := strconv.ParseFloat(str, 64)
+		*m = fromFloat(f)
+		return nil
+	}
+
+	parsed, err := Parse(str)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner, so DECIMAL columns can be scanned directly.
+func (m *Money) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*m = 0
+	case string:
+		parsed, err := Parse(value)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case []byte:
+		parsed, err := Parse(string(value))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case int64:
+		*m = Money(value * scale)
+	case float64:
+		*m = fromFloat(value)
+	default:
+		return fmt.Errorf("%w: cannot scan %T", ErrInvalidMoney, src)
+	}
+
+	return nil
+}
+
+// Value implements driver.Valuer. The decimal string keeps Postgres
+// arithmetic exact.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
@@ -0,0 +1,84 @@
+package money_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/GermanVor/go-tpl/internal/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	testCases := map[string]money.Money{
+		"0":       0,
+		"21.2":    2120,
+		"110.50":  11050,
+		".5":      50,
+		"-1.5":    -150,
+		"0.005":   1,
+		"0.00499": 0,
+		"-0.005":  -1,
+
+		"92233720368547758.07":  math.MaxInt64,
+		"92233720368547758.065": math.MaxInt64,
+		"-92233720368547758.07": -math.MaxInt64,
+	}
+
+	for str, expected := range testCases {
+		m, err := money.Parse(str)
+		require.NoError(t, err, str)
+		assert.Equal(t, expected, m, str)
+	}
+
+	for _, str := range []string{
+		"", ".", "1.2.3", "--1", "1e3", "abc",
+		"92233720368547758.08", "92233720368547758.075", "92233720368547759", "-92233720368547758.08",
+	} {
+		_, err := money.Parse(str)
+		assert.ErrorIs(t, err, money.ErrInvalidMoney, str)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type object struct {
+		Sum     money.Money `json:"sum"`
+		Accrual money.Money `json:"accrual,omitempty"`
+	}
+
+	bytes, err := json.Marshal(object{Sum: money.MustParse("21.20")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"sum":21.2}`, string(bytes))
+
+	obj := object{}
+	require.NoError(t, json.Unmarshal([]byte(`{"sum":0.1,"accrual":729.98}`), &obj))
+	assert.Equal(t, money.MustParse("0.1"), obj.Sum)
+	assert.Equal(t, money.MustParse("729.98"), obj.Accrual)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"sum":"1"}`), &obj))
+}
+
+func TestPercent(t *testing.T) {
+	// float64 gives 11.049999999999999 here
+	assert.Equal(t, money.MustParse("11.05"), money.MustParse("110.5").Percent(money.MustParse("10")))
+	assert.Equal(t, money.MustParse("0.01"), money.MustParse("0.15").Percent(money.MustParse("5")))
+	assert.Equal(t, money.MustParse("-0.01"), money.MustParse("-0.15").Percent(money.MustParse("5")))
+}
+
+func TestScan(t *testing.T) {
+	m := money.Money(0)
+
+	require.NoError(t, m.Scan("0.30"))
+	assert.Equal(t, money.Money(30), m)
+
+	require.NoError(t, m.Scan(int64(3)))
+	assert.Equal(t, money.Money(300), m)
+
+	require.NoError(t, m.Scan(nil))
+	assert.Equal(t, money.Money(0), m)
+
+	value, err := money.MustParse("1.1").Value()
+	require.NoError(t, err)
+	assert.Equal(t, "1.10", value)
+}
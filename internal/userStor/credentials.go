@@ -0,0 +1,213 @@
+package userstor
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	minLoginLen    = 3
+	maxLoginLen    = 32
+	minPasswordLen = 8
+	maxPasswordLen = 128
+)
+
+// Codes of ValidationError.
+const (
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeTooWeak           = "too_weak"
+	CodeContainsLogin     = "contains_login"
+)
+
+var ErrInvalidCredentials = errors.New("invalid login or password")
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every rule the login and the password break,
+// errors.Is matches it with ErrInvalidCredentials.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Field+": "+err.Message)
+	}
+
+	return ErrInvalidCredentials.Error() + ": " + strings.Join(messages, "; ")
+}
+
+func (errs ValidationErrors) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
+
+// normalizeLogin returns the login as it is stored and shown, so "ｑｗｅｒｔｙ"
+// and "qwerty" are the same login.
+func normalizeLogin(login string) string {
+	return norm.NFKC.String(login)
+}
+
+// getLogin is the lookup key of the login, case-insensitive.
+func getLogin(login string) string {
+	return getLegacyLogin(cases.Fold().String(normalizeLogin(login)))
+}
+
+// getLegacyLogin is the key of users registered before logins were
+// normalized, see storageObject.logIn.
+func getLegacyLogin(login string) string {
+	loginHash := sha1.Sum([]byte(login))
+	return hex.EncodeToString(loginHash[:])
+}
+
+// getLoginKeys returns the keys a user of the login may be stored under,
+// the case-insensitive one first.
+func getLoginKeys(login string) []string {
+	keys := []string{getLogin(login)}
+	if legacyKey := getLegacyLogin(login); legacyKey != keys[0] {
+		keys = append(keys, legacyKey)
+	}
+
+	return keys
+}
+
+// storedUser is a row of users found by a login key.
+type storedUser struct {
+	userID        int
+	isLegacyLogin bool
+	passStr       string
+	saltStr       string
+
+	hash *passwordHash
+}
+
+// findUser returns the user of the login with the password, lookup returns
+// nil for unknown keys. The case-insensitive key of an old login may belong
+// to somebody else, e.g. old "Bob" and "bob", so every key is tried.
+func findUser(login string, pass string, policy HashPolicy, lookup func(key string) (*storedUser, error)) (*storedUser, error) {
+	found := false
+
+	for _, key := range getLoginKeys(login) {
+		user, err := lookup(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if user == nil {
+			continue
+		}
+
+		found = true
+
+		user.hash, err = loadPasswordHash(user.passStr, user.saltStr)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := user.hash.verify(pass)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return user, nil
+		}
+	}
+
+	if !found {
+		policy.verifyUnknown(pass)
+	}
+
+	return nil, ErrUnknownUser
+}
+
+// isLoginOccupied checks every key of the login, see getLoginKeys. Old
+// logins differing in case are only found once their users log in.
+func isLoginOccupied(login string, exists func(key string) (bool, error)) (bool, error) {
+	for _, key := range getLoginKeys(login) {
+		ok, err := exists(key)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+func isLoginRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-'
+}
+
+func validateLogin(login string) ValidationErrors {
+	errs := ValidationErrors{}
+
+	switch length := utf8.RuneCountInString(login); {
+	case length < minLoginLen:
+		errs = append(errs, ValidationError{"login", CodeTooShort, "login must have at least 3 characters"})
+	case length > maxLoginLen:
+		errs = append(errs, ValidationError{"login", CodeTooLong, "login must have at most 32 characters"})
+	}
+
+	if strings.IndexFunc(login, func(r rune) bool { return !isLoginRune(r) }) != -1 {
+		errs = append(errs, ValidationError{
+			"login",
+			CodeInvalidCharacters,
+			"login may contain only letters, digits, '.', '_' and '-'",
+		})
+	}
+
+	return errs
+}
+
+// validatePassword wants a letter and something else than letters, and
+// the password must not repeat the login.
+func validatePassword(pass string, login string) ValidationErrors {
+	errs := ValidationErrors{}
+
+	switch length := utf8.RuneCountInString(pass); {
+	case length < minPasswordLen:
+		errs = append(errs, ValidationError{"password", CodeTooShort, "password must have at least 8 characters"})
+	case length > maxPasswordLen:
+		errs = append(errs, ValidationError{"password", CodeTooLong, "password must have at most 128 characters"})
+	}
+
+	hasLetter := strings.IndexFunc(pass, unicode.IsLetter) != -1
+	hasOther := strings.IndexFunc(pass, func(r rune) bool { return !unicode.IsLetter(r) }) != -1
+	if !hasLetter || !hasOther {
+		errs = append(errs, ValidationError{
+			"password",
+			CodeTooWeak,
+			"password must contain a letter and a digit or a symbol",
+		})
+	}
+
+	fold := cases.Fold()
+	if login != "" && strings.Contains(fold.String(normalizeLogin(pass)), fold.String(normalizeLogin(login))) {
+		errs = append(errs, ValidationError{"password", CodeContainsLogin, "password must not contain the login"})
+	}
+
+	return errs
+}
+
+// validateCredentials returns the login to store or ValidationErrors.
+func validateCredentials(login string, pass string) (string, error) {
+	displayLogin := normalizeLogin(login)
+
+	errs := append(validateLogin(displayLogin), validatePassword(pass, displayLogin)...)
+	if len(errs) != 0 {
+		return "", errs
+	}
+
+	return displayLogin, nil
+}
@@ -0,0 +1,122 @@
+package userstor
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getCodes(err error) []string {
+	validationErrs := ValidationErrors{}
+	if !errors.As(err, &validationErrs) {
+		return nil
+	}
+
+	codes := []string{}
+	for _, validationErr := range validationErrs {
+		codes = append(codes, validationErr.Field+":"+validationErr.Code)
+	}
+
+	return codes
+}
+
+func TestValidateCredentials(t *testing.T) {
+	displayLogin, err := validateCredentials("Ｑｗｅｒｔｙ", "Secret-2022")
+	require.NoError(t, err)
+	assert.Equal(t, "Qwerty", displayLogin)
+
+	testCases := []struct {
+		login string
+		pass  string
+		codes []string
+	}{
+		{"Иван_Petrov-1.0", "пароль-2022", nil},
+		{"Qw", "Secret-2022", []string{"login:too_short"}},
+		{"Qwertyqwertyqwertyqwertyqwertyqwe", "Secret-2022", []string{"login:too_long"}},
+		{"Qwer ty", "Secret-2022", []string{"login:invalid_characters"}},
+		{"Qwer@ty", "Secret-2022", []string{"login:invalid_characters"}},
+		{"Qwerty", "Secret1", []string{"password:too_short"}},
+		{"Qwerty", "SecretSecret", []string{"password:too_weak"}},
+		{"Qwerty", "2022202220", []string{"password:too_weak"}},
+		{"Qwerty", "qWERTY-2022", []string{"password:contains_login"}},
+		{"", "", []string{"login:too_short", "password:too_short", "password:too_weak"}},
+	}
+
+	for _, testCase := range testCases {
+		_, err := validateCredentials(testCase.login, testCase.pass)
+		assert.Equal(t, testCase.codes, getCodes(err), testCase.login, testCase.pass)
+
+		if testCase.codes != nil {
+			assert.ErrorIs(t, err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestGetLogin(t *testing.T) {
+	assert.Equal(t, getLogin("qwerty"), getLogin("QWERTY"))
+	assert.Equal(t, getLogin("qwerty"), getLogin("Ｑｗｅｒｔｙ"))
+	assert.Equal(t, getLegacyLogin("qwerty"), getLogin("qwerty"))
+	assert.NotEqual(t, getLegacyLogin("Qwerty"), getLogin("Qwerty"))
+}
+
+func TestFindUserLegacyLogin(t *testing.T) {
+	hash := func(pass string) string {
+		passStr, err := testScryptPolicy.hash(pass)
+		require.NoError(t, err)
+
+		return passStr
+	}
+
+	// old "bob" is stored under the case-insensitive key of old "Bob"
+	users := map[string]*storedUser{
+		getLegacyLogin("bob"): {userID: 1, isLegacyLogin: true, passStr: hash("Secret-bob")},
+		getLegacyLogin("Bob"): {userID: 2, isLegacyLogin: true, passStr: hash("Secret-Bob")},
+	}
+
+	lookup := func(key string) (*storedUser, error) {
+		if user, ok := users[key]; ok {
+			copied := *user
+			return &copied, nil
+		}
+
+		return nil, nil
+	}
+
+	user, err := findUser("Bob", "Secret-Bob", testScryptPolicy, lookup)
+	require.NoError(t, err)
+	assert.Equal(t, 2, user.userID)
+
+	user, err = findUser("bob", "Secret-bob", testScryptPolicy, lookup)
+	require.NoError(t, err)
+	assert.Equal(t, 1, user.userID)
+
+	_, err = findUser("Bob", "Secret-2022", testScryptPolicy, lookup)
+	assert.ErrorIs(t, err, ErrUnknownUser)
+
+	_, err = findUser("alice", "Secret-2022", testScryptPolicy, lookup)
+	assert.ErrorIs(t, err, ErrUnknownUser)
+}
+
+func TestIsLoginOccupiedLegacyLogin(t *testing.T) {
+	keys := map[string]bool{getLegacyLogin("Qwerty"): true}
+	exists := func(key string) (bool, error) {
+		return keys[key], nil
+	}
+
+	occupied, err := isLoginOccupied("Qwerty", exists)
+	require.NoError(t, err)
+	assert.True(t, occupied)
+
+	occupied, err = isLoginOccupied("Asdfgh", exists)
+	require.NoError(t, err)
+	assert.False(t, occupied)
+
+	// once the old user logs in, the login moves to the case-insensitive key
+	keys = map[string]bool{getLogin("Qwerty"): true}
+
+	occupied, err = isLoginOccupied("qwerty", exists)
+	require.NoError(t, err)
+	assert.True(t, occupied)
+}
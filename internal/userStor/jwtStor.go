@@ -0,0 +1,106 @@
+package userstor
+
+import (
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/jwt"
+)
+
+// JWTStorage hands out signed JWTs instead of opaque session tokens.
+// GetSession checks the signature and the expiry in process and asks the
+// wrapped storage only whether the session was revoked by a logout.
+//
+// A JWT can not be prolonged, so sessions do not slide in this mode.
+type JWTStorage struct {
+	Interface
+
+	keys *jwt.KeySet
+}
+
+func InitJWT(stor Interface, keys *jwt.KeySet) *JWTStorage {
+	return &JWTStorage{
+		Interface: stor,
+		keys:      keys,
+	}
+}
+
+func (stor *JWTStorage) sign(session *Session, err error) (*Session, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := stor.keys.Sign(jwt.Claims{
+		UserID:    session.UserID,
+		SessionID: session.Token,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Token:     token,
+		UserID:    session.UserID,
+		ExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+func (stor *JWTStorage) SignIn(login string, pass string, device string) (*Session, error) {
+	return stor.sign(stor.Interface.SignIn(login, pass, device))
+}
+
+func (stor *JWTStorage) LogIn(login string, pass string, device string, ip string) (*Session, error) {
+	return stor.sign(stor.Interface.LogIn(login, pass, device, ip))
+}
+
+func (stor *JWTStorage) GetSession(sessionToken string) (*Session, error) {
+	claims, err := stor.keys.Verify(sessionToken, time.Now())
+	if err != nil {
+		return nil, ErrUnknownSessionToken
+	}
+
+	revoked, err := stor.Interface.IsSessionRevoked(claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, ErrUnknownSessionToken
+	}
+
+	return &Session{
+		Token:     sessionToken,
+		UserID:    claims.UserID,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+// LogOut accepts expired tokens too, there is just nothing to revoke in
+// tokens signed by someone else.
+func (stor *JWTStorage) LogOut(sessionToken string) error {
+	claims, err := stor.keys.Parse(sessionToken)
+	if err != nil {
+		return nil
+	}
+
+	return stor.Interface.LogOut(claims.SessionID)
+}
+
+func (stor *JWTStorage) IsSessionRevoked(sessionToken string) (bool, error) {
+	claims, err := stor.keys.Parse(sessionToken)
+	if err != nil {
+		return true, nil
+	}
+
+	return stor.Interface.IsSessionRevoked(claims.SessionID)
+}
+
+func (stor *JWTStorage) ChangePassword(userID string, sessionToken string, oldPass string, newPass string) error {
+	claims, err := stor.keys.Parse(sessionToken)
+	if err != nil {
+		return ErrUnknownSessionToken
+	}
+
+	return stor.Interface.ChangePassword(userID, claims.SessionID, oldPass, newPass)
+}
@@ -0,0 +1,227 @@
+package userstor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrTooManyAttempts = errors.New("too many failed login attempts")
+
+// LoginBlockedError is returned by LogIn while the login or the address is
+// blocked, errors.Is matches it with ErrTooManyAttempts.
+type LoginBlockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyAttempts, e.RetryAfter)
+}
+
+func (e *LoginBlockedError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+const (
+	// delay after the first failure which is not free
+	loginBaseDelay = time.Second
+	// the longest block, reached after lockoutAfter failures
+	loginLockout = 15 * time.Minute
+	// counters without failures for this long start from zero
+	loginFailuresTTL = time.Hour
+)
+
+type attemptsPolicy struct {
+	// failures which do not block
+	free uint
+	// failures after which the key is locked out for loginLockout
+	lockoutAfter uint
+}
+
+var (
+	loginAttemptsPolicy = attemptsPolicy{free: 3, lockoutAfter: 10}
+	// one address may serve many users behind a NAT
+	ipAttemptsPolicy = attemptsPolicy{free: 20, lockoutAfter: 100}
+)
+
+// getDelay doubles the block with every failure over the free ones.
+func (policy attemptsPolicy) getDelay(failures uint) time.Duration {
+	if failures <= policy.free {
+		return 0
+	}
+
+	if failures >= policy.lockoutAfter {
+		return loginLockout
+	}
+
+	delay := loginBaseDelay
+	for i := policy.free + 1; i < failures && delay < loginLockout; i++ {
+		delay *= 2
+	}
+
+	if delay > loginLockout {
+		return loginLockout
+	}
+
+	return delay
+}
+
+type loginAttempts interface {
+	// addAttempt counts an attempt as a failure before it is made and
+	// blocks the key for the policy delay, so concurrent attempts see it.
+	// It returns the block left by earlier failures, a blocked attempt is
+	// not counted.
+	addAttempt(key string, policy attemptsPolicy) (time.Duration, error)
+	// removeAttempt takes back an attempt which did not fail and the block
+	// it made.
+	removeAttempt(key string) error
+	resetFailures(key string) error
+}
+
+func getLoginAttemptKey(login string) string {
+	return "login:" + getLogin(login)
+}
+
+func getIPAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// throttleLogIn refuses to run logIn, and so scrypt, while the login or the
+// address is blocked. Failed attempts of unknown logins count the same way.
+func throttleLogIn(
+	attempts loginAttempts,
+	login string,
+	ip string,
+	logIn func() (*Session, error),
+) (*Session, error) {
+	loginKey, ipKey := getLoginAttemptKey(login), getIPAttemptKey(ip)
+
+	blockedFor, err := attempts.addAttempt(loginKey, loginAttemptsPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockedFor > 0 {
+		return nil, &LoginBlockedError{RetryAfter: blockedFor}
+	}
+
+	blockedFor, err = attempts.addAttempt(ipKey, ipAttemptsPolicy)
+	if err != nil || blockedFor > 0 {
+		if removeErr := attempts.removeAttempt(loginKey); removeErr != nil {
+			return nil, removeErr
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, &LoginBlockedError{RetryAfter: blockedFor}
+	}
+
+	session, err := logIn()
+	if err != nil {
+		if errors.Is(err, ErrUnknownUser) {
+			return nil, err
+		}
+
+		if removeErr := attempts.removeAttempt(loginKey); removeErr != nil {
+			return nil, removeErr
+		}
+
+		if removeErr := attempts.removeAttempt(ipKey); removeErr != nil {
+			return nil, removeErr
+		}
+
+		return nil, err
+	}
+
+	// the address keeps its failures, a stolen password must not reset them
+	err = attempts.resetFailures(loginKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = attempts.removeAttempt(ipKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+const (
+	// INSERT INTO loginAttempts (attemptKey, failures, updated_at) VALUES ($1, 1, NOW())
+	// ON CONFLICT (attemptKey) DO UPDATE SET failures=failures+1 or 1 if the last failure
+	// was more than $2 ago, updated_at=NOW() WHERE blocked_until<=NOW() RETURNING failures
+	//
+	// the row stays locked until the block is set, no rows if the key is blocked
+	addAttemptSQL = "INSERT INTO loginAttempts (attemptKey, failures, updated_at) VALUES ($1, 1, NOW()) " +
+		"ON CONFLICT (attemptKey) DO UPDATE SET " +
+		"failures=CASE WHEN loginAttempts.updated_at<NOW()-make_interval(secs => $2) " +
+		"THEN 1 ELSE loginAttempts.failures+1 END, updated_at=NOW() " +
+		"WHERE loginAttempts.blocked_until<=NOW() " +
+		"RETURNING failures"
+
+	// SELECT GREATEST(EXTRACT(EPOCH FROM blocked_until-NOW()), 0) FROM loginAttempts WHERE attemptKey=$1
+	getBlockedForSQL = "SELECT GREATEST(EXTRACT(EPOCH FROM blocked_until-NOW()), 0)::FLOAT8 " +
+		"FROM loginAttempts WHERE attemptKey=$1"
+
+	// UPDATE loginAttempts SET blocked_until=NOW()+$2 WHERE attemptKey=$1
+	blockAttemptKeySQL = "UPDATE loginAttempts SET blocked_until=NOW()+make_interval(secs => $2) " +
+		"WHERE attemptKey=$1"
+
+	// UPDATE loginAttempts SET failures=failures-1, blocked_until=NOW() WHERE attemptKey=$1
+	removeAttemptSQL = "UPDATE loginAttempts SET failures=GREATEST(failures-1, 0), blocked_until=NOW() " +
+		"WHERE attemptKey=$1"
+
+	// DELETE FROM loginAttempts WHERE attemptKey=$1
+	resetFailuresSQL = "DELETE FROM loginAttempts WHERE attemptKey=$1"
+)
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+func (stor *storageObject) addAttempt(key string, policy attemptsPolicy) (time.Duration, error) {
+	blockedFor := time.Duration(0)
+
+	err := stor.dbPool.BeginFunc(context.TODO(), func(tx pgx.Tx) error {
+		failures := uint(0)
+		err := tx.QueryRow(context.TODO(), addAttemptSQL, key, loginFailuresTTL.Seconds()).Scan(&failures)
+		if errors.Is(err, pgx.ErrNoRows) {
+			seconds := float64(0)
+			err = tx.QueryRow(context.TODO(), getBlockedForSQL, key).Scan(&seconds)
+			blockedFor = secondsToDuration(seconds)
+
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		delay := policy.getDelay(failures)
+		if delay == 0 {
+			return nil
+		}
+
+		_, err = tx.Exec(context.TODO(), blockAttemptKeySQL, key, delay.Seconds())
+		return err
+	})
+
+	return blockedFor, err
+}
+
+func (stor *storageObject) removeAttempt(key string) error {
+	_, err := stor.dbPool.Exec(context.TODO(), removeAttemptSQL, key)
+	return err
+}
+
+func (stor *storageObject) resetFailures(key string) error {
+	_, err := stor.dbPool.Exec(context.TODO(), resetFailuresSQL, key)
+	return err
+}
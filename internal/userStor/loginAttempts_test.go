@@ -0,0 +1,54 @@
+package userstor
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottleLogInConcurrentAttempts(t *testing.T) {
+	stor := InitMemory(gophermartStor.InitMemory("", "", 0), DefaultSessionTTL, testScryptPolicy)
+
+	logIns := int32(0)
+	failingLogIn := func() (*Session, error) {
+		atomic.AddInt32(&logIns, 1)
+		time.Sleep(50 * time.Millisecond)
+
+		return nil, ErrUnknownUser
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			throttleLogIn(stor, "qwerty", "127.0.0.1", failingLogIn)
+		}()
+	}
+	wg.Wait()
+
+	// the free failures and the one which blocks the login
+	assert.Equal(t, int32(loginAttemptsPolicy.free+1), logIns)
+
+	_, err := throttleLogIn(stor, "qwerty", "127.0.0.1", failingLogIn)
+	assert.ErrorIs(t, err, ErrTooManyAttempts)
+}
+
+func TestThrottleLogInTakesBackSucceeded(t *testing.T) {
+	stor := InitMemory(gophermartStor.InitMemory("", "", 0), DefaultSessionTTL, testScryptPolicy)
+
+	for i := uint(0); i < loginAttemptsPolicy.free+1; i++ {
+		_, err := throttleLogIn(stor, "qwerty"+string(rune('a'+i)), "127.0.0.1", func() (*Session, error) {
+			return &Session{}, nil
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, uint(0), stor.attempts[getIPAttemptKey("127.0.0.1")].failures)
+	assert.NotContains(t, stor.attempts, getLoginAttemptKey("qwertya"))
+}
@@ -0,0 +1,491 @@
+package userstor
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GermanVor/go-tpl/internal/common"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"golang.org/x/text/cases"
+)
+
+type memoryUser struct {
+	userID string
+	// the login to show, see normalizeLogin
+	login        string
+	pass         string
+	role         Role
+	registeredAt time.Time
+}
+
+// MemoryStorage keeps users and their sessions in process memory.
+type MemoryStorage struct {
+	Interface
+
+	mux sync.RWMutex
+	// guards expiresAt of sessions, GetSession slides it under the read
+	// lock
+	expiryMux sync.Mutex
+
+	// users by login hash
+	users map[string]*memoryUser
+	// sessions by token
+	sessions map[string]*memorySession
+
+	lastUserID int
+
+	userData gophermartStor.UserData
+
+	sessionTTL time.Duration
+	hashPolicy HashPolicy
+
+	attemptsMux sync.Mutex
+	// failed logins by attempt key
+	attempts map[string]*memoryLoginAttempts
+}
+
+type memoryLoginAttempts struct {
+	failures     uint
+	blockedUntil time.Time
+	updatedAt    time.Time
+}
+
+type memorySession struct {
+	userID    string
+	device    string
+	expiresAt time.Time
+}
+
+func InitMemory(userData gophermartStor.UserData, sessionTTL time.Duration, hashPolicy HashPolicy) *MemoryStorage {
+	log.Println("Created in-memory userStor")
+
+	return &MemoryStorage{
+		users:      make(map[string]*memoryUser),
+		sessions:   make(map[string]*memorySession),
+		userData:   userData,
+		sessionTTL: sessionTTL,
+		hashPolicy: hashPolicy,
+		attempts:   make(map[string]*memoryLoginAttempts),
+	}
+}
+
+// createSession must be called with the lock held.
+func (stor *MemoryStorage) createSession(userID string, device string) *Session {
+	session := &Session{
+		Token:     createSessionToken(),
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(stor.sessionTTL),
+	}
+
+	stor.sessions[session.Token] = &memorySession{
+		userID:    userID,
+		device:    getDevice(device),
+		expiresAt: session.ExpiresAt,
+	}
+
+	return session
+}
+
+func (stor *MemoryStorage) SignIn(login string, pass string, device string) (*Session, error) {
+	displayLogin, err := validateCredentials(login, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	loginStr := getLogin(displayLogin)
+	passStr, err := stor.hashPolicy.hash(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	occupied, _ := isLoginOccupied(displayLogin, func(key string) (bool, error) {
+		_, ok := stor.users[key]
+		return ok, nil
+	})
+	if occupied {
+		return nil, ErrLoginOccupied
+	}
+
+	// userID is a SERIAL column in Postgres, so it starts from 1
+	userID := strconv.Itoa(stor.lastUserID + 1)
+
+	err = stor.userData.CreateBalance(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stor.lastUserID++
+	stor.users[loginStr] = &memoryUser{
+		userID:       userID,
+		login:        displayLogin,
+		pass:         passStr,
+		role:         RoleUser,
+		registeredAt: time.Now(),
+	}
+
+	return stor.createSession(userID, device), nil
+}
+
+func (stor *MemoryStorage) LogIn(login string, pass string, device string, ip string) (*Session, error) {
+	return throttleLogIn(stor, login, ip, func() (*Session, error) {
+		return stor.logIn(login, pass, device)
+	})
+}
+
+func (stor *MemoryStorage) addAttempt(key string, policy attemptsPolicy) (time.Duration, error) {
+	stor.attemptsMux.Lock()
+	defer stor.attemptsMux.Unlock()
+
+	now := time.Now()
+
+	attempts, ok := stor.attempts[key]
+	if ok && attempts.blockedUntil.After(now) {
+		return attempts.blockedUntil.Sub(now), nil
+	}
+
+	if !ok || attempts.updatedAt.Before(now.Add(-loginFailuresTTL)) {
+		attempts = &memoryLoginAttempts{}
+		stor.attempts[key] = attempts
+	}
+
+	attempts.failures++
+	attempts.updatedAt = now
+
+	if delay := policy.getDelay(attempts.failures); delay > 0 {
+		attempts.blockedUntil = now.Add(delay)
+	}
+
+	return 0, nil
+}
+
+func (stor *MemoryStorage) removeAttempt(key string) error {
+	stor.attemptsMux.Lock()
+	defer stor.attemptsMux.Unlock()
+
+	if attempts, ok := stor.attempts[key]; ok {
+		if attempts.failures > 0 {
+			attempts.failures--
+		}
+
+		attempts.blockedUntil = time.Now()
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) resetFailures(key string) error {
+	stor.attemptsMux.Lock()
+	defer stor.attemptsMux.Unlock()
+
+	delete(stor.attempts, key)
+
+	return nil
+}
+
+func (stor *MemoryStorage) logIn(login string, pass string, device string) (*Session, error) {
+	stor.mux.RLock()
+	memUser, ok := stor.users[getLogin(login)]
+	user := memoryUser{}
+	if ok {
+		// ChangePassword updates the user in place
+		user = *memUser
+	}
+	stor.mux.RUnlock()
+
+	if !ok {
+		stor.hashPolicy.verifyUnknown(pass)
+		return nil, ErrUnknownUser
+	}
+
+	storedHash, err := loadPasswordHash(user.pass, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err = storedHash.verify(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+
+	newPassStr := ""
+	if storedHash.isWeakerThan(stor.hashPolicy) {
+		newPassStr, err = stor.hashPolicy.hash(pass)
+		if err != nil {
+			log.Println("password rehash error", user.userID, err)
+		}
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	// a concurrent password change wins
+	if memUser.pass == user.pass && newPassStr != "" {
+		memUser.pass = newPassStr
+	}
+
+	now := time.Now()
+	for token, session := range stor.sessions {
+		if session.userID == user.userID && !session.expiresAt.After(now) {
+			delete(stor.sessions, token)
+		}
+	}
+
+	return stor.createSession(user.userID, device), nil
+}
+
+func (stor *MemoryStorage) GetSession(sessionToken string) (*Session, error) {
+	stor.mux.RLock()
+	memSession, ok := stor.sessions[sessionToken]
+	session := (*Session)(nil)
+	if ok {
+		session = stor.prolongSession(sessionToken, memSession)
+	}
+	stor.mux.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownSessionToken
+	}
+
+	if session == nil {
+		stor.mux.Lock()
+		defer stor.mux.Unlock()
+
+		delete(stor.sessions, sessionToken)
+		return nil, ErrUnknownSessionToken
+	}
+
+	return session, nil
+}
+
+// prolongSession slides the expiry of the session, it returns nil if the
+// session has expired. It must be called with the read lock held.
+func (stor *MemoryStorage) prolongSession(sessionToken string, memSession *memorySession) *Session {
+	stor.expiryMux.Lock()
+	defer stor.expiryMux.Unlock()
+
+	now := time.Now()
+	if !memSession.expiresAt.After(now) {
+		return nil
+	}
+
+	memSession.expiresAt = now.Add(stor.sessionTTL)
+
+	return &Session{
+		Token:     sessionToken,
+		UserID:    memSession.userID,
+		ExpiresAt: memSession.expiresAt,
+	}
+}
+
+func (stor *MemoryStorage) LogOut(sessionToken string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	delete(stor.sessions, sessionToken)
+
+	return nil
+}
+
+func (stor *MemoryStorage) LogOutEverywhere(userID string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	for token, session := range stor.sessions {
+		if session.userID == userID {
+			delete(stor.sessions, token)
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) IsSessionRevoked(sessionToken string) (bool, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	_, ok := stor.sessions[sessionToken]
+
+	return !ok, nil
+}
+
+// getUser must be called with the lock held.
+func (stor *MemoryStorage) getUser(userID string) (string, *memoryUser) {
+	for loginStr, user := range stor.users {
+		if user.userID == userID {
+			return loginStr, user
+		}
+	}
+
+	return "", nil
+}
+
+func (stor *MemoryStorage) ChangePassword(userID string, sessionToken string, oldPass string, newPass string) error {
+	stor.mux.RLock()
+	_, memUser := stor.getUser(userID)
+	user := memoryUser{}
+	if memUser != nil {
+		user = *memUser
+	}
+	stor.mux.RUnlock()
+
+	if memUser == nil {
+		return ErrUnknownUser
+	}
+
+	// the hashes are computed without the lock, so sessions of other
+	// users are not held up
+	storedHash, err := loadPasswordHash(user.pass, "")
+	if err != nil {
+		return err
+	}
+
+	ok, err := storedHash.verify(oldPass)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrWrongPassword
+	}
+
+	if errs := validatePassword(newPass, user.login); len(errs) != 0 {
+		return errs
+	}
+
+	newPassStr, err := stor.hashPolicy.hash(newPass)
+	if err != nil {
+		return err
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	_, memUser = stor.getUser(userID)
+	if memUser == nil {
+		return ErrUnknownUser
+	}
+
+	// oldPass was checked against a password changed since
+	if memUser.pass != user.pass {
+		return ErrWrongPassword
+	}
+
+	memUser.pass = newPassStr
+
+	for token, session := range stor.sessions {
+		if session.userID == userID && token != sessionToken {
+			delete(stor.sessions, token)
+		}
+	}
+
+	return nil
+}
+
+func (stor *MemoryStorage) GetUser(userID string) (*User, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	_, user := stor.getUser(userID)
+	if user == nil {
+		return nil, ErrUnknownUser
+	}
+
+	return user.toUser(), nil
+}
+
+func (user *memoryUser) toUser() *User {
+	return &User{
+		UserID:       user.userID,
+		Login:        user.login,
+		Role:         user.role,
+		RegisteredAt: user.registeredAt,
+	}
+}
+
+func (stor *MemoryStorage) SearchUsers(query string, page common.Page) ([]*User, error) {
+	stor.mux.RLock()
+	defer stor.mux.RUnlock()
+
+	fold := cases.Fold()
+	foldedQuery := fold.String(query)
+
+	found := make([]*User, 0)
+	for _, user := range stor.users {
+		if query == "" || user.userID == query || strings.Contains(fold.String(user.login), foldedQuery) {
+			found = append(found, user.toUser())
+		}
+	}
+
+	// ORDER BY userID
+	sort.Slice(found, func(i, j int) bool {
+		left, _ := strconv.Atoi(found[i].UserID)
+		right, _ := strconv.Atoi(found[j].UserID)
+
+		return left < right
+	})
+
+	if page.Offset >= uint64(len(found)) {
+		return make([]*User, 0), nil
+	}
+
+	found = found[page.Offset:]
+	if uint64(len(found)) > page.Limit {
+		found = found[:page.Limit]
+	}
+
+	return found, nil
+}
+
+func (stor *MemoryStorage) SetRole(login string, role Role) error {
+	if role != RoleUser && role != RoleAdmin {
+		return ErrUnknownRole
+	}
+
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	user, ok := stor.users[getLogin(login)]
+	if !ok {
+		return ErrUnknownUser
+	}
+
+	user.role = role
+
+	return nil
+}
+
+func (stor *MemoryStorage) DeleteUser(userID string) error {
+	stor.mux.Lock()
+	defer stor.mux.Unlock()
+
+	loginStr, user := stor.getUser(userID)
+	if user == nil {
+		return ErrUnknownUser
+	}
+
+	err := stor.userData.DeleteUserData(userID)
+	if err != nil {
+		return err
+	}
+
+	delete(stor.users, loginStr)
+
+	for token, session := range stor.sessions {
+		if session.userID == userID {
+			delete(stor.sessions, token)
+		}
+	}
+
+	return nil
+}
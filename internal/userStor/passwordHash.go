@@ -0,0 +1,286 @@
+package userstor
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	HashScrypt   = "scrypt"
+	HashArgon2id = "argon2id"
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Parameter names follow the PHC string format, e.g.
+// $scrypt$ln=14,r=8,p=1$<salt>$<hash> or $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+var hashParamNames = map[string][]string{
+	// log2 N, block size, parallelism
+	HashScrypt: {"ln", "r", "p"},
+	// memory in KiB, iterations, parallelism
+	HashArgon2id: {"m", "t", "p"},
+}
+
+var hashKeyLens = map[string]int{
+	HashScrypt:   64,
+	HashArgon2id: 32,
+}
+
+// HashPolicy is the algorithm and the cost of new password hashes.
+type HashPolicy struct {
+	Algorithm string
+	Params    map[string]uint32
+}
+
+// DefaultHashPolicy is the cost getPass used before hashes became self-describing.
+var DefaultHashPolicy = HashPolicy{
+	Algorithm: HashScrypt,
+	Params:    map[string]uint32{"ln": 14, "r": 8, "p": 1},
+}
+
+var defaultArgon2idParams = map[string]uint32{"m": 64 * 1024, "t": 3, "p": 4}
+
+func parseHashParams(algorithm string, paramsStr string) (map[string]uint32, error) {
+	names, ok := hashParamNames[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown algorithm %q", ErrInvalidPasswordHash, algorithm)
+	}
+
+	params := make(map[string]uint32, len(names))
+	for _, param := range strings.Split(paramsStr, ",") {
+		name, valueStr, _ := strings.Cut(param, "=")
+
+		value, err := strconv.ParseUint(valueStr, 10, 32)
+		if err != nil || value == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPasswordHash, param)
+		}
+
+		params[name] = uint32(value)
+	}
+
+	for _, name := range names {
+		if _, ok := params[name]; !ok {
+			return nil, fmt.Errorf("%w: %s misses %s", ErrInvalidPasswordHash, algorithm, name)
+		}
+	}
+
+	if len(params) != len(names) {
+		return nil, fmt.Errorf("%w: unknown %s parameters %q", ErrInvalidPasswordHash, algorithm, paramsStr)
+	}
+
+	return params, nil
+}
+
+// ParseHashPolicy reads the policy from configuration, e.g. "argon2id" and
+// "m=65536,t=3,p=4". Empty params mean the defaults of the algorithm.
+func ParseHashPolicy(algorithm string, paramsStr string) (HashPolicy, error) {
+	if paramsStr == "" {
+		switch algorithm {
+		case HashScrypt:
+			return DefaultHashPolicy, nil
+		case HashArgon2id:
+			return HashPolicy{Algorithm: HashArgon2id, Params: defaultArgon2idParams}, nil
+		}
+	}
+
+	params, err := parseHashParams(algorithm, paramsStr)
+	if err != nil {
+		return HashPolicy{}, err
+	}
+
+	policy := HashPolicy{Algorithm: algorithm, Params: params}
+
+	// refuse parameters which fail on every hash
+	_, err = policy.hash("")
+	if err != nil {
+		return HashPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+type passwordHash struct {
+	algorithm string
+	params    map[string]uint32
+	salt      []byte
+	key       []byte
+
+	// hex scrypt key with the salt in a separate column
+	legacy bool
+}
+
+func deriveKey(algorithm string, params map[string]uint32, pass string, salt []byte, keyLen int) ([]byte, error) {
+	switch algorithm {
+	case HashScrypt:
+		if params["ln"] >= 32 {
+			return nil, fmt.Errorf("%w: ln=%d", ErrInvalidPasswordHash, params["ln"])
+		}
+
+		return scrypt.Key([]byte(pass), salt, 1<<params["ln"], int(params["r"]), int(params["p"]), keyLen)
+	case HashArgon2id:
+		if params["p"] > 255 {
+			return nil, fmt.Errorf("%w: p=%d", ErrInvalidPasswordHash, params["p"])
+		}
+
+		return argon2.IDKey([]byte(pass), salt, params["t"], params["m"], uint8(params["p"]), uint32(keyLen)), nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown algorithm %q", ErrInvalidPasswordHash, algorithm)
+}
+
+func (policy HashPolicy) hash(pass string) (string, error) {
+	salt, err := createSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := deriveKey(policy.Algorithm, policy.Params, pass, salt, hashKeyLens[policy.Algorithm])
+	if err != nil {
+		return "", err
+	}
+
+	passHash := &passwordHash{
+		algorithm: policy.Algorithm,
+		params:    policy.Params,
+		salt:      salt,
+		key:       key,
+	}
+
+	return passHash.String(), nil
+}
+
+// loadPasswordHash reads users.pass, salt is only used by legacy hashes.
+func loadPasswordHash(passStr string, saltStr string) (*passwordHash, error) {
+	if !strings.HasPrefix(passStr, "$") {
+		salt, err := hex.DecodeString(saltStr)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := hex.DecodeString(passStr)
+		if err != nil {
+			return nil, err
+		}
+
+		return &passwordHash{
+			algorithm: HashScrypt,
+			params:    DefaultHashPolicy.Params,
+			salt:      salt,
+			key:       key,
+			legacy:    true,
+		}, nil
+	}
+
+	// algorithm, [version,] params, salt, key
+	parts := strings.Split(passStr, "$")[1:]
+
+	// argon2id hashes must carry the version, scrypt ones do not have it
+	hasVersion := len(parts) == 5 && parts[1] == "v="+strconv.Itoa(argon2.Version)
+	if hasVersion != (parts[0] == HashArgon2id) {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	if hasVersion {
+		parts = append(parts[:1], parts[2:]...)
+	}
+
+	if len(parts) != 4 {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	params, err := parseHashParams(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	return &passwordHash{
+		algorithm: parts[0],
+		params:    params,
+		salt:      salt,
+		key:       key,
+	}, nil
+}
+
+func (passHash *passwordHash) String() string {
+	if passHash.legacy {
+		return hex.EncodeToString(passHash.key)
+	}
+
+	params := make([]string, 0, len(passHash.params))
+	for _, name := range hashParamNames[passHash.algorithm] {
+		params = append(params, name+"="+strconv.FormatUint(uint64(passHash.params[name]), 10))
+	}
+
+	prefix := "$" + passHash.algorithm
+	if passHash.algorithm == HashArgon2id {
+		prefix += "$v=" + strconv.Itoa(argon2.Version)
+	}
+
+	return prefix + "$" + strings.Join(params, ",") +
+		"$" + base64.RawStdEncoding.EncodeToString(passHash.salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(passHash.key)
+}
+
+// rehash hashes pass with the salt and the parameters of passHash, the
+// result equals passHash.String() for the right password.
+func (passHash *passwordHash) rehash(pass string) (string, error) {
+	key, err := deriveKey(passHash.algorithm, passHash.params, pass, passHash.salt, len(passHash.key))
+	if err != nil {
+		return "", err
+	}
+
+	candidate := *passHash
+	candidate.key = key
+
+	return candidate.String(), nil
+}
+
+// verify compares in constant time, so the time does not tell how much of
+// the hash matched.
+func (passHash *passwordHash) verify(pass string) (bool, error) {
+	candidate, err := passHash.rehash(pass)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(passHash.String())) == 1, nil
+}
+
+// verifyUnknown spends as much time as verify of a hash made by the policy,
+// so an unknown login is not faster to reject than a wrong password.
+func (policy HashPolicy) verifyUnknown(pass string) {
+	policy.hash(pass)
+}
+
+// isWeakerThan reports whether the hash has to be replaced on the next login.
+func (passHash *passwordHash) isWeakerThan(policy HashPolicy) bool {
+	if passHash.legacy || passHash.algorithm != policy.Algorithm {
+		return true
+	}
+
+	for name, value := range policy.Params {
+		if passHash.params[name] < value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,139 @@
+package userstor
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/scrypt"
+)
+
+// cheap parameters, the defaults take a noticeable time per hash
+var (
+	testScryptPolicy   = HashPolicy{Algorithm: HashScrypt, Params: map[string]uint32{"ln": 4, "r": 8, "p": 1}}
+	testArgon2idPolicy = HashPolicy{Algorithm: HashArgon2id, Params: map[string]uint32{"m": 64, "t": 1, "p": 1}}
+)
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	for _, policy := range []HashPolicy{testScryptPolicy, testArgon2idPolicy} {
+		t.Run(policy.Algorithm, func(t *testing.T) {
+			passStr, err := policy.hash("qwertY")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(passStr, "$"+policy.Algorithm+"$"))
+
+			passHash, err := loadPasswordHash(passStr, "")
+			require.NoError(t, err)
+			assert.Equal(t, passStr, passHash.String())
+			assert.False(t, passHash.isWeakerThan(policy))
+
+			candidate, err := passHash.rehash("qwertY")
+			require.NoError(t, err)
+			assert.Equal(t, passStr, candidate)
+
+			candidate, err = passHash.rehash("qwerty")
+			require.NoError(t, err)
+			assert.NotEqual(t, passStr, candidate)
+
+			ok, err := passHash.verify("qwertY")
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, err = passHash.verify("qwerty")
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestLegacyPasswordHash(t *testing.T) {
+	salt, err := createSalt()
+	require.NoError(t, err)
+
+	key, err := scrypt.Key([]byte("qwertY"), salt, 1<<14, 8, 1, 64)
+	require.NoError(t, err)
+
+	passStr := hex.EncodeToString(key)
+
+	passHash, err := loadPasswordHash(passStr, hex.EncodeToString(salt))
+	require.NoError(t, err)
+
+	ok, err := passHash.verify("qwertY")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the same cost, but the salt lives in another column
+	assert.True(t, passHash.isWeakerThan(DefaultHashPolicy))
+}
+
+func TestPasswordHashIsWeakerThan(t *testing.T) {
+	passStr, err := testScryptPolicy.hash("qwertY")
+	require.NoError(t, err)
+
+	passHash, err := loadPasswordHash(passStr, "")
+	require.NoError(t, err)
+
+	assert.True(t, passHash.isWeakerThan(testArgon2idPolicy))
+	assert.True(t, passHash.isWeakerThan(HashPolicy{
+		Algorithm: HashScrypt,
+		Params:    map[string]uint32{"ln": 5, "r": 8, "p": 1},
+	}))
+	assert.False(t, passHash.isWeakerThan(HashPolicy{
+		Algorithm: HashScrypt,
+		Params:    map[string]uint32{"ln": 3, "r": 8, "p": 1},
+	}))
+}
+
+func TestParseHashPolicy(t *testing.T) {
+	policy, err := ParseHashPolicy(HashScrypt, "")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultHashPolicy, policy)
+
+	policy, err = ParseHashPolicy(HashArgon2id, "m=64,t=1,p=1")
+	require.NoError(t, err)
+	assert.Equal(t, testArgon2idPolicy, policy)
+
+	for _, params := range []string{"ln=4,r=8", "ln=4,r=8,p=1,x=1", "ln=4,r=0,p=1", "ln=40,r=8,p=1"} {
+		_, err = ParseHashPolicy(HashScrypt, params)
+		assert.ErrorIs(t, err, ErrInvalidPasswordHash, params)
+	}
+
+	_, err = ParseHashPolicy("md5", "")
+	assert.ErrorIs(t, err, ErrInvalidPasswordHash)
+
+	for _, passStr := range []string{"$scrypt$ln=4,r=8,p=1$c2FsdA", "$argon2id$m=64,t=1,p=1$c2FsdA$a2V5", "$scrypt$ln=4,r=8,p=1$c2FsdA$"} {
+		_, err = loadPasswordHash(passStr, "")
+		assert.ErrorIs(t, err, ErrInvalidPasswordHash, passStr)
+	}
+}
+
+func TestRehashOnLogIn(t *testing.T) {
+	stor := InitMemory(gophermartStor.InitMemory("", "", 0), DefaultSessionTTL, testScryptPolicy)
+
+	_, err := stor.SignIn("login", "Secret-2022", "")
+	require.NoError(t, err)
+
+	oldPassStr := stor.users[getLogin("login")].pass
+
+	// the same policy keeps the hash
+	_, err = stor.LogIn("login", "Secret-2022", "", "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, oldPassStr, stor.users[getLogin("login")].pass)
+
+	stor.hashPolicy = testArgon2idPolicy
+
+	_, err = stor.LogIn("login", "Secret-2022", "", "127.0.0.1")
+	require.NoError(t, err)
+
+	newPassStr := stor.users[getLogin("login")].pass
+	assert.True(t, strings.HasPrefix(newPassStr, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	_, err = stor.LogIn("login", "Secret-2022", "", "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, newPassStr, stor.users[getLogin("login")].pass)
+
+	_, err = stor.LogIn("login", "Secret-2023", "", "127.0.0.1")
+	assert.ErrorIs(t, err, ErrUnknownUser)
+}
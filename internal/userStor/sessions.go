@@ -0,0 +1,124 @@
+package userstor
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// a session expires after this long without requests
+	DefaultSessionTTL = 24 * time.Hour
+
+	// longer User-Agent headers are cut
+	maxDeviceLen = 256
+)
+
+type Session struct {
+	Token     string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+const (
+	// INSERT INTO sessions (sessionToken, userID, device, expires_at) VALUES ($1, $2, $3, NOW()+$4)
+	// RETURNING expires_at
+	insertSessionSQL = "INSERT INTO sessions (sessionToken, userID, device, expires_at) " +
+		"VALUES ($1, $2, $3, NOW()+make_interval(secs => $4)) RETURNING expires_at"
+
+	// UPDATE sessions SET expires_at=NOW()+$2 WHERE sessionToken=$1 AND expires_at>NOW()
+	// RETURNING userID, expires_at
+	touchSessionSQL = "UPDATE sessions SET expires_at=NOW()+make_interval(secs => $2) " +
+		"WHERE sessionToken=$1 AND expires_at>NOW() RETURNING userID, expires_at"
+
+	// SELECT EXISTS(SELECT 1 FROM sessions WHERE sessionToken=$1)
+	sessionExistsSQL = "SELECT EXISTS(SELECT 1 FROM sessions WHERE sessionToken=$1)"
+
+	// DELETE FROM sessions WHERE sessionToken=$1
+	deleteSessionSQL = "DELETE FROM sessions WHERE sessionToken=$1"
+
+	// DELETE FROM sessions WHERE userID=$1
+	deleteUserSessionsSQL = "DELETE FROM sessions WHERE userID=$1"
+
+	// DELETE FROM sessions WHERE userID=$1 AND sessionToken<>$2
+	deleteOtherSessionsSQL = "DELETE FROM sessions WHERE userID=$1 AND sessionToken<>$2"
+
+	// DELETE FROM sessions WHERE userID=$1 AND expires_at<=NOW()
+	deleteExpiredSessionsSQL = "DELETE FROM sessions WHERE userID=$1 AND expires_at<=NOW()"
+)
+
+func getDevice(device string) string {
+	if len(device) > maxDeviceLen {
+		return device[:maxDeviceLen]
+	}
+
+	return device
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+func createSession(db queryRower, userID string, device string, ttl time.Duration) (*Session, error) {
+	session := &Session{
+		Token:  createSessionToken(),
+		UserID: userID,
+	}
+
+	err := db.QueryRow(
+		context.TODO(),
+		insertSessionSQL,
+		session.Token,
+		userID,
+		getDevice(device),
+		ttl.Seconds(),
+	).Scan(&session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetSession prolongs the session, expired sessions are unknown.
+func (stor *storageObject) GetSession(sessionToken string) (*Session, error) {
+	session := &Session{Token: sessionToken}
+
+	err := stor.dbPool.QueryRow(
+		context.TODO(),
+		touchSessionSQL,
+		sessionToken,
+		stor.sessionTTL.Seconds(),
+	).Scan(&session.UserID, &session.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUnknownSessionToken
+		}
+
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (stor *storageObject) LogOut(sessionToken string) error {
+	_, err := stor.dbPool.Exec(context.TODO(), deleteSessionSQL, sessionToken)
+	return err
+}
+
+func (stor *storageObject) LogOutEverywhere(userID string) error {
+	_, err := stor.dbPool.Exec(context.TODO(), deleteUserSessionsSQL, userID)
+	return err
+}
+
+func (stor *storageObject) IsSessionRevoked(sessionToken string) (bool, error) {
+	exists := false
+	err := stor.dbPool.QueryRow(context.TODO(), sessionExistsSQL, sessionToken).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return !exists, nil
+}
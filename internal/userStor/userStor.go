@@ -3,57 +3,123 @@ package userstor
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/GermanVor/go-tpl/internal/common"
 	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"golang.org/x/crypto/scrypt"
 )
 
 var (
-	// INSERT INTO users (login, pass, salt, sessionToken) VALUES ($1, $2, $3, $4);
-	insertUserSQL = "INSERT INTO users (login, pass, salt, sessionToken) " +
-		"VALUES ($1, $2, $3, $4) RETURNING users.userID"
+	// INSERT INTO users (login, display_login, pass, salt) VALUES ($1, $2, $3, '');
+	insertUserSQL = "INSERT INTO users (login, display_login, pass, salt) " +
+		"VALUES ($1, $2, $3, '') RETURNING users.userID"
 
-	// SELECT sessionToken FROM users WHERE login=$1 AND pass=$2;
-	findUserBylogpassSQL = "SELECT sessionToken FROM users WHERE login=$1 AND pass=$2"
+	// SELECT userID, display_login IS NULL, pass, salt FROM users WHERE login=$1;
+	getPassSQL = "SELECT userID, display_login IS NULL, pass, salt FROM users WHERE login=$1"
 
-	// SELECT salt FROM users WHERE login=$1;
-	getSaltSQL = "SELECT salt FROM users WHERE login=$1"
+	// SELECT EXISTS(SELECT 1 FROM users WHERE login=$1);
+	existsLoginSQL = "SELECT EXISTS(SELECT 1 FROM users WHERE login=$1)"
 
-	// SELECT userID FROM users WHERE sessionToken=$1;
-	getUserIDSQL = "SELECT userID FROM users WHERE sessionToken=$1"
+	// SELECT COALESCE(display_login, ''), pass, salt FROM users WHERE userID=$1 FOR UPDATE;
+	getPassByUserIDSQL = "SELECT COALESCE(display_login, ''), pass, salt FROM users WHERE userID=$1 FOR UPDATE"
+
+	// UPDATE users SET login=$2, display_login=$3 WHERE userID=$1;
+	setLoginSQL = "UPDATE users SET login=$2, display_login=$3 WHERE userID=$1"
+
+	// UPDATE users SET pass=$2, salt='' WHERE userID=$1;
+	setPassSQL = "UPDATE users SET pass=$2, salt='' WHERE userID=$1"
+
+	// UPDATE users SET pass=$2, salt='' WHERE userID=$1 AND pass=$3;
+	upgradePassSQL = "UPDATE users SET pass=$2, salt='' WHERE userID=$1 AND pass=$3"
+
+	// SELECT COALESCE(display_login, ''), role, registered_at FROM users WHERE userID=$1;
+	getUserSQL = "SELECT COALESCE(display_login, ''), role, registered_at FROM users WHERE userID=$1"
+
+	// SELECT userID, COALESCE(display_login, ''), role, registered_at FROM users
+	// WHERE $1='' OR userID::TEXT=$1 OR POSITION(LOWER($1) IN LOWER(display_login))>0
+	// OR login=ANY($4) ORDER BY userID LIMIT $2 OFFSET $3;
+	searchUsersSQL = "SELECT userID, COALESCE(display_login, ''), role, registered_at FROM users " +
+		"WHERE $1='' OR userID::TEXT=$1 OR POSITION(LOWER($1) IN LOWER(display_login))>0 " +
+		"OR login=ANY($4) ORDER BY userID LIMIT $2 OFFSET $3"
+
+	// UPDATE users SET role=$2 WHERE login=$1;
+	setRoleSQL = "UPDATE users SET role=$2 WHERE login=$1"
+
+	// DELETE FROM users WHERE userID=$1;
+	deleteUserSQL = "DELETE FROM users WHERE userID=$1"
 )
 
+// SignIn and LogIn open a new session for the device, e.g. its User-Agent.
+// SignIn and ChangePassword return ValidationErrors for logins and passwords
+// breaking the policy, logins differing only in case are the same login.
+// LogIn returns *LoginBlockedError after too many failures for the login
+// or the ip address.
 type Interface interface {
-	SignIn(login string, pass string) (string, error)
-	LogIn(login string, pass string) (string, error)
+	SignIn(login string, pass string, device string) (*Session, error)
+	LogIn(login string, pass string, device string, ip string) (*Session, error)
+
+	GetSession(sessionToken string) (*Session, error)
+	LogOut(sessionToken string) error
+	LogOutEverywhere(userID string) error
+	// IsSessionRevoked does not prolong the session.
+	IsSessionRevoked(sessionToken string) (bool, error)
+
+	// ChangePassword ends every session of the user except sessionToken.
+	ChangePassword(userID string, sessionToken string, oldPass string, newPass string) error
+	// DeleteUser forgets the user, see gophermartStor.DeleteUserData.
+	DeleteUser(userID string) error
+
+	GetUser(userID string) (*User, error)
+	// SearchUsers finds users by ID or by a part of the login, an empty
+	// query lists everybody. Users who have not logged in since logins were
+	// stored are only found by the whole login.
+	SearchUsers(query string, page common.Page) ([]*User, error)
+	SetRole(login string, role Role) error
+}
 
-	GetUserID(userID string) (string, error)
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// User is the public part of the account. Login and RegisteredAt are zero
+// for users who registered before they were stored and did not log in since.
+type User struct {
+	UserID       string
+	Login        string
+	Role         Role
+	RegisteredAt time.Time
 }
 
 var (
 	ErrLoginOccupied       = errors.New("the login is already occupied")
 	ErrUnknownUser         = errors.New("invalid login/password pair")
 	ErrUnknownSessionToken = errors.New("unknown user token")
+	ErrWrongPassword       = errors.New("wrong password")
+	ErrUnknownRole         = errors.New("unknown role")
 )
 
 type storageObject struct {
 	Interface
 
 	dbPool *pgxpool.Pool
+
+	sessionTTL time.Duration
+	hashPolicy HashPolicy
 }
 
-func Init(databaseURI string) Interface {
+func Init(databaseURI string, sessionTTL time.Duration, hashPolicy HashPolicy) Interface {
 	conn, err := pgxpool.Connect(context.TODO(), databaseURI)
 	if err != nil {
 		log.Fatalln(err.Error())
@@ -61,23 +127,10 @@ func Init(databaseURI string) Interface {
 
 	log.Printf("Connected to DB %s successfully\n", databaseURI)
 
-	sql := "CREATE TABLE IF NOT EXISTS users (" +
-		"login text UNIQUE, " +
-		"pass text, " +
-		"salt text, " +
-		"userID SERIAL, " +
-		"sessionToken text " +
-		");"
-
-	_, err = conn.Exec(context.TODO(), sql)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-
-	log.Println("Created Table successfully")
-
 	return &storageObject{
-		dbPool: conn,
+		dbPool:     conn,
+		sessionTTL: sessionTTL,
+		hashPolicy: hashPolicy,
 	}
 }
 
@@ -86,123 +139,299 @@ func createSessionToken() string {
 	return hex.EncodeToString(bytes[:])
 }
 
-func getLogin(login string) string {
-	loginHash := sha1.Sum([]byte(login))
-	return hex.EncodeToString(loginHash[:])
-}
-
-func getPass(pass string, salt []byte) (string, error) {
-	passHash, err := scrypt.Key([]byte(pass), salt, 1<<14, 8, 1, 64)
+func createSalt() ([]byte, error) {
+	salt := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, salt)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return hex.EncodeToString(passHash), nil
+	return salt, nil
 }
 
-func (stor *storageObject) SignIn(login string, pass string) (string, error) {
-	salt := make([]byte, 32)
-	_, err := io.ReadFull(rand.Reader, salt)
+func (stor *storageObject) SignIn(login string, pass string, device string) (*Session, error) {
+	displayLogin, err := validateCredentials(login, pass)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	saltStr := hex.EncodeToString(salt)
 
-	loginStr := getLogin(login)
-	passStr, err := getPass(pass, salt)
+	loginStr := getLogin(displayLogin)
+	passStr, err := stor.hashPolicy.hash(pass)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	sessionToken := createSessionToken()
-
 	tx, err := stor.dbPool.Begin(context.TODO())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer tx.Rollback(context.TODO())
 
+	occupied, err := isLoginOccupied(displayLogin, func(key string) (bool, error) {
+		exists := false
+		err := tx.QueryRow(context.TODO(), existsLoginSQL, key).Scan(&exists)
+		return exists, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if occupied {
+		return nil, ErrLoginOccupied
+	}
+
 	userID := 0
 	err = tx.QueryRow(
 		context.TODO(),
 		insertUserSQL,
 		loginStr,
+		displayLogin,
 		passStr,
-		saltStr,
-		sessionToken,
 	).Scan(&userID)
 
 	if err != nil {
 		if common.IsAlreadyCreatedRowErr(err) {
-			return "", ErrLoginOccupied
+			return nil, ErrLoginOccupied
 		}
 
-		return "", err
+		return nil, err
 	}
 
 	err = gophermartStor.CreateBalance(tx, strconv.Itoa(userID))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	session, err := createSession(tx, strconv.Itoa(userID), device, stor.sessionTTL)
+	if err != nil {
+		return nil, err
 	}
 
-	return sessionToken, tx.Commit(context.TODO())
+	return session, tx.Commit(context.TODO())
 }
 
-func (stor *storageObject) LogIn(login string, pass string) (string, error) {
-	loginStr := getLogin(login)
+func (stor *storageObject) LogIn(login string, pass string, device string, ip string) (*Session, error) {
+	return throttleLogIn(stor, login, ip, func() (*Session, error) {
+		return stor.logIn(login, pass, device)
+	})
+}
 
-	saltStr := ""
-	err := stor.dbPool.QueryRow(context.TODO(), getSaltSQL, loginStr).Scan(&saltStr)
-	if err != nil {
+func (stor *storageObject) logIn(login string, pass string, device string) (*Session, error) {
+	user, err := findUser(login, pass, stor.hashPolicy, func(key string) (*storedUser, error) {
+		user := &storedUser{}
+
+		err := stor.dbPool.QueryRow(context.TODO(), getPassSQL, key).
+			Scan(&user.userID, &user.isLegacyLogin, &user.passStr, &user.saltStr)
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "", ErrUnknownUser
-		} else {
-			return "", err
+			return nil, nil
 		}
+
+		return user, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	userID := user.userID
+
+	if user.hash.isWeakerThan(stor.hashPolicy) {
+		stor.upgradePass(userID, user.passStr, pass)
+	}
+
+	if user.isLegacyLogin {
+		stor.upgradeLogin(userID, login)
 	}
 
-	salt, err := hex.DecodeString(saltStr)
+	// a good moment to forget sessions of the user which expired long ago
+	_, err = stor.dbPool.Exec(context.TODO(), deleteExpiredSessionsSQL, strconv.Itoa(userID))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// every login gets its own token, other devices stay logged in
+	return createSession(stor.dbPool, strconv.Itoa(userID), device, stor.sessionTTL)
+}
+
+// upgradePass rehashes the password with the current policy. The login
+// succeeded already, so errors are only logged.
+func (stor *storageObject) upgradePass(userID int, storedPassStr string, pass string) {
+	passStr, err := stor.hashPolicy.hash(pass)
+	if err == nil {
+		// a concurrent password change wins
+		_, err = stor.dbPool.Exec(context.TODO(), upgradePassSQL, userID, passStr, storedPassStr)
 	}
 
-	passStr, err := getPass(pass, salt)
 	if err != nil {
-		return "", err
+		log.Println("password rehash error", userID, err)
 	}
+}
 
-	userID := ""
+// upgradeLogin moves a user registered before logins were normalized to
+// the case-insensitive key. Two old users differing only in case can not
+// share it, the second one keeps the old key.
+func (stor *storageObject) upgradeLogin(userID int, login string) {
+	_, err := stor.dbPool.Exec(context.TODO(), setLoginSQL, userID, getLogin(login), normalizeLogin(login))
+	if err != nil {
+		log.Println("login upgrade error", userID, err)
+	}
+}
 
-	err = stor.dbPool.QueryRow(
-		context.TODO(),
-		findUserBylogpassSQL,
-		loginStr,
-		passStr,
-	).Scan(&userID)
+func (stor *storageObject) ChangePassword(userID string, sessionToken string, oldPass string, newPass string) error {
+	tx, err := stor.dbPool.Begin(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
 
+	displayLogin, passStr, saltStr := "", "", ""
+	err = tx.QueryRow(context.TODO(), getPassByUserIDSQL, userID).Scan(&displayLogin, &passStr, &saltStr)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "", ErrUnknownUser
-		} else {
-			return "", err
+			return ErrUnknownUser
 		}
+
+		return err
 	}
 
-	// place where we can recreate userID
+	storedHash, err := loadPasswordHash(passStr, saltStr)
+	if err != nil {
+		return err
+	}
 
-	return userID, nil
+	ok, err := storedHash.verify(oldPass)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrWrongPassword
+	}
+
+	if errs := validatePassword(newPass, displayLogin); len(errs) != 0 {
+		return errs
+	}
+
+	newPassStr, err := stor.hashPolicy.hash(newPass)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.TODO(), setPassSQL, userID, newPassStr)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.TODO(), deleteOtherSessionsSQL, userID, sessionToken)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.TODO())
 }
 
-func (stor *storageObject) GetUserID(sessionToken string) (string, error) {
-	userID := 0
-	err := stor.dbPool.QueryRow(context.TODO(), getUserIDSQL, sessionToken).Scan(&userID)
+func (stor *storageObject) GetUser(userID string) (*User, error) {
+	user := &User{UserID: userID}
+	var registeredAt *time.Time
+
+	err := stor.dbPool.QueryRow(context.TODO(), getUserSQL, userID).Scan(&user.Login, &user.Role, &registeredAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return "", ErrUnknownSessionToken
-		} else {
-			return "", err
+			return nil, ErrUnknownUser
+		}
+
+		return nil, err
+	}
+
+	if registeredAt != nil {
+		user.RegisteredAt = *registeredAt
+	}
+
+	return user, nil
+}
+
+func (stor *storageObject) SearchUsers(query string, page common.Page) ([]*User, error) {
+	rows, err := stor.dbPool.Query(
+		context.TODO(),
+		searchUsersSQL,
+		query,
+		page.Limit,
+		page.Offset,
+		getLoginKeys(query),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		user := &User{}
+		userID := 0
+		var registeredAt *time.Time
+
+		err := rows.Scan(&userID, &user.Login, &user.Role, &registeredAt)
+		if err != nil {
+			return nil, err
 		}
+
+		user.UserID = strconv.Itoa(userID)
+		if registeredAt != nil {
+			user.RegisteredAt = *registeredAt
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (stor *storageObject) SetRole(login string, role Role) error {
+	if role != RoleUser && role != RoleAdmin {
+		return ErrUnknownRole
+	}
+
+	// the exact old login first, the case-insensitive key of old "Bob" may
+	// belong to old "bob"
+	keys := getLoginKeys(login)
+	for i := len(keys) - 1; i >= 0; i-- {
+		tag, err := stor.dbPool.Exec(context.TODO(), setRoleSQL, keys[i], role)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() != 0 {
+			return nil
+		}
+	}
+
+	return ErrUnknownUser
+}
+
+func (stor *storageObject) DeleteUser(userID string) error {
+	tx, err := stor.dbPool.Begin(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
+
+	tag, err := tx.Exec(context.TODO(), deleteUserSQL, userID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownUser
+	}
+
+	_, err = tx.Exec(context.TODO(), deleteUserSessionsSQL, userID)
+	if err != nil {
+		return err
+	}
+
+	err = gophermartStor.DeleteUserData(tx, userID)
+	if err != nil {
+		return err
 	}
 
-	return strconv.Itoa(userID), nil
+	return tx.Commit(context.TODO())
 }
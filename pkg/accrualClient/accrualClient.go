@@ -0,0 +1,426 @@
+package accrualclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/common"
+	"github.com/GermanVor/go-tpl/internal/money"
+)
+
+// Request and response types of the accrual handlers.
+type (
+	Order        = accrualStor.Order
+	OrderStatus  = accrualStor.OrderStatus
+	OrderPackage = accrualStor.OrderPackage
+	Good         = accrualStor.Good
+	GoodReward   = accrualStor.GoodReward
+	RewardType   = accrualStor.RewardType
+	MatchType    = accrualStor.MatchType
+	Resolution   = accrualStor.Resolution
+	Scope        = accrualStor.Scope
+
+	GoodRewardState   = accrualStor.GoodRewardState
+	GoodRewardVersion = accrualStor.GoodRewardVersion
+	Breakdown         = accrualStor.Breakdown
+	BreakdownItem     = accrualStor.BreakdownItem
+	Page              = common.Page
+
+	// Money is stored in hundredths, so 10 is 0.10, use ParseMoney
+	// for decimal strings
+	Money = money.Money
+)
+
+const (
+	OrderStatusRegistered = accrualStor.OrderStatusRegistered
+	OrderStatusInvalid    = accrualStor.OrderStatusInvalid
+	OrderStatusProcessing = accrualStor.OrderStatusProcessing
+	OrderStatusProcessed  = accrualStor.OrderStatusProcessed
+
+	RewardTypePercent = accrualStor.RewardTypePercent
+	RewardTypePT      = accrualStor.RewardTypePT
+
+	MatchTypeContains = accrualStor.MatchTypeContains
+	MatchTypeExact    = accrualStor.MatchTypeExact
+	MatchTypePrefix   = accrualStor.MatchTypePrefix
+	MatchTypeRegex    = accrualStor.MatchTypeRegex
+
+	ResolutionStack = accrualStor.ResolutionStack
+	ResolutionFirst = accrualStor.ResolutionFirst
+	ResolutionBest  = accrualStor.ResolutionBest
+
+	GoodRewardStateAny      = accrualStor.GoodRewardStateAny
+	GoodRewardStateActive   = accrualStor.GoodRewardStateActive
+	GoodRewardStateUpcoming = accrualStor.GoodRewardStateUpcoming
+	GoodRewardStateExpired  = accrualStor.GoodRewardStateExpired
+
+	ScopeOrdersRead  = accrualStor.ScopeOrdersRead
+	ScopeOrdersWrite = accrualStor.ScopeOrdersWrite
+	ScopeGoodsRead   = accrualStor.ScopeGoodsRead
+	ScopeGoodsWrite  = accrualStor.ScopeGoodsWrite
+)
+
+var ParseMoney = money.Parse
+
+var (
+	ErrOrderAlreadyAccepted      = accrualStor.ErrOrderAlreadyAccepted
+	ErrGoodRewardAlreadyAccepted = accrualStor.ErrGoodRewardAlreadyAccepted
+	ErrInvalidGoodReward         = accrualStor.ErrInvalidGoodReward
+	ErrInvalidOrderIDFormat      = accrualStor.ErrInvalidOrderIDFormat
+	ErrExceededRequestsNumber    = accrualStor.ErrExceededRequestsNumber
+	ErrUnknownOrderID            = accrualStor.ErrUnknownOrderID
+	ErrInvalidAPIKey             = accrualStor.ErrInvalidAPIKey
+	ErrUnknownGoodRewardState    = accrualStor.ErrUnknownGoodRewardState
+	ErrUnknownGoodReward         = accrualStor.ErrUnknownGoodReward
+)
+
+// used when 429 comes without a valid Retry-After
+const DefaultRetryAfter = time.Minute
+
+// ThrottledError is returned on 429, errors.Is matches it with
+// ErrExceededRequestsNumber.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrExceededRequestsNumber, e.RetryAfter)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrExceededRequestsNumber
+}
+
+// StatusError is returned for statuses without a sentinel error.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("accrual system responded %d: %s", e.StatusCode, e.Message)
+}
+
+// ParseRetryAfter supports both delay-seconds and HTTP-date forms.
+func ParseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// Client wraps the accrual system HTTP API.
+type Client struct {
+	address    string
+	httpClient *http.Client
+
+	// "<key id>.<secret>", empty for anonymous requests
+	apiKey string
+	// sign requests instead of sending the secret
+	sign bool
+}
+
+// NewClient creates a client of the accrual system at address, e.g.
+// http://localhost:8080. nil httpClient means http.DefaultClient.
+func NewClient(address string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		address:    strings.TrimSuffix(address, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// SetAPIKey makes the client send the key in X-API-Key with every request.
+func (client *Client) SetAPIKey(apiKey string) error {
+	_, _, err := accrualStor.ParseAPIKey(apiKey)
+	if err != nil {
+		return err
+	}
+
+	client.apiKey = apiKey
+	client.sign = false
+
+	return nil
+}
+
+// SetSigningKey makes the client sign every request with the key, so the
+// secret never goes over the wire.
+func (client *Client) SetSigningKey(apiKey string) error {
+	err := client.SetAPIKey(apiKey)
+	if err != nil {
+		return err
+	}
+
+	client.sign = true
+	return nil
+}
+
+func (client *Client) authorize(req *http.Request, body []byte) {
+	if client.apiKey == "" {
+		return
+	}
+
+	if !client.sign {
+		req.Header.Set(accrualStor.APIKeyHeader, client.apiKey)
+		return
+	}
+
+	keyID, secret, _ := accrualStor.ParseAPIKey(client.apiKey)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(accrualStor.KeyIDHeader, keyID)
+	req.Header.Set(accrualStor.TimestampHeader, timestamp)
+	req.Header.Set(
+		accrualStor.SignatureHeader,
+		accrualStor.Sign(secret, req.Method, req.URL.RequestURI(), timestamp, body),
+	)
+}
+
+type statusErrors map[int]error
+
+func (client *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	src interface{},
+	errs statusErrors,
+) (*http.Response, error) {
+	var data []byte
+	var body io.Reader
+	if src != nil {
+		var err error
+		data, err = json.Marshal(src)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, client.address+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if src != nil {
+		req.Header.Set("Content-Type", common.ApplicationJSONStr)
+	}
+
+	client.authorize(req, data)
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err, ok := errs[resp.StatusCode]; ok {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			retryAfter = DefaultRetryAfter
+		}
+
+		return nil, &ThrottledError{RetryAfter: retryAfter}
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &StatusError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(message)),
+	}
+}
+
+// GetOrder returns the accrual of the order. It returns ErrUnknownOrderID
+// if the order was not registered and *ThrottledError on 429.
+func (client *Client) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	resp, err := client.do(ctx, http.MethodGet, "/api/orders/"+orderID, nil, statusErrors{
+		http.StatusNoContent:  ErrUnknownOrderID,
+		http.StatusBadRequest: ErrInvalidOrderIDFormat,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	order := &Order{}
+	err = json.NewDecoder(resp.Body).Decode(order)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// GetOrderBreakdown explains the accrual of the order, errors are the same
+// as of GetOrder.
+func (client *Client) GetOrderBreakdown(ctx context.Context, orderID string) (*Breakdown, error) {
+	resp, err := client.do(ctx, http.MethodGet, "/api/orders/"+orderID+"/breakdown", nil, statusErrors{
+		http.StatusNoContent:  ErrUnknownOrderID,
+		http.StatusBadRequest: ErrInvalidOrderIDFormat,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	breakdown := &Breakdown{}
+	err = json.NewDecoder(resp.Body).Decode(breakdown)
+	if err != nil {
+		return nil, err
+	}
+
+	return breakdown, nil
+}
+
+// SetOrder registers an order for the accrual calculation.
+func (client *Client) SetOrder(ctx context.Context, orderPackage OrderPackage) error {
+	resp, err := client.do(ctx, http.MethodPost, "/api/orders", orderPackage, statusErrors{
+		http.StatusBadRequest: ErrInvalidOrderIDFormat,
+		http.StatusConflict:   ErrOrderAlreadyAccepted,
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// SetGoodReward registers a reward rule for goods matching goodReward.Match.
+func (client *Client) SetGoodReward(ctx context.Context, goodReward GoodReward) error {
+	resp, err := client.do(ctx, http.MethodPost, "/api/goods", goodReward, statusErrors{
+		http.StatusBadRequest: ErrInvalidGoodReward,
+		http.StatusConflict:   ErrGoodRewardAlreadyAccepted,
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// GetGoodRewards returns a page of live rules in the state, every live
+// rule for GoodRewardStateAny, by priority.
+func (client *Client) GetGoodRewards(ctx context.Context, state GoodRewardState, page Page) ([]GoodReward, error) {
+	query := url.Values{}
+	query.Set("offset", strconv.FormatUint(page.Offset, 10))
+	if page.Limit != 0 {
+		query.Set("limit", strconv.FormatUint(page.Limit, 10))
+	}
+	if state != GoodRewardStateAny {
+		query.Set("state", string(state))
+	}
+
+	goodRewards := make([]GoodReward, 0)
+	err := client.getJSON(ctx, "/api/goods?"+query.Encode(), statusErrors{
+		http.StatusBadRequest: ErrUnknownGoodRewardState,
+	}, &goodRewards)
+	if err != nil {
+		return nil, err
+	}
+
+	return goodRewards, nil
+}
+
+func goodRewardPath(match string) string {
+	return "/api/goods/" + url.PathEscape(match)
+}
+
+// GetGoodReward returns the live rule, ErrUnknownGoodReward if there is none.
+func (client *Client) GetGoodReward(ctx context.Context, match string) (*GoodReward, error) {
+	goodReward := &GoodReward{}
+	err := client.getJSON(ctx, goodRewardPath(match), statusErrors{
+		http.StatusNotFound: ErrUnknownGoodReward,
+	}, goodReward)
+	if err != nil {
+		return nil, err
+	}
+
+	return goodReward, nil
+}
+
+// UpdateGoodReward replaces the live rule of goodReward.Match.
+func (client *Client) UpdateGoodReward(ctx context.Context, goodReward GoodReward) error {
+	resp, err := client.do(ctx, http.MethodPut, goodRewardPath(goodReward.Match), goodReward, statusErrors{
+		http.StatusBadRequest: ErrInvalidGoodReward,
+		http.StatusNotFound:   ErrUnknownGoodReward,
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// DeleteGoodReward deletes the live rule, its history stays.
+func (client *Client) DeleteGoodReward(ctx context.Context, match string) error {
+	resp, err := client.do(ctx, http.MethodDelete, goodRewardPath(match), nil, statusErrors{
+		http.StatusNotFound: ErrUnknownGoodReward,
+	})
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// GoodRewardHistory returns every version of the rule, the oldest first.
+func (client *Client) GoodRewardHistory(ctx context.Context, match string) ([]GoodRewardVersion, error) {
+	versions := make([]GoodRewardVersion, 0)
+	err := client.getJSON(ctx, goodRewardPath(match)+"/history", statusErrors{
+		http.StatusNotFound: ErrUnknownGoodReward,
+	}, &versions)
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (client *Client) getJSON(ctx context.Context, path string, errs statusErrors, dst interface{}) error {
+	resp, err := client.do(ctx, http.MethodGet, path, nil, errs)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
@@ -0,0 +1,368 @@
+package accrualclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	accrualHandlers "github.com/GermanVor/go-tpl/cmd/accrual/accrualHandlers"
+	accrualStor "github.com/GermanVor/go-tpl/internal/accrualStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	accrualClient "github.com/GermanVor/go-tpl/pkg/accrualClient"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	orderID        = "70757088342"
+	unknownOrderID = "12345678903"
+)
+
+// newClient returns a client with a new key of the scopes.
+func newClient(t *testing.T, stor accrualStor.Interface, address string, scopes ...accrualClient.Scope) *accrualClient.Client {
+	key, err := stor.CreateAPIKey(scopes)
+	require.NoError(t, err)
+
+	client := accrualClient.NewClient(address, nil)
+	require.NoError(t, client.SetAPIKey(key.String()))
+
+	return client
+}
+
+// waitProcessed waits for the workers of the accrual system to calculate
+// the order.
+func waitProcessed(t *testing.T, client *accrualClient.Client, orderID string) {
+	require.Eventually(t, func() bool {
+		order, err := client.GetOrder(context.Background(), orderID)
+		return err == nil && order.Status == accrualClient.OrderStatusProcessed
+	}, time.Second, 20*time.Millisecond)
+}
+
+func createTestEnv(t *testing.T, requestCountLimit uint16) (*accrualClient.Client, func()) {
+	r := chi.NewRouter()
+	stor := accrualStor.InitMemory(requestCountLimit, 1)
+	accrualHandlers.InitRouter(r, stor)
+
+	ts := httptest.NewServer(r)
+
+	return newClient(t, stor, ts.URL, accrualStor.Scopes...), ts.Close
+}
+
+func TestAccrualClient(t *testing.T) {
+	client, destructor := createTestEnv(t, 10)
+	defer destructor()
+
+	ctx := context.Background()
+
+	goodReward := accrualClient.GoodReward{
+		Match:      "Qwe",
+		Reward:     money.MustParse("10"),
+		RewardType: accrualClient.RewardTypePercent,
+	}
+
+	t.Run("Set good reward", func(t *testing.T) {
+		require.NoError(t, client.SetGoodReward(ctx, goodReward))
+
+		err := client.SetGoodReward(ctx, goodReward)
+		assert.ErrorIs(t, err, accrualClient.ErrGoodRewardAlreadyAccepted)
+
+		err = client.SetGoodReward(ctx, accrualClient.GoodReward{Match: "Rty", RewardType: "?"})
+		assert.ErrorIs(t, err, accrualClient.ErrInvalidGoodReward)
+	})
+
+	t.Run("Set order", func(t *testing.T) {
+		orderPackage := accrualClient.OrderPackage{
+			Order: orderID,
+			Goods: []accrualClient.Good{
+				{Description: "Qwerty", Price: money.MustParse("212")},
+			},
+		}
+
+		require.NoError(t, client.SetOrder(ctx, orderPackage))
+
+		err := client.SetOrder(ctx, orderPackage)
+		assert.ErrorIs(t, err, accrualClient.ErrOrderAlreadyAccepted)
+
+		orderPackage.Order = "12345"
+		err = client.SetOrder(ctx, orderPackage)
+		assert.ErrorIs(t, err, accrualClient.ErrInvalidOrderIDFormat)
+
+		waitProcessed(t, client, orderID)
+	})
+
+	t.Run("Get order", func(t *testing.T) {
+		order, err := client.GetOrder(ctx, orderID)
+		require.NoError(t, err)
+
+		assert.Equal(t, orderID, order.Order)
+		assert.Equal(t, accrualClient.OrderStatusProcessed, order.Status)
+
+		accrual, err := accrualClient.ParseMoney("21.2")
+		require.NoError(t, err)
+		assert.Equal(t, accrual, order.Accrual)
+
+		_, err = client.GetOrder(ctx, unknownOrderID)
+		assert.ErrorIs(t, err, accrualClient.ErrUnknownOrderID)
+	})
+
+	t.Run("Get order breakdown", func(t *testing.T) {
+		breakdown, err := client.GetOrderBreakdown(ctx, orderID)
+		require.NoError(t, err)
+
+		assert.Equal(t, orderID, breakdown.Order)
+		assert.Equal(t, money.MustParse("21.2"), breakdown.Accrual)
+		assert.Equal(t, []accrualClient.BreakdownItem{{
+			Position:    0,
+			Description: "Qwerty",
+			Price:       money.MustParse("212"),
+			Match:       "Qwe",
+			RuleVersion: 1,
+			RewardType:  accrualClient.RewardTypePercent,
+			Reward:      money.MustParse("10"),
+			Accrual:     money.MustParse("21.2"),
+		}}, breakdown.Items)
+
+		_, err = client.GetOrderBreakdown(ctx, unknownOrderID)
+		assert.ErrorIs(t, err, accrualClient.ErrUnknownOrderID)
+
+		_, err = client.GetOrderBreakdown(ctx, "12345")
+		assert.ErrorIs(t, err, accrualClient.ErrInvalidOrderIDFormat)
+	})
+}
+
+func TestAccrualClientCampaigns(t *testing.T) {
+	client, destructor := createTestEnv(t, 10)
+	defer destructor()
+
+	ctx := context.Background()
+
+	now := time.Now()
+	yesterday, tomorrow := now.Add(-24*time.Hour), now.Add(24*time.Hour)
+
+	goodRewards, err := client.GetGoodRewards(ctx, accrualClient.GoodRewardStateAny, accrualClient.Page{})
+	require.NoError(t, err)
+	assert.Empty(t, goodRewards)
+
+	for _, goodReward := range []accrualClient.GoodReward{
+		{Match: "Always", Reward: 1, RewardType: accrualClient.RewardTypePT},
+		{Match: "Past", Reward: 1, RewardType: accrualClient.RewardTypePT, ValidUntil: &yesterday},
+		{Match: "Future", Reward: 1, RewardType: accrualClient.RewardTypePT, ValidFrom: &tomorrow, Priority: 1},
+		{Match: "Now", Reward: 1, RewardType: accrualClient.RewardTypePT, ValidFrom: &yesterday, ValidUntil: &tomorrow},
+	} {
+		require.NoError(t, client.SetGoodReward(ctx, goodReward))
+	}
+
+	matches := func(state accrualClient.GoodRewardState) []string {
+		goodRewards, err := client.GetGoodRewards(ctx, state, accrualClient.Page{})
+		require.NoError(t, err)
+
+		arr := make([]string, 0, len(goodRewards))
+		for _, goodReward := range goodRewards {
+			arr = append(arr, goodReward.Match)
+		}
+
+		return arr
+	}
+
+	assert.Equal(t, []string{"Future", "Always", "Now", "Past"}, matches(accrualClient.GoodRewardStateAny))
+	assert.Equal(t, []string{"Always", "Now"}, matches(accrualClient.GoodRewardStateActive))
+	assert.Equal(t, []string{"Future"}, matches(accrualClient.GoodRewardStateUpcoming))
+	assert.Equal(t, []string{"Past"}, matches(accrualClient.GoodRewardStateExpired))
+
+	_, err = client.GetGoodRewards(ctx, "soon", accrualClient.Page{})
+	assert.ErrorIs(t, err, accrualClient.ErrUnknownGoodRewardState)
+
+	err = client.SetGoodReward(ctx, accrualClient.GoodReward{
+		Match:      "Backwards",
+		RewardType: accrualClient.RewardTypePT,
+		ValidFrom:  &tomorrow,
+		ValidUntil: &yesterday,
+	})
+	assert.ErrorIs(t, err, accrualClient.ErrInvalidGoodReward)
+}
+
+func TestAccrualClientGoodRewardCRUD(t *testing.T) {
+	client, destructor := createTestEnv(t, 10)
+	defer destructor()
+
+	ctx := context.Background()
+
+	goodReward := accrualClient.GoodReward{
+		Match:      "Bork/Kettle",
+		Reward:     money.MustParse("10"),
+		RewardType: accrualClient.RewardTypePercent,
+	}
+	require.NoError(t, client.SetGoodReward(ctx, goodReward))
+
+	require.NoError(t, client.SetOrder(ctx, accrualClient.OrderPackage{
+		Order: orderID,
+		Goods: []accrualClient.Good{{Description: "Bork/Kettle 2000", Price: money.MustParse("100")}},
+	}))
+	waitProcessed(t, client, orderID)
+
+	t.Run("Get", func(t *testing.T) {
+		stored, err := client.GetGoodReward(ctx, goodReward.Match)
+		require.NoError(t, err)
+		assert.Equal(t, goodReward.Reward, stored.Reward)
+		assert.Equal(t, accrualClient.MatchTypeContains, stored.MatchType)
+
+		_, err = client.GetGoodReward(ctx, "Bork")
+		assert.ErrorIs(t, err, accrualClient.ErrUnknownGoodReward)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		updated := goodReward
+		updated.Reward = money.MustParse("50")
+		require.NoError(t, client.UpdateGoodReward(ctx, updated))
+
+		stored, err := client.GetGoodReward(ctx, goodReward.Match)
+		require.NoError(t, err)
+		assert.Equal(t, updated.Reward, stored.Reward)
+
+		updated.RewardType = "?"
+		assert.ErrorIs(t, client.UpdateGoodReward(ctx, updated), accrualClient.ErrInvalidGoodReward)
+
+		updated.Match = "Bork"
+		updated.RewardType = accrualClient.RewardTypePT
+		assert.ErrorIs(t, client.UpdateGoodReward(ctx, updated), accrualClient.ErrUnknownGoodReward)
+	})
+
+	t.Run("Processed orders keep their accrual", func(t *testing.T) {
+		order, err := client.GetOrder(ctx, orderID)
+		require.NoError(t, err)
+		assert.Equal(t, money.MustParse("10"), order.Accrual)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, client.DeleteGoodReward(ctx, goodReward.Match))
+		assert.ErrorIs(t, client.DeleteGoodReward(ctx, goodReward.Match), accrualClient.ErrUnknownGoodReward)
+
+		_, err := client.GetGoodReward(ctx, goodReward.Match)
+		assert.ErrorIs(t, err, accrualClient.ErrUnknownGoodReward)
+
+		goodRewards, err := client.GetGoodRewards(ctx, accrualClient.GoodRewardStateAny, accrualClient.Page{})
+		require.NoError(t, err)
+		assert.Empty(t, goodRewards)
+
+		// the match is free again
+		require.NoError(t, client.SetGoodReward(ctx, goodReward))
+	})
+
+	t.Run("History", func(t *testing.T) {
+		versions, err := client.GoodRewardHistory(ctx, goodReward.Match)
+		require.NoError(t, err)
+		require.Len(t, versions, 3)
+
+		for i, version := range versions {
+			assert.Equal(t, i+1, version.Version)
+		}
+
+		assert.Equal(t, money.MustParse("10"), versions[0].Reward)
+		assert.NotNil(t, versions[0].DeletedAt)
+		assert.Equal(t, money.MustParse("50"), versions[1].Reward)
+		assert.NotNil(t, versions[1].DeletedAt)
+		assert.Nil(t, versions[2].DeletedAt)
+
+		_, err = client.GoodRewardHistory(ctx, "Bork")
+		assert.ErrorIs(t, err, accrualClient.ErrUnknownGoodReward)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		for _, match := range []string{"A", "B", "C"} {
+			require.NoError(t, client.SetGoodReward(ctx, accrualClient.GoodReward{
+				Match:      match,
+				RewardType: accrualClient.RewardTypePT,
+			}))
+		}
+
+		goodRewards, err := client.GetGoodRewards(ctx, accrualClient.GoodRewardStateAny, accrualClient.Page{Offset: 1, Limit: 2})
+		require.NoError(t, err)
+		require.Len(t, goodRewards, 2)
+		assert.Equal(t, "B", goodRewards[0].Match)
+		assert.Equal(t, "Bork/Kettle", goodRewards[1].Match)
+	})
+}
+
+func TestAccrualClientThrottled(t *testing.T) {
+	client, destructor := createTestEnv(t, 2)
+	defer destructor()
+
+	ctx := context.Background()
+
+	_, err := client.GetOrder(ctx, orderID)
+	assert.ErrorIs(t, err, accrualClient.ErrUnknownOrderID)
+
+	_, err = client.GetOrder(ctx, orderID)
+	require.ErrorIs(t, err, accrualClient.ErrExceededRequestsNumber)
+
+	var throttledErr *accrualClient.ThrottledError
+	require.True(t, errors.As(err, &throttledErr))
+	assert.Equal(t, time.Minute, throttledErr.RetryAfter)
+}
+
+func TestAccrualClientAPIKeys(t *testing.T) {
+	r := chi.NewRouter()
+	stor := accrualStor.InitMemory(10, 1)
+	accrualHandlers.InitRouter(r, stor)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ctx := context.Background()
+	goodReward := accrualClient.GoodReward{
+		Match:      "Qwe",
+		Reward:     money.MustParse("10"),
+		RewardType: accrualClient.RewardTypePercent,
+	}
+
+	t.Run("Anonymous client", func(t *testing.T) {
+		var statusErr *accrualClient.StatusError
+
+		err := accrualClient.NewClient(ts.URL, nil).SetGoodReward(ctx, goodReward)
+		require.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+	})
+
+	t.Run("Scoped client", func(t *testing.T) {
+		var statusErr *accrualClient.StatusError
+
+		client := newClient(t, stor, ts.URL, accrualClient.ScopeOrdersRead)
+
+		err := client.SetGoodReward(ctx, goodReward)
+		require.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+
+		_, err = client.GetOrder(ctx, orderID)
+		assert.ErrorIs(t, err, accrualClient.ErrUnknownOrderID)
+	})
+
+	t.Run("Signing client", func(t *testing.T) {
+		key, err := stor.CreateAPIKey([]accrualClient.Scope{accrualClient.ScopeGoodsWrite})
+		require.NoError(t, err)
+
+		client := accrualClient.NewClient(ts.URL, nil)
+		require.NoError(t, client.SetSigningKey(key.String()))
+		require.NoError(t, client.SetGoodReward(ctx, goodReward))
+
+		assert.ErrorIs(t, client.SetSigningKey(key.KeyID), accrualClient.ErrInvalidAPIKey)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := accrualClient.ParseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, delay)
+
+	delay, ok = accrualClient.ParseRetryAfter("Sun, 01 May 2022 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, delay)
+
+	_, ok = accrualClient.ParseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,343 @@
+package gophermartclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	gophermartHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/gophermartHandlers"
+	registrationHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/registrationHandlers"
+	"github.com/GermanVor/go-tpl/internal/common"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	"github.com/GermanVor/go-tpl/internal/money"
+	userStor "github.com/GermanVor/go-tpl/internal/userStor"
+)
+
+// Request and response types of the gophermart handlers.
+type (
+	UserRequest           = registrationHandlers.UserRequest
+	ChangePasswordRequest = registrationHandlers.ChangePasswordRequest
+	ValidationErrors      = userStor.ValidationErrors
+	ValidationError       = userStor.ValidationError
+	Profile               = registrationHandlers.ProfileResponse
+	WithdrawRequest       = gophermartHandlers.MakeWithdrawResponse
+
+	Order       = gophermartStor.OrdersForEachObject
+	OrderStatus = gophermartStor.OrderStatus
+	Balance     = gophermartStor.Balance
+	Withdrawal  = gophermartStor.WithdrawalObject
+	LedgerEntry = gophermartStor.LedgerEntry
+
+	SetOrderStatus = gophermartStor.SetOrderStatus
+
+	Money = money.Money
+	Page  = common.Page
+)
+
+const (
+	SetOrderStatusErr             = gophermartStor.SetOrderStatusErr
+	SetOrderStatusAlreadyAccepted = gophermartStor.SetOrderStatusAlreadyAccepted
+	SetOrderStatusAccepted        = gophermartStor.SetOrderStatusAccepted
+
+	OrderStatusNew        = gophermartStor.OrderStatusNew
+	OrderStatusProcessing = gophermartStor.OrderStatusProcessing
+	OrderStatusInvalid    = gophermartStor.OrderStatusInvalid
+	OrderStatusProcessed  = gophermartStor.OrderStatusProcessed
+)
+
+var ParseMoney = money.Parse
+
+var (
+	ErrLoginOccupied        = userStor.ErrLoginOccupied
+	ErrUnknownUser          = userStor.ErrUnknownUser
+	ErrWrongPassword        = userStor.ErrWrongPassword
+	ErrInvalidCredentials   = userStor.ErrInvalidCredentials
+	ErrTooManyAttempts      = userStor.ErrTooManyAttempts
+	ErrUnauthorized         = userStor.ErrUnknownSessionToken
+	ErrOrderAlreadyAccepted = gophermartStor.ErrOrderAlreadyAccepted
+	ErrInvalidOrderIDFormat = gophermartStor.ErrInvalidOrderIDFormat
+	ErrNotEnoughFunds       = gophermartStor.ErrNotEnoughFunds
+)
+
+// StatusError is returned for statuses without a sentinel error.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("gophermart responded %d: %s", e.StatusCode, e.Message)
+}
+
+// Client wraps the gophermart HTTP API. It keeps the session cookie
+// received on Register or Login and sends it with every request.
+type Client struct {
+	address    string
+	httpClient *http.Client
+
+	mux          sync.RWMutex
+	sessionToken string
+}
+
+// NewClient creates a client of the gophermart at address, e.g.
+// http://localhost:8081. nil httpClient means http.DefaultClient.
+func NewClient(address string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		address:    strings.TrimSuffix(address, "/"),
+		httpClient: httpClient,
+	}
+}
+
+func (client *Client) SessionToken() string {
+	client.mux.RLock()
+	defer client.mux.RUnlock()
+
+	return client.sessionToken
+}
+
+// SetSessionToken lets a BFF reuse a token obtained elsewhere.
+func (client *Client) SetSessionToken(sessionToken string) {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+
+	client.sessionToken = sessionToken
+}
+
+type statusErrors map[int]error
+
+func (client *Client) do(
+	ctx context.Context,
+	method string,
+	path string,
+	contentType string,
+	body []byte,
+	errs statusErrors,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, client.address+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if sessionToken := client.SessionToken(); sessionToken != "" {
+		req.AddCookie(&http.Cookie{Name: registrationHandlers.SessionTokenName, Value: sessionToken})
+	}
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == registrationHandlers.SessionTokenName {
+			client.SetSessionToken(cookie.Value)
+		}
+	}
+
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	if err, ok := errs[resp.StatusCode]; ok {
+		return nil, err
+	}
+
+	// the login or the password breaks the policy
+	if resp.StatusCode == http.StatusBadRequest && resp.Header.Get("Content-Type") == common.ApplicationJSONStr {
+		validationErrs := registrationHandlers.ValidationErrorsResponse{}
+		if json.NewDecoder(resp.Body).Decode(&validationErrs) == nil && len(validationErrs.Errors) != 0 {
+			return nil, validationErrs.Errors
+		}
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &StatusError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(message)),
+	}
+}
+
+// getJSON leaves dst untouched on 204 No Content.
+func (client *Client) getJSON(ctx context.Context, path string, dst interface{}) error {
+	resp, err := client.do(ctx, http.MethodGet, path, "", nil, statusErrors{
+		http.StatusUnauthorized: ErrUnauthorized,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+func (client *Client) postJSON(ctx context.Context, path string, src interface{}, errs statusErrors) error {
+	body, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.do(ctx, http.MethodPost, path, common.ApplicationJSONStr, body, errs)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Register creates a user and logs the client in. A login or a password
+// breaking the policy gives ValidationErrors.
+func (client *Client) Register(ctx context.Context, login string, password string) error {
+	return client.postJSON(ctx, "/api/user/register", UserRequest{Login: login, Password: password}, statusErrors{
+		http.StatusConflict: ErrLoginOccupied,
+	})
+}
+
+func (client *Client) Login(ctx context.Context, login string, password string) error {
+	return client.postJSON(ctx, "/api/user/login", UserRequest{Login: login, Password: password}, statusErrors{
+		http.StatusUnauthorized:    ErrUnknownUser,
+		http.StatusTooManyRequests: ErrTooManyAttempts,
+	})
+}
+
+// Logout ends the session of the client.
+func (client *Client) Logout(ctx context.Context) error {
+	return client.logout(ctx, "/api/user/logout")
+}
+
+// LogoutEverywhere ends every session of the user.
+func (client *Client) LogoutEverywhere(ctx context.Context) error {
+	return client.logout(ctx, "/api/user/logout/all")
+}
+
+func (client *Client) logout(ctx context.Context, path string) error {
+	resp, err := client.do(ctx, http.MethodPost, path, "", nil, statusErrors{
+		http.StatusUnauthorized: ErrUnauthorized,
+	})
+	if err != nil {
+		return err
+	}
+
+	client.SetSessionToken("")
+
+	return resp.Body.Close()
+}
+
+// ChangePassword keeps the session of the client, other sessions end.
+func (client *Client) ChangePassword(ctx context.Context, oldPassword string, newPassword string) error {
+	return client.postJSON(ctx, "/api/user/password", ChangePasswordRequest{
+		OldPassword: oldPassword,
+		NewPassword: newPassword,
+	}, statusErrors{
+		http.StatusUnauthorized: ErrUnauthorized,
+		http.StatusForbidden:    ErrWrongPassword,
+	})
+}
+
+// DeleteAccount removes the user. Orders and withdrawals are kept anonymized.
+func (client *Client) DeleteAccount(ctx context.Context) error {
+	resp, err := client.do(ctx, http.MethodDelete, "/api/user", "", nil, statusErrors{
+		http.StatusUnauthorized: ErrUnauthorized,
+	})
+	if err != nil {
+		return err
+	}
+
+	client.SetSessionToken("")
+
+	return resp.Body.Close()
+}
+
+// SetOrder uploads an order number for accrual calculation.
+func (client *Client) SetOrder(ctx context.Context, orderID string) (SetOrderStatus, error) {
+	resp, err := client.do(ctx, http.MethodPost, "/api/user/orders", common.TextPlaneStr, []byte(orderID), statusErrors{
+		http.StatusUnauthorized:        ErrUnauthorized,
+		http.StatusConflict:            ErrOrderAlreadyAccepted,
+		http.StatusUnprocessableEntity: ErrInvalidOrderIDFormat,
+	})
+	if err != nil {
+		return SetOrderStatusErr, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		return SetOrderStatusAccepted, nil
+	}
+
+	return SetOrderStatusAlreadyAccepted, nil
+}
+
+func (client *Client) Orders(ctx context.Context) ([]Order, error) {
+	orders := make([]Order, 0)
+	err := client.getJSON(ctx, "/api/user/orders", &orders)
+
+	return orders, err
+}
+
+// Profile returns the user the client is logged in as, with the balance
+// and the numbers of orders and withdrawals.
+func (client *Client) Profile(ctx context.Context) (*Profile, error) {
+	profile := &Profile{}
+	err := client.getJSON(ctx, "/api/user/me", profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+func (client *Client) Balance(ctx context.Context) (*Balance, error) {
+	balance := &Balance{}
+	err := client.getJSON(ctx, "/api/user/balance", balance)
+	if err != nil {
+		return nil, err
+	}
+
+	return balance, nil
+}
+
+func (client *Client) Withdraw(ctx context.Context, orderID string, sum Money) error {
+	return client.postJSON(ctx, "/api/user/balance/withdraw", WithdrawRequest{Order: orderID, Sum: sum}, statusErrors{
+		http.StatusUnauthorized:        ErrUnauthorized,
+		http.StatusPaymentRequired:     ErrNotEnoughFunds,
+		http.StatusUnprocessableEntity: ErrInvalidOrderIDFormat,
+	})
+}
+
+func (client *Client) Withdrawals(ctx context.Context) ([]Withdrawal, error) {
+	withdrawals := make([]Withdrawal, 0)
+	err := client.getJSON(ctx, "/api/user/withdrawals", &withdrawals)
+
+	return withdrawals, err
+}
+
+// BalanceHistory returns ledger entries of the user, newest first.
+func (client *Client) BalanceHistory(ctx context.Context, page Page) ([]LedgerEntry, error) {
+	path := "/api/user/balance/history?offset=" + strconv.FormatUint(page.Offset, 10)
+	if page.Limit != 0 {
+		path += "&limit=" + strconv.FormatUint(page.Limit, 10)
+	}
+
+	entries := make([]LedgerEntry, 0)
+	err := client.getJSON(ctx, path, &entries)
+
+	return entries, err
+}
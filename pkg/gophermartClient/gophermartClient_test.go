@@ -0,0 +1,217 @@
+package gophermartclient_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gophermartHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/gophermartHandlers"
+	registrationHandlers "github.com/GermanVor/go-tpl/cmd/gophermart/registrationHandlers"
+	gophermartStor "github.com/GermanVor/go-tpl/internal/gophermartStor"
+	userStor "github.com/GermanVor/go-tpl/internal/userStor"
+	gophermartClient "github.com/GermanVor/go-tpl/pkg/gophermartClient"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	orderID = "70757088342"
+	login   = "Qwerty"
+	pass    = "Secret-2022"
+)
+
+func createTestEnv() (string, func()) {
+	gophermartStorage := gophermartStor.InitMemory("", "", 0)
+	userStorage := userStor.InitMemory(gophermartStorage, userStor.DefaultSessionTTL, userStor.DefaultHashPolicy)
+
+	r := chi.NewRouter()
+
+	r.Group(func(r chi.Router) {
+		registrationHandlers.InitRouter(r, userStorage)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(func(h http.Handler) http.Handler {
+			return registrationHandlers.CheckUserTokenMiddleware(h, userStorage)
+		})
+
+		registrationHandlers.InitPrivateRouter(r, userStorage)
+		registrationHandlers.InitProfileRouter(r, userStorage, gophermartStorage)
+		gophermartHandlers.InitRouter(r, gophermartStorage)
+	})
+
+	ts := httptest.NewServer(r)
+
+	return ts.URL, ts.Close
+}
+
+func TestRegistration(t *testing.T) {
+	endpointURL, destructor := createTestEnv()
+	defer destructor()
+
+	ctx := context.Background()
+
+	client := gophermartClient.NewClient(endpointURL, nil)
+	require.NoError(t, client.Register(ctx, login, pass))
+	assert.NotEmpty(t, client.SessionToken())
+
+	t.Run("Login is occupied", func(t *testing.T) {
+		err := gophermartClient.NewClient(endpointURL, nil).Register(ctx, login, pass)
+		assert.ErrorIs(t, err, gophermartClient.ErrLoginOccupied)
+	})
+
+	t.Run("Login differs in case", func(t *testing.T) {
+		err := gophermartClient.NewClient(endpointURL, nil).Register(ctx, strings.ToUpper(login), pass)
+		assert.ErrorIs(t, err, gophermartClient.ErrLoginOccupied)
+	})
+
+	t.Run("Invalid credentials", func(t *testing.T) {
+		err := gophermartClient.NewClient(endpointURL, nil).Register(ctx, "a b", "short")
+		assert.ErrorIs(t, err, gophermartClient.ErrInvalidCredentials)
+
+		validationErrs := gophermartClient.ValidationErrors{}
+		require.ErrorAs(t, err, &validationErrs)
+		assert.Len(t, validationErrs, 3)
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		client := gophermartClient.NewClient(endpointURL, nil)
+		require.NoError(t, client.Login(ctx, login, pass))
+		assert.NotEmpty(t, client.SessionToken())
+
+		_, err := client.Balance(ctx)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		err := gophermartClient.NewClient(endpointURL, nil).Login(ctx, login, pass+"@")
+		assert.ErrorIs(t, err, gophermartClient.ErrUnknownUser)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		_, err := gophermartClient.NewClient(endpointURL, nil).Orders(ctx)
+		assert.ErrorIs(t, err, gophermartClient.ErrUnauthorized)
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		client := gophermartClient.NewClient(endpointURL, nil)
+		require.NoError(t, client.Login(ctx, login, pass))
+
+		sessionToken := client.SessionToken()
+		require.NoError(t, client.Logout(ctx))
+		assert.Empty(t, client.SessionToken())
+
+		client.SetSessionToken(sessionToken)
+		_, err := client.Orders(ctx)
+		assert.ErrorIs(t, err, gophermartClient.ErrUnauthorized)
+	})
+}
+
+func TestOrdersAndBalance(t *testing.T) {
+	endpointURL, destructor := createTestEnv()
+	defer destructor()
+
+	ctx := context.Background()
+
+	client := gophermartClient.NewClient(endpointURL, nil)
+	require.NoError(t, client.Register(ctx, login, pass))
+
+	t.Run("No orders", func(t *testing.T) {
+		orders, err := client.Orders(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, orders)
+	})
+
+	t.Run("Set order", func(t *testing.T) {
+		status, err := client.SetOrder(ctx, orderID)
+		require.NoError(t, err)
+		assert.Equal(t, gophermartClient.SetOrderStatusAccepted, status)
+
+		status, err = client.SetOrder(ctx, orderID)
+		require.NoError(t, err)
+		assert.Equal(t, gophermartClient.SetOrderStatusAlreadyAccepted, status)
+
+		_, err = client.SetOrder(ctx, "12345")
+		assert.ErrorIs(t, err, gophermartClient.ErrInvalidOrderIDFormat)
+
+		orders, err := client.Orders(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(orders))
+		assert.Equal(t, orderID, orders[0].Number)
+		assert.Equal(t, gophermartClient.OrderStatusNew, orders[0].Status)
+	})
+
+	t.Run("Order of another user", func(t *testing.T) {
+		anotherClient := gophermartClient.NewClient(endpointURL, nil)
+		require.NoError(t, anotherClient.Register(ctx, login+"2", pass))
+
+		_, err := anotherClient.SetOrder(ctx, orderID)
+		assert.ErrorIs(t, err, gophermartClient.ErrOrderAlreadyAccepted)
+	})
+
+	t.Run("Balance", func(t *testing.T) {
+		balance, err := client.Balance(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, gophermartClient.Money(0), balance.Current)
+	})
+
+	t.Run("Profile", func(t *testing.T) {
+		profile, err := client.Profile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, login, profile.Login)
+		assert.Equal(t, 1, profile.OrdersCount)
+		assert.Equal(t, 0, profile.WithdrawalsCount)
+	})
+
+	t.Run("Not enough funds", func(t *testing.T) {
+		sum, err := gophermartClient.ParseMoney("10")
+		require.NoError(t, err)
+
+		err = client.Withdraw(ctx, orderID, sum)
+		assert.ErrorIs(t, err, gophermartClient.ErrNotEnoughFunds)
+
+		withdrawals, err := client.Withdrawals(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, withdrawals)
+
+		entries, err := client.BalanceHistory(ctx, gophermartClient.Page{})
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestDeleteAccount(t *testing.T) {
+	endpointURL, destructor := createTestEnv()
+	defer destructor()
+
+	ctx := context.Background()
+
+	client := gophermartClient.NewClient(endpointURL, nil)
+	require.NoError(t, client.Register(ctx, login, pass))
+
+	_, err := client.SetOrder(ctx, orderID)
+	require.NoError(t, err)
+
+	err = client.ChangePassword(ctx, pass+"@", pass+"2")
+	assert.ErrorIs(t, err, gophermartClient.ErrWrongPassword)
+
+	require.NoError(t, client.DeleteAccount(ctx))
+
+	_, err = client.Orders(ctx)
+	assert.ErrorIs(t, err, gophermartClient.ErrUnauthorized)
+
+	t.Run("Order number stays taken", func(t *testing.T) {
+		client := gophermartClient.NewClient(endpointURL, nil)
+		require.NoError(t, client.Register(ctx, login, pass))
+
+		_, err := client.SetOrder(ctx, orderID)
+		assert.ErrorIs(t, err, gophermartClient.ErrOrderAlreadyAccepted)
+
+		orders, err := client.Orders(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, orders)
+	})
+}